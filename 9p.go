@@ -54,6 +54,11 @@ func (t Tag) GetTag() Tag {
 	return t
 }
 
+// SetTag is a convenience method to set the tag without type asserting.
+func (t *Tag) SetTag(nt Tag) {
+	*t = nt
+}
+
 // Fid is a "file identifier", and is quite similar in concept to a file
 // descriptor, and is used to keep track of a file and its potential opening
 // mode. The client is responsible for providing a unique Fid to use. The Fid
@@ -736,6 +741,7 @@ func (wr *WalkResponse) Unmarshal(b []byte) error {
 		wr.Qids[i].Type = QidType(b[idx])
 		wr.Qids[i].Version = binary.LittleEndian.Uint32(b[idx+1 : idx+5])
 		wr.Qids[i].Path = binary.LittleEndian.Uint64(b[idx+5 : idx+13])
+		idx += 13
 	}
 	return nil
 }
@@ -56,6 +56,9 @@ const (
 	NOFID Fid = 0xFFFFFFFF
 )
 
+// MAXWELEM is the maximum amount of names in a single walk request.
+const MAXWELEM = 16
+
 // Opening modes.
 const (
 	OREAD OpenMode = iota
@@ -63,9 +66,9 @@ const (
 	ORDWR
 	OEXEC
 
-	OTRUNC OpenMode = 16 * (iota + 1)
-	OCEXEC
-	ORCLOSE
+	OTRUNC  OpenMode = 0x10
+	OCEXEC  OpenMode = 0x20
+	ORCLOSE OpenMode = 0x40
 )
 
 // Permission bits.
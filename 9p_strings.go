@@ -0,0 +1,165 @@
+package qp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidFlags indicates that a symbolic flag string could not be parsed.
+var ErrInvalidFlags = errors.New("invalid flags")
+
+// flagName maps a single flag value to its symbolic name.
+type flagName struct {
+	value uint32
+	name  string
+}
+
+var qidTypeNames = []flagName{
+	{uint32(QTDIR), "QTDIR"},
+	{uint32(QTAPPEND), "QTAPPEND"},
+	{uint32(QTEXCL), "QTEXCL"},
+	{uint32(QTMOUNT), "QTMOUNT"},
+	{uint32(QTAUTH), "QTAUTH"},
+	{uint32(QTTMP), "QTTMP"},
+	{uint32(QTSYMLINK), "QTSYMLINK"},
+	{uint32(QTLINK), "QTLINK"},
+}
+
+var fileModeNames = []flagName{
+	{uint32(DMDIR), "DMDIR"},
+	{uint32(DMAPPEND), "DMAPPEND"},
+	{uint32(DMEXCL), "DMEXCL"},
+	{uint32(DMMOUNT), "DMMOUNT"},
+	{uint32(DMAUTH), "DMAUTH"},
+	{uint32(DMTMP), "DMTMP"},
+	{uint32(DMSYMLINK), "DMSYMLINK"},
+	{uint32(DMLINK), "DMLINK"},
+	{uint32(DMDEVICE), "DMDEVICE"},
+	{uint32(DMNAMEDPIPE), "DMNAMEDPIPE"},
+	{uint32(DMSOCKET), "DMSOCKET"},
+	{uint32(DMSETUID), "DMSETUID"},
+	{uint32(DMSETGID), "DMSETGID"},
+}
+
+var openModeNames = []flagName{
+	{uint32(OTRUNC), "OTRUNC"},
+	{uint32(OCEXEC), "OCEXEC"},
+	{uint32(ORCLOSE), "ORCLOSE"},
+}
+
+var openModeBaseNames = []string{"OREAD", "OWRITE", "ORDWR", "OEXEC"}
+
+// formatFlags appends the names of the set flags to parts, followed by any
+// remaining unnamed bits in hexadecimal.
+func formatFlags(parts []string, v uint32, names []flagName) []string {
+	for _, f := range names {
+		if v&f.value == f.value {
+			parts = append(parts, f.name)
+			v &^= f.value
+		}
+	}
+	if v != 0 {
+		parts = append(parts, fmt.Sprintf("%#x", v))
+	}
+	return parts
+}
+
+// parseFlags parses a "|"-separated list of flag names and numbers.
+func parseFlags(s string, bits int, names []flagName, extra map[string]uint32) (uint32, error) {
+	var v uint32
+outer:
+	for _, tok := range strings.Split(s, "|") {
+		tok = strings.TrimSpace(tok)
+		for _, f := range names {
+			if tok == f.name {
+				v |= f.value
+				continue outer
+			}
+		}
+		if x, ok := extra[tok]; ok {
+			v |= x
+			continue
+		}
+		x, err := strconv.ParseUint(tok, 0, bits)
+		if err != nil {
+			return 0, ErrInvalidFlags
+		}
+		v |= uint32(x)
+	}
+	return v, nil
+}
+
+// String returns the symbolic representation of the Qid type, such as
+// "QTDIR|QTAPPEND", or "QTFILE" if no bits are set.
+func (qt QidType) String() string {
+	if qt == QTFILE {
+		return "QTFILE"
+	}
+	return strings.Join(formatFlags(nil, uint32(qt), qidTypeNames), "|")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (qt QidType) MarshalText() ([]byte, error) {
+	return []byte(qt.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (qt *QidType) UnmarshalText(b []byte) error {
+	v, err := parseFlags(string(b), 8, qidTypeNames, map[string]uint32{"QTFILE": 0})
+	if err != nil {
+		return err
+	}
+	*qt = QidType(v)
+	return nil
+}
+
+// String returns the symbolic representation of the file mode, such as
+// "DMDIR|0755". The permission bits are always present in octal.
+func (fm FileMode) String() string {
+	parts := formatFlags(nil, uint32(fm)&^0777, fileModeNames)
+	parts = append(parts, "0"+strconv.FormatUint(uint64(fm&0777), 8))
+	return strings.Join(parts, "|")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (fm FileMode) MarshalText() ([]byte, error) {
+	return []byte(fm.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (fm *FileMode) UnmarshalText(b []byte) error {
+	v, err := parseFlags(string(b), 32, fileModeNames, nil)
+	if err != nil {
+		return err
+	}
+	*fm = FileMode(v)
+	return nil
+}
+
+// String returns the symbolic representation of the open mode, such as
+// "ORDWR|OTRUNC".
+func (om OpenMode) String() string {
+	parts := []string{openModeBaseNames[om&3]}
+	return strings.Join(formatFlags(parts, uint32(om)&^3, openModeNames), "|")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (om OpenMode) MarshalText() ([]byte, error) {
+	return []byte(om.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (om *OpenMode) UnmarshalText(b []byte) error {
+	base := make(map[string]uint32, len(openModeBaseNames))
+	for i, n := range openModeBaseNames {
+		base[n] = uint32(i)
+	}
+	v, err := parseFlags(string(b), 8, openModeNames, base)
+	if err != nil {
+		return err
+	}
+	*om = OpenMode(v)
+	return nil
+}
@@ -69,7 +69,7 @@ var PrimitiveTestData = []PrimitiveTestEntry{
 			Type:   0xDEAD,
 			Dev:    0xABCDEF08,
 			Qid:    Qid{},
-			Mode:   FileMode(OTRUNC),
+			Mode:   FileMode(0x50),
 			Atime:  90870987,
 			Mtime:  1234124,
 			Length: 0x23ABDDF8,
@@ -376,3 +376,29 @@ func TestReencode(t *testing.T) {
 		reencode(i, tt.input, tt.reference, t, NineP2000)
 	}
 }
+
+// TestOpenModes checks the open modes against the values of Plan 9, which
+// are bits that can be combined with the access mode.
+func TestOpenModes(t *testing.T) {
+	modes := []struct {
+		mode OpenMode
+		want uint8
+	}{
+		{OREAD, 0}, {OWRITE, 1}, {ORDWR, 2}, {OEXEC, 3},
+		{OTRUNC, 0x10}, {OCEXEC, 0x20}, {ORCLOSE, 0x40},
+	}
+	for _, m := range modes {
+		if uint8(m.mode) != m.want {
+			t.Errorf("%d is %#x, expected %#x", m.mode, uint8(m.mode), m.want)
+		}
+	}
+
+	m := &OpenRequest{Tag: 1, Fid: 2, Mode: ORDWR | OTRUNC | ORCLOSE}
+	b := make([]byte, m.EncodedSize())
+	if err := m.Marshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if b[len(b)-1] != 0x52 {
+		t.Errorf("ORDWR|OTRUNC|ORCLOSE encoded as %#x, expected 0x52", b[len(b)-1])
+	}
+}
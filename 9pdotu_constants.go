@@ -3,6 +3,9 @@ package qp
 // VersionDotu is the 9P2000.u version string.
 const VersionDotu = "9P2000.u"
 
+// NONUNAME is used in place of a numeric user ID when none is provided.
+const NONUNAME uint32 = 0xFFFFFFFF
+
 // Permissions bits for 9P2000.u.
 const (
 	DMSYMLINK   FileMode = 0x02000000
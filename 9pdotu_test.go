@@ -23,7 +23,7 @@ var PrimitiveTestDataDotu = []PrimitiveTestEntry{
 			Type:       0xDEAD,
 			Dev:        0xABCDEF08,
 			Qid:        Qid{},
-			Mode:       FileMode(OTRUNC),
+			Mode:       FileMode(0x50),
 			Atime:      90870987,
 			Mtime:      1234124,
 			Length:     0x23ABDDF8,
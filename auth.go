@@ -0,0 +1,308 @@
+package qp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+var (
+	// ErrAuthFailed indicates an authentication conversation in which the
+	// other side failed to prove its identity.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrAuthPhase indicates a read or write of an auth file at a point of
+	// the conversation where the other operation is expected.
+	ErrAuthPhase = errors.New("authentication protocol phase error")
+
+	// ErrAuthRequired indicates an attach without a completed authentication,
+	// made to a server that requires one.
+	ErrAuthRequired = errors.New("authentication required")
+)
+
+// AuthConn carries the messages of an authentication conversation. On the
+// client, each message is exchanged with a single read or write of the auth
+// file.
+type AuthConn interface {
+	// ReadMessage returns the next message from the other side.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage sends a message to the other side.
+	WriteMessage(msg []byte) error
+}
+
+// AuthConv is the server side of an authentication conversation. Reads of
+// the auth file are served by ReadMessage, and writes by WriteMessage. As
+// the requests on an auth file may be served concurrently, the methods must
+// be safe for concurrent use.
+type AuthConv interface {
+	AuthConn
+
+	// Authenticated returns the user that has been authenticated, and
+	// whether the conversation has completed successfully.
+	Authenticated() (string, bool)
+}
+
+// Authenticator starts the authentication conversations of a Server.
+type Authenticator interface {
+	// Start starts a conversation authenticating the user uname for the
+	// tree aname, as requested by a Tauth.
+	Start(uname, aname string) (AuthConv, error)
+}
+
+// ClientAuthenticator is the client side of an authentication protocol.
+type ClientAuthenticator interface {
+	// Authenticate runs the conversation authenticating the user for the
+	// service over the connection.
+	Authenticate(conn AuthConn, user, service string) error
+}
+
+// authExchange implements AuthConv for protocols in which the server and
+// client take turns, starting with the server. Each message written by the
+// client is passed to the next step, which returns the reply of the server,
+// if any. The conversation completes once all steps have succeeded, and
+// fails for good once a step fails.
+type authExchange struct {
+	mu    sync.Mutex
+	user  string
+	out   []byte
+	steps []func(msg []byte) ([]byte, error)
+	err   error
+}
+
+// ReadMessage implements AuthConv.
+func (x *authExchange) ReadMessage() ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.err != nil {
+		return nil, x.err
+	}
+	if x.out == nil {
+		return nil, ErrAuthPhase
+	}
+	msg := x.out
+	x.out = nil
+	return msg, nil
+}
+
+// WriteMessage implements AuthConv.
+func (x *authExchange) WriteMessage(msg []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.err != nil {
+		return x.err
+	}
+	if x.out != nil || len(x.steps) == 0 {
+		return ErrAuthPhase
+	}
+	step := x.steps[0]
+	x.steps = x.steps[1:]
+	reply, err := step(msg)
+	if err != nil {
+		x.err = err
+		return err
+	}
+	x.out = reply
+	return nil
+}
+
+// Authenticated implements AuthConv.
+func (x *authExchange) Authenticated() (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.user, x.err == nil && len(x.steps) == 0
+}
+
+// authNode is the node of an auth fid, exposing the conversation as a file.
+type authNode struct {
+	conv  AuthConv
+	qid   Qid
+	uname string
+}
+
+func (n *authNode) Qid() Qid { return n.qid }
+
+func (n *authNode) Walk(names []string) ([]Qid, Node, error) {
+	return nil, nil, ErrNotDirectory
+}
+
+func (n *authNode) Open(mode OpenMode) (uint32, error) {
+	return 0, nil
+}
+
+func (n *authNode) Create(name string, perm FileMode, mode OpenMode) (Node, uint32, error) {
+	return nil, 0, ErrNotDirectory
+}
+
+// Read returns the next message of the conversation, which must fit the
+// read as a whole.
+func (n *authNode) Read(p []byte, off uint64) (int, error) {
+	msg, err := n.conv.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, msg), nil
+}
+
+// Write passes the data to the conversation as a single message.
+func (n *authNode) Write(p []byte, off uint64) (int, error) {
+	if err := n.conv.WriteMessage(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (n *authNode) Stat() (Stat, error) {
+	return Stat{
+		Qid:  n.qid,
+		Mode: DMAUTH | 0600,
+		Name: "auth",
+		UID:  n.uname,
+		GID:  n.uname,
+		MUID: n.uname,
+	}, nil
+}
+
+func (n *authNode) WriteStat(s Stat) error {
+	return fs.ErrPermission
+}
+
+func (n *authNode) Remove() error {
+	return nil
+}
+
+func (n *authNode) Clunk() error {
+	return nil
+}
+
+// auth handles a Tauth by starting a conversation on the afid, which is
+// ready for reads and writes without being opened.
+func (sc *serverConn) auth(t Tag, afid Fid, uname, aname string) (Message, error) {
+	a := sc.srv.Auth
+	if a == nil {
+		return nil, ErrNoAuth
+	}
+	if _, err := sc.fid(afid); err == nil {
+		return nil, ErrFidInUse
+	}
+	conv, err := a.Start(uname, aname)
+	if err != nil {
+		return nil, err
+	}
+
+	qid := Qid{Type: QTAUTH, Path: sc.srv.authPath.Add(1)}
+	f := &serverFid{
+		node:  &authNode{conv: conv, qid: qid, uname: uname},
+		uname: uname,
+		aname: aname,
+		open:  true,
+		mode:  ORDWR,
+	}
+	if err := sc.bind(afid, f); err != nil {
+		return nil, err
+	}
+	return &AuthResponse{Tag: t, AuthQid: qid}, nil
+}
+
+// authenticated checks the afid of an attach for the user. Servers without
+// an Authenticator reject afids, while servers with one require an afid
+// whose conversation has authenticated the user.
+func (sc *serverConn) authenticated(afid Fid, uname string) error {
+	if info := sc.secure; info != nil && afid == NOFID {
+		if uname != info.CUID {
+			return fs.ErrPermission
+		}
+		return nil
+	}
+	if sc.srv.Auth == nil {
+		if afid != NOFID {
+			return ErrNoAuth
+		}
+		return nil
+	}
+	if afid == NOFID {
+		return ErrAuthRequired
+	}
+	f, err := sc.fid(afid)
+	if err != nil {
+		return err
+	}
+	n, ok := f.node.(*authNode)
+	if !ok {
+		return ErrAuthRequired
+	}
+	user, ok := n.conv.Authenticated()
+	if !ok || user != uname {
+		return ErrAuthRequired
+	}
+	return nil
+}
+
+// fileAuthConn carries a conversation over an auth file, exchanging each
+// message with a single read or write.
+type fileAuthConn struct {
+	f *File
+}
+
+func (fc fileAuthConn) ReadMessage() ([]byte, error) {
+	buf := make([]byte, fc.f.readUnit())
+	n, err := fc.f.read(context.Background(), buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (fc fileAuthConn) WriteMessage(msg []byte) error {
+	if uint32(len(msg)) > fc.f.writeUnit() {
+		return io.ErrShortWrite
+	}
+	_, err := fc.f.write(context.Background(), msg, 0)
+	return err
+}
+
+// AuthAttach authenticates the user for the service with a Tauth
+// conversation run by auth, and attaches with the resulting auth file, which
+// is clunked afterwards. See Attach.
+func (c *Client) AuthAttach(auth ClientAuthenticator, user, service string) (*File, error) {
+	afid, err := c.Auth(user, service)
+	if err != nil {
+		return nil, err
+	}
+	defer afid.Close()
+	if err := auth.Authenticate(fileAuthConn{afid}, user, service); err != nil {
+		return nil, err
+	}
+	return c.Attach(afid, user, service)
+}
+
+// authNonceSize is the size of the challenges of the built-in protocols.
+const authNonceSize = 32
+
+// authNonce returns a random challenge.
+func authNonce() ([]byte, error) {
+	b := make([]byte, authNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// authTranscript encodes the label and parts as the data proven by a
+// response, with each part prefixed by its size, so that the boundaries of
+// the parts cannot be shifted.
+func authTranscript(label string, parts ...[]byte) []byte {
+	b := append([]byte(label), 0)
+	for _, p := range parts {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
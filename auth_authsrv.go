@@ -0,0 +1,183 @@
+package qp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+)
+
+// AuthServer connects to the auth servers that issue tickets for Plan 9
+// authentication domains, as described in authsrv(6).
+type AuthServer interface {
+	// DialAuth connects to the auth server of the domain.
+	DialAuth(domain string) (io.ReadWriteCloser, error)
+}
+
+// AuthServerAddr is an AuthServer reached at a dial string for all
+// domains, such as "tcp!auth!ticket". See ParseDialString.
+type AuthServerAddr string
+
+// DialAuth implements AuthServer.
+func (addr AuthServerAddr) DialAuth(domain string) (io.ReadWriteCloser, error) {
+	network, address, err := ParseDialString(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial(network, address)
+}
+
+// LocalAuthServer is an auth server running in the process, standing in for
+// the auth server of a domain in tests and self-contained setups. It issues
+// DES tickets for p9sk1, and form1 tickets after the PAK exchange of dp9ik.
+type LocalAuthServer struct {
+	// Keys returns the key of a user, or nil if the user is unknown.
+	// Tickets for unknown users are encrypted with a random key, so that
+	// clients cannot tell which users exist.
+	Keys func(user string) *Authkey
+
+	// SpeaksFor reports whether the host user may obtain tickets for
+	// another user. If nil, hosts only speak for themselves.
+	SpeaksFor func(hostID, uid string) bool
+}
+
+// DialAuth implements AuthServer, serving each connection in a new
+// goroutine.
+func (as *LocalAuthServer) DialAuth(domain string) (io.ReadWriteCloser, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		as.ServeConn(c2)
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+// key returns the key of a user, making up a random key for unknown users.
+func (as *LocalAuthServer) key(user string) *Authkey {
+	if k := as.Keys(user); k != nil {
+		return k
+	}
+	k := new(Authkey)
+	rand.Read(k.DES[:])
+	rand.Read(k.AES[:])
+	return k
+}
+
+// pakKeys holds the keys resulting from the PAK exchanges of a connection.
+type pakKeys struct {
+	authID, hostID string
+	auth, host     []byte
+}
+
+// ServeConn serves ticket requests on the connection until it fails. A PAK
+// request performs the exchanges for the authid and hostid of the request,
+// after which tickets for the same ids are issued in form1.
+func (as *LocalAuthServer) ServeConn(rw io.ReadWriter) error {
+	var pak *pakKeys
+	buf := make([]byte, TICKREQLEN)
+	for {
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return err
+		}
+		tr, err := unmarshalTicketReq(buf)
+		if err != nil {
+			return err
+		}
+
+		var resp []byte
+		switch tr.typ {
+		case AuthPAK:
+			pak, resp, err = as.pak(rw, tr)
+		case AuthTreq:
+			resp, err = as.ticket(tr, pak)
+		default:
+			err = ErrAuthProtocol
+		}
+		if err != nil {
+			msg := make([]byte, 1+AERRLEN)
+			msg[0] = AuthErr
+			putString(msg[1:], err.Error())
+			resp = msg
+		}
+		if _, err := rw.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// pak performs the PAK exchanges of a request, reading the public values of
+// the authid and the hostid, and returning the keys and the reply.
+func (as *LocalAuthServer) pak(r io.Reader, tr *ticketReq) (*pakKeys, []byte, error) {
+	ys := make([]byte, 2*pakSize)
+	if _, err := io.ReadFull(r, ys); err != nil {
+		return nil, nil, err
+	}
+	keys := &pakKeys{authID: tr.authID, hostID: tr.hostID}
+	resp := []byte{AuthOK}
+	for i, user := range []string{tr.authID, tr.hostID} {
+		hash, err := newPakHash(as.key(user).AES[:], user)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, err := newPak(hash, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := p.finish(ys[i*pakSize : (i+1)*pakSize])
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			keys.auth = key
+		} else {
+			keys.host = key
+		}
+		resp = append(resp, p.y...)
+	}
+	return keys, resp, nil
+}
+
+// ticket issues the tickets of a request: one for the client encrypted with
+// the key of the hostid, and one for the server encrypted with the key of the
+// authid.
+func (as *LocalAuthServer) ticket(tr *ticketReq, pak *pakKeys) ([]byte, error) {
+	speaks := tr.hostID == tr.uid
+	if as.SpeaksFor != nil && !speaks {
+		speaks = as.SpeaksFor(tr.hostID, tr.uid)
+	}
+	if !speaks {
+		return nil, ErrAuthFailed
+	}
+
+	t := &ticket{chal: tr.chal, cuid: tr.uid, suid: tr.uid}
+	akey, hkey := as.key(tr.authID), as.key(tr.hostID)
+	ak := &authKeys{des: &akey.DES}
+	hk := &authKeys{des: &hkey.DES}
+	if pak != nil && pak.authID == tr.authID && pak.hostID == tr.hostID {
+		t.form = 1
+		ak.pak, hk.pak = pak.auth, pak.host
+		t.key = make([]byte, NONCELEN)
+	} else {
+		t.key = make([]byte, DESKEYLEN)
+	}
+	rand.Read(t.key)
+
+	resp := []byte{AuthOK}
+	t.num = AuthTc
+	resp = append(resp, t.marshal(hk)...)
+	t.num = AuthTs
+	resp = append(resp, t.marshal(ak)...)
+	return resp, nil
+}
+
+// readTicket reads a ticket of either form from the auth server.
+func readTicket(r io.Reader) ([]byte, error) {
+	b := make([]byte, 8, form1TicketLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	b = b[:ticketLen(b)]
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,68 @@
+package qp
+
+import (
+	"crypto/ed25519"
+)
+
+// Ed25519Auth is an Authenticator for a public key challenge:
+//
+//	server -> client: a random challenge
+//	client -> server: the ed25519 signature of the challenge, the user and
+//	                  the service
+//
+// The user is authenticated once the signature has been verified with one of
+// the keys of the user. Unlike SharedSecretAuth, the server is not
+// authenticated to the client. Ed25519Client implements the client side.
+type Ed25519Auth struct {
+	// Keys returns the public keys of the user. An error fails the
+	// conversation, without telling the client whether the user exists.
+	Keys func(user string) ([]ed25519.PublicKey, error)
+}
+
+// ed25519Message returns the data signed by the client.
+func ed25519Message(chal []byte, user, service string) []byte {
+	return authTranscript("qp ed25519", chal, []byte(user), []byte(service))
+}
+
+// Start implements Authenticator.
+func (a *Ed25519Auth) Start(uname, aname string) (AuthConv, error) {
+	chal, err := authNonce()
+	if err != nil {
+		return nil, err
+	}
+	x := &authExchange{user: uname, out: chal}
+	x.steps = append(x.steps, func(sig []byte) ([]byte, error) {
+		if len(sig) != ed25519.SignatureSize {
+			return nil, ErrAuthFailed
+		}
+		keys, err := a.Keys(uname)
+		if err != nil {
+			return nil, ErrAuthFailed
+		}
+		msg := ed25519Message(chal, uname, aname)
+		for _, key := range keys {
+			if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, msg, sig) {
+				return nil, nil
+			}
+		}
+		return nil, ErrAuthFailed
+	})
+	return x, nil
+}
+
+// Ed25519Client is the client side of Ed25519Auth.
+type Ed25519Client struct {
+	Key ed25519.PrivateKey
+}
+
+// Authenticate implements ClientAuthenticator.
+func (ec *Ed25519Client) Authenticate(conn AuthConn, user, service string) error {
+	chal, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if len(chal) != authNonceSize {
+		return ErrAuthFailed
+	}
+	return conn.WriteMessage(ed25519.Sign(ec.Key, ed25519Message(chal, user, service)))
+}
@@ -0,0 +1,450 @@
+package qp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Sizes of the fields of Plan 9 authentication messages. See authsrv(6).
+const (
+	ANAMELEN   = 28
+	DOMLEN     = 48
+	DESKEYLEN  = 7
+	AESKEYLEN  = 16
+	CHALLEN    = 8
+	NONCELEN   = 32
+	AERRLEN    = 64
+	PASSWDLEN  = 28
+	TICKREQLEN = 3*ANAMELEN + CHALLEN + DOMLEN + 1
+)
+
+// Message types of the Plan 9 authentication protocols.
+const (
+	AuthTreq = 1
+	AuthOK   = 4
+	AuthErr  = 5
+	AuthPAK  = 19
+	AuthTs   = 64
+	AuthTc   = 65
+	AuthAs   = 66
+	AuthAc   = 67
+)
+
+const (
+	// desTicketLen and desAuthenticatorLen are the sizes of the DES
+	// encrypted tickets and authenticators of p9sk1.
+	desTicketLen        = 1 + CHALLEN + 2*ANAMELEN + DESKEYLEN
+	desAuthenticatorLen = 1 + CHALLEN + 4
+
+	// form1TicketLen and form1AuthenticatorLen are the sizes of the
+	// ChaCha20-Poly1305 encrypted tickets and authenticators of dp9ik.
+	form1TicketLen        = 12 + CHALLEN + 2*ANAMELEN + NONCELEN + chacha20poly1305.Overhead
+	form1AuthenticatorLen = 12 + CHALLEN + NONCELEN + chacha20poly1305.Overhead
+)
+
+// ErrAuthProtocol indicates a malformed message of an authentication
+// protocol.
+var ErrAuthProtocol = errors.New("authentication protocol botch")
+
+// Authkey holds the keys of a user of a Plan 9 authentication domain.
+type Authkey struct {
+	// DES is the key of p9sk1.
+	DES [DESKEYLEN]byte
+
+	// AES is the key of dp9ik, from which the PAK hash is derived.
+	AES [AESKEYLEN]byte
+}
+
+// PassToKey derives the keys of a password, as passtokey(2) does.
+func PassToKey(password string) *Authkey {
+	k := new(Authkey)
+	passToDESKey(&k.DES, password)
+	aes, err := pbkdf2.Key(sha1.New, password, []byte("Plan 9 key derivation"), 9001, AESKEYLEN)
+	if err != nil {
+		panic(err)
+	}
+	copy(k.AES[:], aes)
+	return k
+}
+
+// passToDESKey derives the DES key of a password, which is truncated to 27
+// bytes, by encrypting each 8 byte block with the key of the blocks before.
+func passToDESKey(key *[DESKEYLEN]byte, password string) {
+	var buf [PASSWDLEN]byte
+	copy(buf[:8], "        ")
+	n := copy(buf[:PASSWDLEN-1], password)
+	buf[n] = 0
+
+	off := 0
+	for {
+		t := buf[off:]
+		for i := 0; i < DESKEYLEN; i++ {
+			key[i] = t[i]>>i + t[i+1]<<(8-(i+1))
+		}
+		if n <= 8 {
+			return
+		}
+		n -= 8
+		off += 8
+		if n < 8 {
+			off -= 8 - n
+			n = 8
+		}
+		desEncrypt(key, buf[off:off+8])
+	}
+}
+
+// des56to64 expands a 56 bit key to the 64 bits of DES, with the lowest bit
+// of each byte left for parity.
+func des56to64(key *[DESKEYLEN]byte) []byte {
+	hi := uint32(key[0])<<24 | uint32(key[1])<<16 | uint32(key[2])<<8 | uint32(key[3])
+	lo := uint32(key[4])<<24 | uint32(key[5])<<16 | uint32(key[6])<<8
+	k64 := []byte{
+		byte(hi >> 25),
+		byte(hi >> 18),
+		byte(hi >> 11),
+		byte(hi >> 4),
+		byte(hi<<3 | lo>>29),
+		byte(lo >> 22),
+		byte(lo >> 15),
+		byte(lo >> 8),
+	}
+	for i := range k64 {
+		k64[i] = (k64[i] & 0x7f) << 1
+	}
+	return k64
+}
+
+// desCipher returns the DES cipher of a 56 bit key.
+func desCipher(key *[DESKEYLEN]byte) cipher.Block {
+	c, err := des.NewCipher(des56to64(key))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// desEncrypt encrypts the buffer of at least 8 bytes in place, as
+// encrypt(2) does: each 7 byte step is encrypted as an 8 byte block,
+// chaining the blocks through their overlapping byte, and the remainder is
+// covered by a final block ending at the end of the buffer.
+func desEncrypt(key *[DESKEYLEN]byte, b []byte) {
+	c := desCipher(key)
+	n := len(b) - 1
+	r := n % 7
+	n /= 7
+	for i := 0; i < n; i++ {
+		c.Encrypt(b[7*i:7*i+8], b[7*i:7*i+8])
+	}
+	if r != 0 {
+		off := 7*n - 7 + r
+		c.Encrypt(b[off:off+8], b[off:off+8])
+	}
+}
+
+// desDecrypt reverses desEncrypt.
+func desDecrypt(key *[DESKEYLEN]byte, b []byte) {
+	c := desCipher(key)
+	n := len(b) - 1
+	r := n % 7
+	n /= 7
+	if r != 0 {
+		off := 7*n - 7 + r
+		c.Decrypt(b[off:off+8], b[off:off+8])
+	}
+	for i := n - 1; i >= 0; i-- {
+		c.Decrypt(b[7*i:7*i+8], b[7*i:7*i+8])
+	}
+}
+
+// putString stores the string in the fixed size field, truncated to leave
+// room for a terminating NUL.
+func putString(b []byte, s string) {
+	clear(b)
+	copy(b[:len(b)-1], s)
+}
+
+// getString returns the NUL terminated string of the fixed size field.
+func getString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// ticketReq is a ticket request, sent by servers to clients, and by clients
+// to the auth server.
+type ticketReq struct {
+	typ     byte
+	authID  string
+	authDom string
+	chal    [CHALLEN]byte
+	hostID  string
+	uid     string
+}
+
+func (tr *ticketReq) marshal() []byte {
+	b := make([]byte, TICKREQLEN)
+	b[0] = tr.typ
+	p := b[1:]
+	putString(p[:ANAMELEN], tr.authID)
+	p = p[ANAMELEN:]
+	putString(p[:DOMLEN], tr.authDom)
+	p = p[DOMLEN:]
+	copy(p, tr.chal[:])
+	p = p[CHALLEN:]
+	putString(p[:ANAMELEN], tr.hostID)
+	p = p[ANAMELEN:]
+	putString(p[:ANAMELEN], tr.uid)
+	return b
+}
+
+func unmarshalTicketReq(b []byte) (*ticketReq, error) {
+	if len(b) < TICKREQLEN {
+		return nil, ErrAuthProtocol
+	}
+	tr := &ticketReq{typ: b[0]}
+	p := b[1:]
+	tr.authID = getString(p[:ANAMELEN])
+	p = p[ANAMELEN:]
+	tr.authDom = getString(p[:DOMLEN])
+	p = p[DOMLEN:]
+	copy(tr.chal[:], p)
+	p = p[CHALLEN:]
+	tr.hostID = getString(p[:ANAMELEN])
+	p = p[ANAMELEN:]
+	tr.uid = getString(p[:ANAMELEN])
+	return tr, nil
+}
+
+// form1Sigs are the signatures replacing the type of form1 messages, which
+// are encrypted with ChaCha20-Poly1305.
+var form1Sigs = map[byte]string{
+	AuthTs: "form1 Ts",
+	AuthTc: "form1 Tc",
+	AuthAs: "form1 As",
+	AuthAc: "form1 Ac",
+}
+
+// form1Counter numbers the form1 messages sealed by the process, making up
+// the nonce together with the signature.
+var form1Counter atomic.Uint32
+
+// form1Type returns the type of the form1 message, or 0 if the message is
+// not a form1 message.
+func form1Type(b []byte) byte {
+	if len(b) < 8 {
+		return 0
+	}
+	for typ, sig := range form1Sigs {
+		if string(b[:8]) == sig {
+			return typ
+		}
+	}
+	return 0
+}
+
+// form1Seal encrypts the message, whose first byte is its type, as a form1
+// message.
+func form1Seal(msg, key []byte) []byte {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 12, 12+len(msg)-1+chacha20poly1305.Overhead)
+	copy(b, form1Sigs[msg[0]])
+	binary.LittleEndian.PutUint32(b[8:], form1Counter.Add(1)-1)
+	return aead.Seal(b, b[:12], msg[1:], b[:12])
+}
+
+// form1Open decrypts a form1 message, returning the message with its type
+// restored as the first byte.
+func form1Open(b, key []byte) ([]byte, error) {
+	typ := form1Type(b)
+	if typ == 0 || len(b) < 12+chacha20poly1305.Overhead {
+		return nil, ErrAuthProtocol
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := aead.Open([]byte{typ}, b[:12], b[12:], b[:12])
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return msg, nil
+}
+
+// authKeys holds the keys a party decrypts its tickets with: the DES key
+// for p9sk1, and for dp9ik, the key resulting from the PAK exchange with
+// the auth server.
+type authKeys struct {
+	des *[DESKEYLEN]byte
+	pak []byte
+}
+
+// ticket is a ticket issued by the auth server. The form is 0 for DES
+// tickets with a key of DESKEYLEN bytes, and 1 for form1 tickets with a key
+// of NONCELEN bytes.
+type ticket struct {
+	num  byte
+	chal [CHALLEN]byte
+	cuid string
+	suid string
+	key  []byte
+	form int
+}
+
+// marshal encrypts the ticket with the key of its form.
+func (t *ticket) marshal(k *authKeys) []byte {
+	b := make([]byte, 1+CHALLEN+2*ANAMELEN, 1+CHALLEN+2*ANAMELEN+NONCELEN)
+	b[0] = t.num
+	copy(b[1:], t.chal[:])
+	putString(b[1+CHALLEN:][:ANAMELEN], t.cuid)
+	putString(b[1+CHALLEN+ANAMELEN:][:ANAMELEN], t.suid)
+	b = append(b, t.key...)
+	if t.form == 0 {
+		desEncrypt(k.des, b)
+		return b
+	}
+	return form1Seal(b, k.pak)
+}
+
+// ticketLen returns the size of the ticket starting with the 8 bytes.
+func ticketLen(b []byte) int {
+	if form1Type(b) != 0 {
+		return form1TicketLen
+	}
+	return desTicketLen
+}
+
+// unmarshalTicket decrypts a ticket, returning it and its size.
+func unmarshalTicket(b []byte, k *authKeys) (*ticket, int, error) {
+	if len(b) < 8 || len(b) < ticketLen(b) {
+		return nil, 0, ErrAuthProtocol
+	}
+	t := new(ticket)
+	n := ticketLen(b)
+	var msg []byte
+	if n == form1TicketLen {
+		if k.pak == nil {
+			return nil, 0, ErrAuthFailed
+		}
+		var err error
+		if msg, err = form1Open(b[:n], k.pak); err != nil {
+			return nil, 0, err
+		}
+		t.form = 1
+	} else {
+		if k.des == nil {
+			return nil, 0, ErrAuthFailed
+		}
+		msg = append([]byte(nil), b[:n]...)
+		desDecrypt(k.des, msg)
+	}
+	t.num = msg[0]
+	copy(t.chal[:], msg[1:])
+	t.cuid = getString(msg[1+CHALLEN:][:ANAMELEN])
+	t.suid = getString(msg[1+CHALLEN+ANAMELEN:][:ANAMELEN])
+	t.key = msg[1+CHALLEN+2*ANAMELEN:]
+	return t, n, nil
+}
+
+// desKey returns the key of a DES ticket.
+func (t *ticket) desKey() *[DESKEYLEN]byte {
+	return (*[DESKEYLEN]byte)(t.key)
+}
+
+// authenticator proves knowledge of the key of a ticket. The nonce is only
+// present in form1 authenticators.
+type authenticator struct {
+	num  byte
+	chal [CHALLEN]byte
+	rand [NONCELEN]byte
+}
+
+// authenticatorLen returns the size of the authenticators for the ticket.
+func authenticatorLen(t *ticket) int {
+	if t.form == 0 {
+		return desAuthenticatorLen
+	}
+	return form1AuthenticatorLen
+}
+
+// marshal encrypts the authenticator with the key of the ticket.
+func (a *authenticator) marshal(t *ticket) []byte {
+	b := append([]byte{a.num}, a.chal[:]...)
+	if t.form == 0 {
+		b = append(b, 0, 0, 0, 0)
+		desEncrypt(t.desKey(), b)
+		return b
+	}
+	return form1Seal(append(b, a.rand[:]...), t.key)
+}
+
+// unmarshalAuthenticator decrypts an authenticator with the key of the
+// ticket.
+func unmarshalAuthenticator(b []byte, t *ticket) (*authenticator, error) {
+	if len(b) != authenticatorLen(t) {
+		return nil, ErrAuthProtocol
+	}
+	var msg []byte
+	if t.form == 0 {
+		msg = append([]byte(nil), b...)
+		desDecrypt(t.desKey(), msg)
+	} else {
+		var err error
+		if msg, err = form1Open(b, t.key); err != nil {
+			return nil, err
+		}
+	}
+	a := &authenticator{num: msg[0]}
+	copy(a.chal[:], msg[1:])
+	if t.form == 1 {
+		copy(a.rand[:], msg[1+CHALLEN:])
+	}
+	return a, nil
+}
+
+// readAuthResp reads the reply of the auth server to a request, which is
+// AuthOK followed by n bytes, or AuthErr followed by an error message.
+func readAuthResp(r io.Reader, n int) ([]byte, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return nil, err
+	}
+	switch typ[0] {
+	case AuthOK:
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case AuthErr:
+		msg := make([]byte, AERRLEN)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		return nil, &AuthServerError{Message: getString(msg)}
+	default:
+		return nil, ErrAuthProtocol
+	}
+}
+
+// AuthServerError is an error reported by an auth server.
+type AuthServerError struct {
+	Message string
+}
+
+func (e *AuthServerError) Error() string {
+	return "auth server: " + e.Message
+}
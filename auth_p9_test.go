@@ -0,0 +1,257 @@
+package qp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDESEncrypt(t *testing.T) {
+	key := &PassToKey("password").DES
+	for _, n := range []int{8, 13, 15, 72} {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		enc := append([]byte(nil), b...)
+		desEncrypt(key, enc)
+		if bytes.Equal(enc, b) {
+			t.Errorf("%d bytes: encryption changed nothing", n)
+		}
+		desDecrypt(key, enc)
+		if !bytes.Equal(enc, b) {
+			t.Errorf("%d bytes: decryption does not reverse encryption", n)
+		}
+	}
+}
+
+func TestPassToKey(t *testing.T) {
+	keys := map[Authkey]string{}
+	for _, pw := range []string{"", "short", "password", "a rather long password", "a rather long password, truncated"} {
+		k := *PassToKey(pw)
+		if k != *PassToKey(pw) {
+			t.Errorf("%q: key not deterministic", pw)
+		}
+		if other, ok := keys[k]; ok {
+			t.Errorf("%q and %q have the same key", pw, other)
+		}
+		keys[k] = pw
+	}
+	// DES keys are derived from the first 27 bytes of the password.
+	if PassToKey(strings.Repeat("x", 27)).DES != PassToKey(strings.Repeat("x", 30)).DES {
+		t.Error("expected passwords to be truncated for DES")
+	}
+}
+
+// The vectors below were computed independently of this package: the AES
+// keys with PBKDF2 from another library, the DES keys and p9sk1 ticket with
+// a separate implementation of passtokey and encrypt(2), and the form1
+// ticket with golang.org/x/crypto/chacha20poly1305. They were not produced
+// by Plan 9 or 9front; TestAuthP9AnyInterop tests against their auth servers.
+
+func TestPassToKeyVectors(t *testing.T) {
+	for _, v := range []struct{ pw, des, aes string }{
+		{"", "00100804028140", "127c5d44df23346fca036283e8c6dba0"},
+		{"password", "f0f07c7e7fcbc9", "15d13256344211e56c52f50c539de223"},
+		{"a rather long password, truncated", "27492352732c83", "70a2546c133bb9dd72099b7f1379a6ea"},
+	} {
+		k := PassToKey(v.pw)
+		if got := hex.EncodeToString(k.DES[:]); got != v.des {
+			t.Errorf("%q: expected DES key %s, got %s", v.pw, v.des, got)
+		}
+		if got := hex.EncodeToString(k.AES[:]); got != v.aes {
+			t.Errorf("%q: expected AES key %s, got %s", v.pw, v.aes, got)
+		}
+	}
+}
+
+func TestTicketVectors(t *testing.T) {
+	key := PassToKey("password")
+	tk := &ticket{num: AuthTs, chal: [CHALLEN]byte{1, 2, 3, 4, 5, 6, 7, 8}, cuid: "glenda", suid: "bootes"}
+	tk.key = bytes.Repeat([]byte{0x11}, DESKEYLEN)
+	if got := hex.EncodeToString(tk.marshal(&authKeys{des: &key.DES})); got != "762a70459bbb9e55993e2177771aa515d04e2a815da515d04e2a815da515d04e2a815d36b3507858f29d264ec4480bb353f7e9c4273df4ef0c263530e51501faeec94f07387cb0e4" {
+		t.Errorf("unexpected p9sk1 ticket %s", got)
+	}
+
+	// The nonce counter is global, so it is set for the vector and restored
+	// afterwards.
+	defer form1Counter.Store(form1Counter.Load())
+	form1Counter.Store(5)
+	tk.form = 1
+	tk.key = bytes.Repeat([]byte{0x22}, NONCELEN)
+	pak := bytes.Repeat([]byte{0x33}, pakKeySize)
+	b := tk.marshal(&authKeys{pak: pak})
+	if got := hex.EncodeToString(b); got != "666f726d3120547305000000bf3065c9fd0fb3fa964fea39e557e44bba77624605083c5746a68eb0360b78c24ddc69a5589649251b04542259a390887ad41914481060c1de4e0adca3db8167d3452de64a8524a5c4063724065920bfb2f8c1dc9d1049ec7171f2cf2143584a94f7d850b517103fe72de3c9dcb3a973" {
+		t.Errorf("unexpected form1 ticket %s", got)
+	}
+	if u, _, err := unmarshalTicket(b, &authKeys{pak: pak}); err != nil || u.cuid != "glenda" || !bytes.Equal(u.key, tk.key) {
+		t.Errorf("form1 ticket does not round trip: %+v, %v", u, err)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	key := PassToKey("password")
+	for form, keys := range []*authKeys{{des: &key.DES}, {pak: bytes.Repeat([]byte{1}, pakKeySize)}} {
+		tk := &ticket{num: AuthTs, chal: [CHALLEN]byte{1, 2, 3}, cuid: "glenda", suid: "bootes", form: form}
+		tk.key = make([]byte, DESKEYLEN)
+		if form == 1 {
+			tk.key = make([]byte, NONCELEN)
+		}
+		authRandom(tk.key)
+
+		b := tk.marshal(keys)
+		if len(b) != ticketLen(b) {
+			t.Fatalf("form %d: ticket of %d bytes, expected %d", form, len(b), ticketLen(b))
+		}
+		got, n, err := unmarshalTicket(b, keys)
+		if err != nil {
+			t.Fatalf("form %d: unmarshal failed: %v", form, err)
+		}
+		if n != len(b) || got.num != tk.num || got.chal != tk.chal || got.cuid != tk.cuid ||
+			got.suid != tk.suid || !bytes.Equal(got.key, tk.key) || got.form != form {
+			t.Errorf("form %d: got %+v, expected %+v", form, got, tk)
+		}
+
+		a := &authenticator{num: AuthAc, chal: tk.chal}
+		authRandom(a.rand[:])
+		ab := a.marshal(tk)
+		ga, err := unmarshalAuthenticator(ab, tk)
+		if err != nil {
+			t.Fatalf("form %d: unmarshal of authenticator failed: %v", form, err)
+		}
+		if form == 0 {
+			a.rand = [NONCELEN]byte{}
+		}
+		if *ga != *a {
+			t.Errorf("form %d: got authenticator %+v, expected %+v", form, ga, a)
+		}
+	}
+
+	// Tampering with a form1 ticket is detected.
+	keys := &authKeys{pak: bytes.Repeat([]byte{1}, pakKeySize)}
+	tk := &ticket{num: AuthTs, key: make([]byte, NONCELEN), form: 1}
+	b := tk.marshal(keys)
+	b[20] ^= 1
+	if _, _, err := unmarshalTicket(b, keys); err != ErrAuthFailed {
+		t.Errorf("expected ErrAuthFailed, got %v", err)
+	}
+}
+
+// p9anySetup returns a p9any server for bootes, and the auth server of the
+// domain, with glenda as a user.
+func p9anySetup() (*P9AnyAuth, *LocalAuthServer) {
+	keys := map[string]*Authkey{
+		"bootes": PassToKey("bootes password"),
+		"glenda": PassToKey("glenda password"),
+	}
+	as := &LocalAuthServer{Keys: func(user string) *Authkey { return keys[user] }}
+	a := &P9AnyAuth{AuthID: "bootes", AuthDom: "example.org", Key: keys["bootes"]}
+	return a, as
+}
+
+func TestAuthP9Any(t *testing.T) {
+	a, as := p9anySetup()
+	for _, proto := range []string{"dp9ik", "p9sk1"} {
+		conv, err := a.Start("glenda", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := &P9AnyClient{Key: PassToKey("glenda password"), AuthServer: as, Protocols: []string{proto}}
+		info, err := pc.AuthenticateInfo(conv, "glenda", "")
+		if err != nil {
+			t.Fatalf("%s: authentication failed: %v", proto, err)
+		}
+		if user, ok := conv.Authenticated(); !ok || user != "glenda" {
+			t.Errorf("%s: server authenticated %q, %v", proto, user, ok)
+		}
+		sinfo := conv.(*p9anyServer).info
+		if info.CUID != "glenda" || info.SUID != "glenda" || !bytes.Equal(info.Secret, sinfo.Secret) {
+			t.Errorf("%s: client info %+v, server info %+v", proto, info, sinfo)
+		}
+		if want := map[string]int{"dp9ik": 256, "p9sk1": 8}[proto]; len(info.Secret) != want {
+			t.Errorf("%s: secret of %d bytes, expected %d", proto, len(info.Secret), want)
+		}
+
+		// A client with the wrong password cannot decrypt its ticket.
+		conv, err = a.Start("glenda", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc.Key = PassToKey("wrong")
+		if _, err := pc.AuthenticateInfo(conv, "glenda", ""); err == nil {
+			t.Errorf("%s: expected authentication with wrong password to fail", proto)
+		}
+		if _, ok := conv.Authenticated(); ok {
+			t.Errorf("%s: server authenticated client with wrong password", proto)
+		}
+	}
+}
+
+func TestAuthP9AnyAttach(t *testing.T) {
+	a, as := p9anySetup()
+	srv := &Server{FS: newRamServer(newRamFS()), Auth: a}
+	for _, version := range []string{Version, VersionDotu} {
+		c := serverClient(t, srv, version)
+		pc := &P9AnyClient{Key: PassToKey("glenda password"), AuthServer: as}
+		root, err := c.AuthAttach(pc, "glenda", "")
+		if err != nil {
+			t.Fatalf("%s: authenticated attach failed: %v", version, err)
+		}
+		if _, err := root.Stat(); err != nil {
+			t.Errorf("%s: stat failed: %v", version, err)
+		}
+
+		// Tickets of unknown users cannot be decrypted.
+		if _, err := c.AuthAttach(pc, "other", ""); err != ErrAuthFailed {
+			t.Errorf("%s: expected ErrAuthFailed, got %v", version, err)
+		}
+	}
+}
+
+func TestAuthP9AnyNegotiate(t *testing.T) {
+	a, as := p9anySetup()
+	a.Protocols = []string{"dp9ik"}
+	conv, err := a.Start("glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &P9AnyClient{Key: PassToKey("glenda password"), AuthServer: as, Protocols: []string{"p9sk1"}}
+	if _, err := pc.AuthenticateInfo(conv, "glenda", ""); err != ErrNoAuthProtocol {
+		t.Errorf("expected ErrNoAuthProtocol, got %v", err)
+	}
+}
+
+// TestAuthP9AnyInterop authenticates with tickets of a real auth server, such
+// as that of 9front, given by the following variables:
+//
+//	QP_AUTHSRV   dial string of the auth server, such as tcp!auth!ticket
+//	QP_AUTHDOM   authentication domain
+//	QP_AUTHID    user:password of the authid of the server
+//	QP_AUTHUSER  user:password of the client
+func TestAuthP9AnyInterop(t *testing.T) {
+	addr := os.Getenv("QP_AUTHSRV")
+	if addr == "" {
+		t.Skip("QP_AUTHSRV not set")
+	}
+	authid, authpw, _ := strings.Cut(os.Getenv("QP_AUTHID"), ":")
+	user, userpw, _ := strings.Cut(os.Getenv("QP_AUTHUSER"), ":")
+
+	for _, proto := range []string{"dp9ik", "p9sk1"} {
+		a := &P9AnyAuth{AuthID: authid, AuthDom: os.Getenv("QP_AUTHDOM"), Key: PassToKey(authpw), Protocols: []string{proto}}
+		conv, err := a.Start(user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := &P9AnyClient{Key: PassToKey(userpw), AuthServer: AuthServerAddr(addr), Protocols: []string{proto}}
+		info, err := pc.AuthenticateInfo(conv, user, "")
+		if err != nil {
+			t.Errorf("%s: authentication failed: %v", proto, err)
+			continue
+		}
+		if u, ok := conv.Authenticated(); !ok || u != user || info.CUID != user {
+			t.Errorf("%s: server authenticated %q, %v, client info %+v", proto, u, ok, info)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package qp
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+// ErrNoAuthProtocol indicates a p9any negotiation without a protocol
+// supported by both sides.
+var ErrNoAuthProtocol = errors.New("no common authentication protocol")
+
+// DefaultAuthProtocols are the protocols negotiated by p9any if none are
+// configured, in order of preference.
+var DefaultAuthProtocols = []string{"dp9ik", "p9sk1"}
+
+// AuthInfo describes the result of a p9any authentication.
+type AuthInfo struct {
+	// CUID is the user on the client, and SUID the user on the server.
+	CUID string
+	SUID string
+
+	// Secret is the secret shared by client and server, which is 8 bytes
+	// for p9sk1 and 256 bytes for dp9ik.
+	Secret []byte
+}
+
+// sessionSecret derives the shared secret from the ticket and the nonces
+// of the authenticators.
+func sessionSecret(t *ticket, crand, srand []byte) ([]byte, error) {
+	if t.form == 0 {
+		return des56to64(t.desKey()), nil
+	}
+	salt := append(append([]byte(nil), crand...), srand...)
+	return hkdf.Key(sha256.New, t.key, salt, "Plan 9 session secret", 256)
+}
+
+// authRandom fills the buffers with random bytes.
+func authRandom(bufs ...[]byte) {
+	for _, b := range bufs {
+		rand.Read(b)
+	}
+}
+
+// P9AnyAuth is an Authenticator for the p9any protocol of Plan 9, which
+// negotiates p9sk1 or dp9ik, as implemented by factotum(4). The server
+// holds the key of its authid, which the auth server of the domain shares,
+// and the user is authenticated by the ticket the client obtains from the
+// auth server. See P9AnyClient.
+//
+// The dp9ik implementation follows the 9front sources, but has not been
+// tested against 9front, so only LocalAuthServer and the clients and servers
+// of this package are known to interoperate with it. Set Protocols to
+// p9sk1 alone to avoid it.
+type P9AnyAuth struct {
+	// AuthID and AuthDom are the user the server authenticates as, and its
+	// authentication domain.
+	AuthID  string
+	AuthDom string
+
+	// Key is the key of AuthID.
+	Key *Authkey
+
+	// Protocols are the protocols offered, in order of preference. If
+	// empty, DefaultAuthProtocols are offered.
+	Protocols []string
+}
+
+func (a *P9AnyAuth) protocols() []string {
+	if len(a.Protocols) == 0 {
+		return DefaultAuthProtocols
+	}
+	return a.Protocols
+}
+
+// p9anyServer is the state of a p9any conversation on the server.
+type p9anyServer struct {
+	authExchange
+	a *P9AnyAuth
+
+	proto string
+	tr    *ticketReq
+	cchal [CHALLEN]byte
+	pak   *pakPriv
+	info  *AuthInfo
+}
+
+// Start implements Authenticator.
+func (a *P9AnyAuth) Start(uname, aname string) (AuthConv, error) {
+	s := &p9anyServer{a: a}
+	var offers []string
+	for _, p := range a.protocols() {
+		offers = append(offers, p+"@"+a.AuthDom)
+	}
+	s.out = []byte("v.2 " + strings.Join(offers, " ") + "\x00")
+	s.steps = append(s.steps, s.negotiate, s.challenge, s.ticket)
+	return s, nil
+}
+
+// negotiate accepts the protocol chosen by the client.
+func (s *p9anyServer) negotiate(msg []byte) ([]byte, error) {
+	proto, dom, ok := strings.Cut(strings.TrimSuffix(string(msg), "\x00"), " ")
+	if !ok || dom != s.a.AuthDom {
+		return nil, ErrAuthProtocol
+	}
+	for _, p := range s.a.protocols() {
+		if p == proto {
+			s.proto = proto
+			return []byte("OK\x00"), nil
+		}
+	}
+	return nil, ErrNoAuthProtocol
+}
+
+// challenge receives the challenge of the client, and replies with the
+// ticket request, followed by the public value of the server for dp9ik.
+func (s *p9anyServer) challenge(msg []byte) ([]byte, error) {
+	if len(msg) != CHALLEN {
+		return nil, ErrAuthProtocol
+	}
+	copy(s.cchal[:], msg)
+	s.tr = &ticketReq{typ: AuthTreq, authID: s.a.AuthID, authDom: s.a.AuthDom}
+	authRandom(s.tr.chal[:])
+	if s.proto != "dp9ik" {
+		return s.tr.marshal(), nil
+	}
+
+	s.tr.typ = AuthPAK
+	hash, err := newPakHash(s.a.Key.AES[:], s.a.AuthID)
+	if err != nil {
+		return nil, err
+	}
+	if s.pak, err = newPak(hash, true); err != nil {
+		return nil, err
+	}
+	return append(s.tr.marshal(), s.pak.y...), nil
+}
+
+// ticket verifies the ticket and authenticator of the client, and replies
+// with the authenticator of the server.
+func (s *p9anyServer) ticket(msg []byte) ([]byte, error) {
+	keys := &authKeys{des: &s.a.Key.DES}
+	if s.pak != nil {
+		if len(msg) < pakSize {
+			return nil, ErrAuthProtocol
+		}
+		key, err := s.pak.finish(msg[:pakSize])
+		if err != nil {
+			return nil, ErrAuthFailed
+		}
+		keys = &authKeys{pak: key}
+		msg = msg[pakSize:]
+	}
+
+	t, n, err := unmarshalTicket(msg, keys)
+	if err != nil {
+		return nil, err
+	}
+	if t.num != AuthTs || t.chal != s.tr.chal {
+		return nil, ErrAuthFailed
+	}
+	ac, err := unmarshalAuthenticator(msg[n:], t)
+	if err != nil {
+		return nil, err
+	}
+	if ac.num != AuthAc || ac.chal != s.tr.chal {
+		return nil, ErrAuthFailed
+	}
+
+	as := &authenticator{num: AuthAs, chal: s.cchal}
+	authRandom(as.rand[:])
+	secret, err := sessionSecret(t, ac.rand[:], as.rand[:])
+	if err != nil {
+		return nil, err
+	}
+	s.info = &AuthInfo{CUID: t.cuid, SUID: t.suid, Secret: secret}
+	s.user = t.cuid
+	return as.marshal(t), nil
+}
+
+// P9AnyClient is the client side of the p9any protocol, which obtains
+// tickets for the user from the auth server of the domain of the server.
+type P9AnyClient struct {
+	// Key is the key of the user.
+	Key *Authkey
+
+	// AuthServer connects to the auth server of the domain.
+	AuthServer AuthServer
+
+	// Protocols are the protocols accepted, in order of preference. If
+	// empty, DefaultAuthProtocols are accepted.
+	Protocols []string
+}
+
+// Authenticate implements ClientAuthenticator.
+func (pc *P9AnyClient) Authenticate(conn AuthConn, user, service string) error {
+	_, err := pc.AuthenticateInfo(conn, user, service)
+	return err
+}
+
+// choose picks the protocol to use among the offers of the server, which are
+// of the form proto@domain.
+func (pc *P9AnyClient) choose(offers []string) (proto, dom string, err error) {
+	protos := pc.Protocols
+	if len(protos) == 0 {
+		protos = DefaultAuthProtocols
+	}
+	for _, p := range protos {
+		for _, o := range offers {
+			if op, od, ok := strings.Cut(o, "@"); ok && op == p {
+				return op, od, nil
+			}
+		}
+	}
+	return "", "", ErrNoAuthProtocol
+}
+
+// AuthenticateInfo is like Authenticate, but also returns the result of the
+// authentication.
+func (pc *P9AnyClient) AuthenticateInfo(conn AuthConn, user, service string) (*AuthInfo, error) {
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	offers, ok := strings.CutSuffix(string(msg), "\x00")
+	if !ok {
+		return nil, ErrAuthProtocol
+	}
+	offers, v2 := strings.CutPrefix(offers, "v.2 ")
+	proto, dom, err := pc.choose(strings.Fields(offers))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage([]byte(proto + " " + dom + "\x00")); err != nil {
+		return nil, err
+	}
+	if v2 {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if string(msg) != "OK\x00" {
+			return nil, ErrAuthProtocol
+		}
+	}
+
+	var cchal [CHALLEN]byte
+	authRandom(cchal[:])
+	if err := conn.WriteMessage(cchal[:]); err != nil {
+		return nil, err
+	}
+	msg, err = conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	tr, err := unmarshalTicketReq(msg)
+	if err != nil {
+		return nil, err
+	}
+	var ys []byte
+	if proto == "dp9ik" {
+		if tr.typ != AuthPAK || len(msg) != TICKREQLEN+pakSize {
+			return nil, ErrAuthProtocol
+		}
+		ys = msg[TICKREQLEN:]
+	} else if tr.typ != AuthTreq || len(msg) != TICKREQLEN {
+		return nil, ErrAuthProtocol
+	}
+	tr.hostID, tr.uid = user, user
+
+	tc, ts, err := pc.tickets(tr, ys)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := &authenticator{num: AuthAc, chal: tr.chal}
+	authRandom(ac.rand[:])
+	reply := append(append([]byte(nil), ys...), ts...)
+	if err := conn.WriteMessage(append(reply, ac.marshal(tc)...)); err != nil {
+		return nil, err
+	}
+
+	msg, err = conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	as, err := unmarshalAuthenticator(msg, tc)
+	if err != nil {
+		return nil, err
+	}
+	if as.num != AuthAs || as.chal != cchal {
+		return nil, ErrAuthFailed
+	}
+	secret, err := sessionSecret(tc, ac.rand[:], as.rand[:])
+	if err != nil {
+		return nil, err
+	}
+	return &AuthInfo{CUID: tc.cuid, SUID: tc.suid, Secret: secret}, nil
+}
+
+// tickets obtains the tickets for the request from the auth server,
+// returning the decrypted ticket of the client and the encrypted ticket of
+// the server. For dp9ik, ys holds the public value of the server, which is
+// replaced by the reply of the auth server to be passed on to the server.
+func (pc *P9AnyClient) tickets(tr *ticketReq, ys []byte) (*ticket, []byte, error) {
+	conn, err := pc.AuthServer.DialAuth(tr.authDom)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	keys := &authKeys{des: &pc.Key.DES}
+	if ys != nil {
+		hash, err := newPakHash(pc.Key.AES[:], tr.hostID)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, err := newPak(hash, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		tr.typ = AuthPAK
+		req := append(append(tr.marshal(), ys...), p.y...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, nil, err
+		}
+		resp, err := readAuthResp(conn, 2*pakSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keys.pak, err = p.finish(resp[pakSize:]); err != nil {
+			return nil, nil, ErrAuthFailed
+		}
+		copy(ys, resp[:pakSize])
+	}
+
+	tr.typ = AuthTreq
+	if _, err := conn.Write(tr.marshal()); err != nil {
+		return nil, nil, err
+	}
+	if _, err := readAuthResp(conn, 0); err != nil {
+		return nil, nil, err
+	}
+	tcb, err := readTicket(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	ts, err := readTicket(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tc, _, err := unmarshalTicket(tcb, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tc.num != AuthTc || tc.chal != tr.chal {
+		return nil, nil, ErrAuthFailed
+	}
+	return tc, ts, nil
+}
@@ -0,0 +1,485 @@
+package qp
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+// The password authenticated key exchange of dp9ik, which is SPAKE2 on the
+// Ed448-Goldilocks curve with points encoded as described in the Decaf
+// paper, and hashed to the curve with Elligator 2. See authpak(2) of 9front.
+// All arithmetic on secrets takes the same steps whatever their values. The
+// exchange follows the 9front sources, but has only been tested against this
+// package, not against 9front itself.
+
+const (
+	// pakSize is the size of an encoded field element or scalar.
+	pakSize = (448 + 7) / 8
+
+	// pakKeySize is the size of the key resulting from an exchange.
+	pakKeySize = 32
+)
+
+// errPakPoint indicates a public value that does not encode a point.
+var errPakPoint = errors.New("invalid authpak point")
+
+// pakElt is an element of the field of p = 2^448 - 2^224 - 1, held in eight
+// limbs of 56 bits, least significant first. The limbs of the results of all
+// operations are below 2^56, other than the first and fifth, which may
+// exceed it by a little until the element is reduced.
+type pakElt [8]uint64
+
+const pakMask = 1<<56 - 1
+
+// pakP is p, the modulus of the field.
+var pakP = pakElt{pakMask, pakMask, pakMask, pakMask, pakMask - 1, pakMask, pakMask, pakMask}
+
+// pakQ is q, the order of the generator, as a big-endian scalar.
+var pakQ = [pakSize]byte(mustHex("3fffffffffffffffffffffffffffffffffffffffffffffffffffffff7cca23e9c44edb49aed63690216cc2728dc58f552378c292ab5844f3"))
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic("bad constant " + s)
+	}
+	return b
+}
+
+// pakEltBytes returns the element with the big-endian encoding of pakSize
+// bytes, which need not be reduced.
+func pakEltBytes(b []byte) pakElt {
+	var le [pakSize + 1]byte
+	for i := range pakSize {
+		le[i] = b[pakSize-1-i]
+	}
+	var x pakElt
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint64(le[7*i:]) & pakMask
+	}
+	return x
+}
+
+// bytes returns the big-endian encoding of the reduced element.
+func (x pakElt) bytes() []byte {
+	x = x.reduce()
+	var le [pakSize + 1]byte
+	for i := range x {
+		binary.LittleEndian.PutUint64(le[7*i:], x[i])
+	}
+	b := make([]byte, pakSize)
+	for i := range b {
+		b[i] = le[pakSize-1-i]
+	}
+	return b
+}
+
+// carry moves the bits above 56 of each limb to the next, and those of the
+// last limb to the first and the fifth, as 2^448 is congruent to
+// 2^224 + 1.
+func (x pakElt) carry() pakElt {
+	for i := 0; i < 7; i++ {
+		x[i+1] += x[i] >> 56
+		x[i] &= pakMask
+	}
+	c := x[7] >> 56
+	x[7] &= pakMask
+	x[0] += c
+	x[4] += c
+	return x
+}
+
+// reduce returns the element reduced below p, with all limbs below 2^56.
+func (x pakElt) reduce() pakElt {
+	// After carrying, x is below 2p, so that subtracting p once, and adding
+	// it back if that went below zero, reduces it.
+	x = x.carry()
+	var s int64
+	for i := range x {
+		s += int64(x[i]) - int64(pakP[i])
+		x[i] = uint64(s) & pakMask
+		s >>= 56
+	}
+	m := uint64(s)
+	var c uint64
+	for i := range x {
+		c += x[i] + pakP[i]&m
+		x[i] = c & pakMask
+		c >>= 56
+	}
+	return x
+}
+
+func (x pakElt) add(y pakElt) pakElt {
+	for i := range x {
+		x[i] += y[i]
+	}
+	return x.carry()
+}
+
+// sub returns x - y, computed as x + 2p - y, which keeps the limbs from
+// going below zero.
+func (x pakElt) sub(y pakElt) pakElt {
+	for i := range x {
+		x[i] += 2*pakP[i] - y[i]
+	}
+	return x.carry()
+}
+
+func (x pakElt) neg() pakElt {
+	return pakElt{}.sub(x)
+}
+
+func (x pakElt) mul(y pakElt) pakElt {
+	// The products of the limbs are summed in 128 bits by the position of
+	// their weight, and the positions above 2^448 are folded onto those of
+	// 2^224 and 1 lower, starting from the top.
+	var hi, lo [15]uint64
+	for i := range x {
+		for j := range y {
+			h, l := bits.Mul64(x[i], y[j])
+			var c uint64
+			lo[i+j], c = bits.Add64(lo[i+j], l, 0)
+			hi[i+j] += h + c
+		}
+	}
+	for k := 14; k >= 8; k-- {
+		for _, d := range []int{k - 4, k - 8} {
+			var c uint64
+			lo[d], c = bits.Add64(lo[d], lo[k], 0)
+			hi[d] += hi[k] + c
+		}
+	}
+
+	var z pakElt
+	var chi, clo uint64
+	for i := range z {
+		var c uint64
+		clo, c = bits.Add64(clo, lo[i], 0)
+		chi += hi[i] + c
+		z[i] = clo & pakMask
+		clo = clo>>56 | chi<<8
+		chi >>= 56
+	}
+	z[0] += clo
+	z[4] += clo
+	return z.carry()
+}
+
+// pow2k returns x^(2^k).
+func (x pakElt) pow2k(k int) pakElt {
+	for range k {
+		x = x.mul(x)
+	}
+	return x
+}
+
+// isZero returns 1 if x is zero, and 0 otherwise.
+func (x pakElt) isZero() int {
+	x = x.reduce()
+	var v uint64
+	for i := range x {
+		v |= x[i]
+	}
+	return int((v - 1) >> 63)
+}
+
+// equal returns 1 if x equals y, and 0 otherwise.
+func (x pakElt) equal(y pakElt) int {
+	return x.sub(y).isZero()
+}
+
+// negative returns 1 if x is above (p-1)/2, and 0 otherwise, which is the
+// case if 2x reduced is odd.
+func (x pakElt) negative() int {
+	return int(x.add(x).reduce()[0] & 1)
+}
+
+// choose returns y if cond is 1, and x if it is 0.
+func (x pakElt) choose(y pakElt, cond int) pakElt {
+	m := -uint64(cond)
+	for i := range x {
+		x[i] ^= (x[i] ^ y[i]) & m
+	}
+	return x
+}
+
+// condNeg returns -x if cond is 1, and x if it is 0.
+func (x pakElt) condNeg(cond int) pakElt {
+	return x.choose(x.neg(), cond)
+}
+
+// abs returns x or -x, whichever is not negative.
+func (x pakElt) abs() pakElt {
+	return x.condNeg(x.negative())
+}
+
+// invSqrt returns the inverse of a square root of x, and 1 if x is a
+// non-zero square, or 0 otherwise. As p is 3 mod 4, the inverse square root
+// is x^((p-3)/4), that is, x^(2^446 - 2^222 - 1).
+func (x pakElt) invSqrt() (pakElt, int) {
+	// e(k) stands for x^(2^k - 1), and e(a+b) is e(a)^(2^b) * e(b).
+	e1 := x
+	e2 := e1.pow2k(1).mul(e1)
+	e3 := e2.pow2k(1).mul(e1)
+	e6 := e3.pow2k(3).mul(e3)
+	e12 := e6.pow2k(6).mul(e6)
+	e24 := e12.pow2k(12).mul(e12)
+	e30 := e24.pow2k(6).mul(e6)
+	e48 := e24.pow2k(24).mul(e24)
+	e96 := e48.pow2k(48).mul(e48)
+	e192 := e96.pow2k(96).mul(e96)
+	e222 := e192.pow2k(30).mul(e30)
+	e223 := e222.pow2k(1).mul(e1)
+	r := e223.pow2k(223).mul(e222)
+	return r, r.mul(r).mul(x).equal(pakElt{1})
+}
+
+// inv returns the inverse of x, or zero if x is zero.
+func (x pakElt) inv() pakElt {
+	r, _ := x.mul(x).invSqrt()
+	return r.mul(r).mul(x)
+}
+
+// pakPoint is a point in extended homogeneous coordinates, with x = X/Z,
+// y = Y/Z and x*y = T/Z.
+type pakPoint struct {
+	x, y, z, t pakElt
+}
+
+// choose returns q if cond is 1, and p if it is 0.
+func (p pakPoint) choose(q pakPoint, cond int) pakPoint {
+	return pakPoint{p.x.choose(q.x, cond), p.y.choose(q.y, cond), p.z.choose(q.z, cond), p.t.choose(q.t, cond)}
+}
+
+// pakCurve is the twisted Edwards curve a*x^2 + y^2 = 1 + d*x^2*y^2 over
+// the field of p, with the generator g and a non-square n.
+type pakCurve struct {
+	a, d pakElt
+	g    pakPoint
+	n    pakElt
+}
+
+// ed448 returns the Ed448-Goldilocks curve.
+var ed448 = sync.OnceValue(func() *pakCurve {
+	c := &pakCurve{a: pakElt{1}, d: pakElt{39081}.neg()}
+	x := pakEltBytes(mustHex("4f1970c66bed0ded221d15a622bf36da9e146570470f1767ea6de324a3d3a46412ae1af72ab66511433b80e18b00938e2626a82bc70cc05e"))
+	y := pakEltBytes(mustHex("693f46716eb6bc248876203756c9c7624bea73736ca3984087789c1e05a0c2d73ad3ff1ce67c39c4fdbd132c4ed7c8ad9808795bf230fa14"))
+	c.g = pakPoint{x, y, pakElt{1}, x.mul(y)}
+
+	// The smallest non-square, as used by Elligator 2.
+	c.n = pakElt{7}
+	return c
+})
+
+// addPoints returns p1 + p2, using the unified addition law, which is
+// complete for curves with a square a and a non-square d.
+func (c *pakCurve) addPoints(p1, p2 pakPoint) pakPoint {
+	a := p1.x.mul(p2.x)
+	b := p1.y.mul(p2.y)
+	cc := c.d.mul(p1.t.mul(p2.t))
+	d := p1.z.mul(p2.z)
+	e := p1.x.add(p1.y).mul(p2.x.add(p2.y)).sub(a).sub(b)
+	f := d.sub(cc)
+	g := d.add(cc)
+	h := b.sub(c.a.mul(a))
+	return pakPoint{e.mul(f), g.mul(h), f.mul(g), e.mul(h)}
+}
+
+// negPoint returns -p.
+func (c *pakCurve) negPoint(p pakPoint) pakPoint {
+	return pakPoint{p.x.neg(), p.y, p.z, p.t.neg()}
+}
+
+// scale returns k*p for the big-endian scalar k, doubling and adding for
+// every bit of k, and keeping the sum only for the bits that are set.
+func (c *pakCurve) scale(k []byte, p pakPoint) pakPoint {
+	r := pakPoint{y: pakElt{1}, z: pakElt{1}}
+	for i := range 8 * len(k) {
+		r = c.addPoints(r, r)
+		bit := int(k[i/8]>>(7-i%8)) & 1
+		r = r.choose(c.addPoints(r, p), bit)
+	}
+	return r
+}
+
+// encode returns the Decaf encoding of the point, which is the same for
+// points differing by the point of order 2. Only the points in the image of
+// the isogeny from the Jacobi quartic can be encoded, which includes the
+// multiples of the generator and the points of Elligator 2, and sums of
+// these.
+func (c *pakCurve) encode(p pakPoint) []byte {
+	ad := c.a.sub(c.d)
+	r, ok := ad.mul(p.z.add(p.y).mul(p.z.sub(p.y))).invSqrt()
+	r = r.choose(pakElt{}, 1-ok)
+	u := ad.mul(r)
+	r = r.condNeg(pakElt{2}.mul(u.mul(p.z)).neg().negative())
+	s := c.a.mul(p.z.mul(p.x)).sub(c.d.mul(p.y.mul(p.t)))
+	s = u.mul(r.mul(s).add(p.y))
+	s = s.mul(c.a.inv()).abs()
+	return s.bytes()
+}
+
+// decode returns a point with the Decaf encoding. The encoding is public,
+// and may be rejected early.
+func (c *pakCurve) decode(b []byte) (pakPoint, error) {
+	if len(b) != pakSize {
+		return pakPoint{}, errPakPoint
+	}
+	s := pakEltBytes(b)
+	if !bytes.Equal(s.bytes(), b) || s.negative() == 1 {
+		return pakPoint{}, errPakPoint
+	}
+	ss := s.mul(s)
+	x := pakElt{2}.mul(s)
+	z := pakElt{1}.add(c.a.mul(ss))
+	u := z.mul(z).sub(pakElt{4}.mul(c.d.mul(ss)))
+
+	us := u.mul(ss)
+	v, ok := us.invSqrt()
+	if ok == 0 && us.isZero() == 0 {
+		return pakPoint{}, errPakPoint
+	}
+	v = v.condNeg(u.mul(v).negative())
+	w := v.mul(s.mul(pakElt{2}.sub(z)))
+	w = w.add(pakElt{uint64(s.isZero())})
+	return pakPoint{x, w.mul(z), z, w.mul(x)}, nil
+}
+
+// elligator maps the field element to a point with Elligator 2, through
+// the Jacobi quartic isogenous to the curve, so that the point can be
+// encoded.
+func (c *pakCurve) elligator(r0 pakElt) pakPoint {
+	one := pakElt{1}
+	a2d := c.a.sub(pakElt{2}.mul(c.d))
+	r := c.n.mul(r0.mul(r0))
+	dd := c.d.mul(r).add(c.a.sub(c.d)).mul(c.d.mul(r).sub(c.a.mul(r)).sub(c.d))
+	n := r.add(one).mul(a2d)
+	nd := n.mul(dd)
+
+	// If nd is not a square, n*nd is, as n is not. If nd is zero, so is e,
+	// and the sign does not matter.
+	e, square := nd.invSqrt()
+	ie, _ := c.n.mul(nd).invSqrt()
+	e = c.n.mul(r0).mul(ie).choose(e, square)
+	sign := one.neg().choose(one, square)
+
+	s := sign.mul(n.mul(e))
+	ae := a2d.mul(e)
+	t := sign.neg().mul(n.mul(r.sub(one).mul(ae.mul(ae))))
+	t = t.sub(one)
+
+	as2 := c.a.mul(s.mul(s))
+	return pakPoint{
+		pakElt{2}.mul(s).mul(t),
+		one.sub(as2).mul(one.add(as2)),
+		one.add(as2).mul(t),
+		pakElt{2}.mul(s).mul(one.sub(as2)),
+	}
+}
+
+// pakHash holds the points the public values of both sides are blinded
+// with, derived from the AES key and the name of a user.
+type pakHash struct {
+	m, n pakPoint
+}
+
+// newPakHash derives the blinding points of the user.
+func newPakHash(aesKey []byte, user string) (*pakHash, error) {
+	salt := sha256.Sum256([]byte(user))
+	h, err := hkdf.Key(sha256.New, aesKey, salt[:], "Plan 9 AuthPAK hash", 2*pakSize)
+	if err != nil {
+		return nil, err
+	}
+	c := ed448()
+	return &pakHash{
+		m: c.elligator(pakEltBytes(h[:pakSize])),
+		n: c.elligator(pakEltBytes(h[pakSize:])),
+	}, nil
+}
+
+// pakScalar returns a uniformly random scalar below q, as mpnrand(2) does
+// for 9front.
+func pakScalar() ([]byte, error) {
+	x := make([]byte, pakSize)
+	for {
+		if _, err := rand.Read(x); err != nil {
+			return nil, err
+		}
+		// q is just below 2^446, so that few candidates are rejected.
+		x[0] &= 0x3f
+		var borrow uint64
+		for i := pakSize - 8; i >= 0; i -= 8 {
+			_, borrow = bits.Sub64(binary.BigEndian.Uint64(x[i:]), binary.BigEndian.Uint64(pakQ[i:]), borrow)
+		}
+		if borrow == 1 {
+			return x, nil
+		}
+	}
+}
+
+// pakPriv is one side of an exchange in progress.
+type pakPriv struct {
+	hash     *pakHash
+	isClient bool
+	x        []byte
+	y        []byte
+}
+
+// newPak starts an exchange, returning the public value to send. Clients,
+// which are both the client and the server of a ticket, blind with m, and
+// auth servers blind with n.
+func newPak(hash *pakHash, isClient bool) (*pakPriv, error) {
+	x, err := pakScalar()
+	if err != nil {
+		return nil, err
+	}
+	return newPakScalar(hash, isClient, x), nil
+}
+
+// newPakScalar starts an exchange with the secret scalar x.
+func newPakScalar(hash *pakHash, isClient bool, x []byte) *pakPriv {
+	c := ed448()
+	blind := hash.n
+	if isClient {
+		blind = hash.m
+	}
+	y := c.encode(c.addPoints(c.scale(x, c.g), blind))
+	return &pakPriv{hash: hash, isClient: isClient, x: x, y: y}
+}
+
+// finish completes the exchange with the public value of the other side,
+// returning the shared key.
+func (pp *pakPriv) finish(y []byte) ([]byte, error) {
+	c := ed448()
+	p, err := c.decode(y)
+	if err != nil {
+		return nil, err
+	}
+	blind := pp.peerBlind()
+	z := c.encode(c.scale(pp.x, c.addPoints(p, c.negPoint(blind))))
+
+	h := sha256.New()
+	if pp.isClient {
+		h.Write(pp.y)
+		h.Write(y)
+	} else {
+		h.Write(y)
+		h.Write(pp.y)
+	}
+	return hkdf.Key(sha256.New, z, h.Sum(nil), "Plan 9 AuthPAK key", pakKeySize)
+}
+
+// peerBlind returns the point the other side blinds with.
+func (pp *pakPriv) peerBlind() pakPoint {
+	if pp.isClient {
+		return pp.hash.n
+	}
+	return pp.hash.m
+}
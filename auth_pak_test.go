@@ -0,0 +1,276 @@
+package qp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// pakBig returns the element as an integer reduced modulo p.
+func pakBig(x pakElt) *big.Int {
+	return new(big.Int).SetBytes(x.bytes())
+}
+
+// pakEltOf returns the element for a non-negative integer below 2^448.
+func pakEltOf(n *big.Int) pakElt {
+	return pakEltBytes(n.FillBytes(make([]byte, pakSize)))
+}
+
+// pakScalarOf returns the scalar with the big-endian bytes.
+func pakScalarOf(b []byte) []byte {
+	x := make([]byte, pakSize)
+	copy(x[pakSize-len(b):], b)
+	return x
+}
+
+// onCurve reports whether the point satisfies the curve equation
+// a*X^2*Z^2 + Y^2*Z^2 = Z^4 + d*X^2*Y^2, and X*Y = T*Z.
+func onCurve(c *pakCurve, p pakPoint) bool {
+	xx, yy, zz := p.x.mul(p.x), p.y.mul(p.y), p.z.mul(p.z)
+	lhs := c.a.mul(xx).add(yy).mul(zz)
+	rhs := zz.mul(zz).add(c.d.mul(xx.mul(yy)))
+	return lhs.equal(rhs) == 1 && p.x.mul(p.y).equal(p.t.mul(p.z)) == 1
+}
+
+func TestPakField(t *testing.T) {
+	p := new(big.Int).Lsh(big.NewInt(1), 448)
+	p.Sub(p, new(big.Int).Lsh(big.NewInt(1), 224))
+	p.Sub(p, big.NewInt(1))
+	if pakBig(pakP).Sign() != 0 {
+		t.Fatal("p is not zero")
+	}
+
+	// Values next to the limits of the limbs, and random ones, some of
+	// which are at least p.
+	top := new(big.Int).Lsh(big.NewInt(1), 448)
+	values := []*big.Int{
+		big.NewInt(0), big.NewInt(1), big.NewInt(2),
+		new(big.Int).Sub(p, big.NewInt(1)), new(big.Int).Set(p), new(big.Int).Add(p, big.NewInt(1)),
+		new(big.Int).Sub(top, big.NewInt(1)), new(big.Int).Lsh(big.NewInt(1), 224),
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for range 50 {
+		values = append(values, new(big.Int).Rand(rnd, top))
+	}
+
+	check := func(what string, got pakElt, expected *big.Int) {
+		t.Helper()
+		expected = new(big.Int).Mod(expected, p)
+		if pakBig(got).Cmp(expected) != 0 {
+			t.Fatalf("%s: expected %x, got %x", what, expected, pakBig(got))
+		}
+	}
+	for i, a := range values {
+		x := pakEltOf(a)
+		b := values[(i+1)%len(values)]
+		y := pakEltOf(b)
+		check("add", x.add(y), new(big.Int).Add(a, b))
+		check("sub", x.sub(y), new(big.Int).Sub(a, b))
+		check("neg", x.neg(), new(big.Int).Neg(a))
+		check("mul", x.mul(y), new(big.Int).Mul(a, b))
+		check("mul of sums", x.add(y).mul(x.sub(y)), new(big.Int).Sub(new(big.Int).Mul(a, a), new(big.Int).Mul(b, b)))
+
+		am := new(big.Int).Mod(a, p)
+		if inv := new(big.Int).ModInverse(am, p); inv != nil {
+			check("inv", x.inv(), inv)
+		}
+		r, ok := x.invSqrt()
+		square := am.Sign() != 0 && big.Jacobi(am, p) == 1
+		if square != (ok == 1) {
+			t.Fatalf("invSqrt of %x: expected square %v", am, square)
+		}
+		if square {
+			check("invSqrt", r.mul(r).mul(x), big.NewInt(1))
+		}
+		if neg := am.Cmp(new(big.Int).Rsh(p, 1)) > 0; neg != (x.negative() == 1) {
+			t.Fatalf("negative of %x: expected %v", am, neg)
+		}
+		if x.isZero() != int(1-am.Sign()) {
+			t.Fatalf("isZero of %x", am)
+		}
+	}
+
+	// n is the smallest non-square.
+	for i := uint64(2); i <= 7; i++ {
+		if _, ok := (pakElt{i}).invSqrt(); (ok == 0) != (i == 7) {
+			t.Errorf("%d: unexpected squareness", i)
+		}
+	}
+}
+
+func TestPakDecaf(t *testing.T) {
+	c := ed448()
+	if !onCurve(c, c.g) {
+		t.Fatal("generator not on curve")
+	}
+	// The point of order 2, which the encoding must not tell apart.
+	t2 := pakPoint{pakElt{}, pakElt{1}.neg(), pakElt{1}, pakElt{}}
+
+	for _, k := range []int64{1, 2, 3, 12345, 1 << 40} {
+		p := c.scale(pakScalarOf(big.NewInt(k).Bytes()), c.g)
+		if !onCurve(c, p) {
+			t.Fatalf("%d*G not on curve", k)
+		}
+		enc := c.encode(p)
+		if got := c.encode(c.addPoints(p, t2)); !bytes.Equal(got, enc) {
+			t.Errorf("encoding of %d*G depends on torsion", k)
+		}
+		q, err := c.decode(enc)
+		if err != nil {
+			t.Fatalf("decoding %d*G failed: %v", k, err)
+		}
+		if !onCurve(c, q) {
+			t.Errorf("decoded %d*G not on curve", k)
+		}
+		if got := c.encode(q); !bytes.Equal(got, enc) {
+			t.Errorf("encoding of decoded %d*G differs", k)
+		}
+	}
+
+	// Encodings are additive: G + 2G = 3G.
+	g2 := c.scale(pakScalarOf([]byte{2}), c.g)
+	if !bytes.Equal(c.encode(c.addPoints(c.g, g2)), c.encode(c.scale(pakScalarOf([]byte{3}), c.g))) {
+		t.Error("G + 2G != 3G")
+	}
+
+	// q is the order of the generator.
+	if id := c.scale(pakQ[:], c.g); id.x.isZero() != 1 || id.y.equal(id.z) != 1 {
+		t.Error("q*G is not the identity")
+	}
+
+	// Negative and unreduced encodings are rejected.
+	unreduced := bytes.Repeat([]byte{0xff}, pakSize)
+	unreduced[27] = 0xfe
+	for _, b := range [][]byte{pakElt{1}.neg().bytes(), unreduced} {
+		if _, err := c.decode(b); err == nil {
+			t.Errorf("expected encoding %x to be rejected", b)
+		}
+	}
+}
+
+func TestPakElligator(t *testing.T) {
+	c := ed448()
+	p := new(big.Int).SetBytes(pakElt{1}.neg().bytes())
+	p.Add(p, big.NewInt(1))
+	for i := int64(0); i < 20; i++ {
+		r := new(big.Int).Exp(big.NewInt(3), big.NewInt(i*37+1), p)
+		q := c.elligator(pakEltOf(r))
+		if !onCurve(c, q) {
+			t.Fatalf("elligator(%d) not on curve", i)
+		}
+		d, err := c.decode(c.encode(q))
+		if err != nil {
+			t.Fatalf("elligator(%d) not encodable: %v", i, err)
+		}
+		if !bytes.Equal(c.encode(d), c.encode(q)) {
+			t.Errorf("elligator(%d) does not round trip", i)
+		}
+	}
+}
+
+func TestPakScalar(t *testing.T) {
+	q := new(big.Int).SetBytes(pakQ[:])
+	for range 100 {
+		x, err := pakScalar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(x) != pakSize || new(big.Int).SetBytes(x).Cmp(q) >= 0 {
+			t.Fatalf("scalar %x not below q", x)
+		}
+	}
+}
+
+// TestPakVectors checks the exchange against values computed by an earlier
+// implementation of this package on math/big, which shares none of the
+// field and scalar arithmetic. The HKDF output of the hash was checked
+// against an independent HKDF implementation. None of these values were
+// produced by 9front.
+func TestPakVectors(t *testing.T) {
+	key := PassToKey("password")
+	hash, err := newPakHash(key.AES[:], "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ed448()
+	for _, v := range []struct {
+		what     string
+		got      []byte
+		expected string
+	}{
+		{"G", c.encode(c.g), "2d22fad8915cfee427f2c0fcc98aa0de1aac9e0b7872ca2f9f65059fbb2fabd18111379cdc7c10e8f221d582d24e58ecbc654e031d5837f0"},
+		{"elligator(0)", c.encode(c.elligator(pakElt{0})), "0000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"},
+		{"elligator(1)", c.encode(c.elligator(pakElt{1})), "5f0c872c0891805e3c5e10d6059cd52f81025ad063f56ae0e3b3a1b709d98e55f4ada387f9029cb57ecde886237fbf89a59f35b6ca60803f"},
+		{"elligator(2)", c.encode(c.elligator(pakElt{2})), "71e9452e6cdf0fe00d4f8cebd928f998590002078e9e36ebb7537ab5005edcd781102a01759e07d7d72b1a2f34001b85279e747087fc9dd2"},
+		{"elligator(3)", c.encode(c.elligator(pakElt{3})), "25b9d366da7cabfb30d7ee0dbc97c5c427216de1734df9b67e6753784fdfdde819f314bfa1bcccfe1895db517fed7a0a18a3924a02a82be0"},
+		{"elligator(7)", c.encode(c.elligator(pakElt{7})), "665d5d6e74d713a3622b39a66f0160d56476e2a309f8fdc39a2a3a0fc14d03399ddd6fbb882d9c4c5567b51c5f617e84cf6432ebb2f23bd3"},
+		{"m", c.encode(hash.m), "57ebcdae7d3a37aac244e4cf4d92f759beb30d36ae0e866a8115963afd95a34585f33dfc75ceb7b137c5841550e380ccbbc89c4eb2e73efd"},
+		{"n", c.encode(hash.n), "03684ab7b68627e1af06d6ec66cc979fd425cfe1c3e2737f9de82188b32c2cb51fdd902e70e15178271ec121b15b2a311ff2d911f24baa96"},
+	} {
+		if got := hex.EncodeToString(v.got); got != v.expected {
+			t.Errorf("%s: expected %s, got %s", v.what, v.expected, got)
+		}
+	}
+
+	client := newPakScalar(hash, true, pakScalarOf([]byte("client scalar")))
+	server := newPakScalar(hash, false, pakScalarOf([]byte("server scalar, which is a little longer")))
+	if got := hex.EncodeToString(client.y); got != "5128bf74059edd0eb2ed3ea1a0b2609df7becd47045aa93e5a1322167dc93cdc1661a6801eadb42b75bdb213dd969cd750843ba3fbf156fb" {
+		t.Errorf("unexpected client value %s", got)
+	}
+	if got := hex.EncodeToString(server.y); got != "39c2c51d92768f29f080b7e05855fb74eaf3b6600713b01722a181ff1dded4e81e46f105cb0560b5082caa059ca40013259ada92d3f76622" {
+		t.Errorf("unexpected server value %s", got)
+	}
+	for _, pp := range []*pakPriv{client, server} {
+		peer := server
+		if pp == server {
+			peer = client
+		}
+		k, err := pp.finish(peer.y)
+		if err != nil || hex.EncodeToString(k) != "0ef2808cf2ae5797063d4fc25d1f05589890f1d890e240af1503db256ac15e14" {
+			t.Errorf("unexpected key %x, %v", k, err)
+		}
+	}
+}
+
+func TestPakExchange(t *testing.T) {
+	key := PassToKey("password")
+	hash, err := newPakHash(key.AES[:], "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newPak(hash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newPak(hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck, err := client.finish(server.y)
+	if err != nil {
+		t.Fatalf("client finish failed: %v", err)
+	}
+	sk, err := server.finish(client.y)
+	if err != nil {
+		t.Fatalf("server finish failed: %v", err)
+	}
+	if !bytes.Equal(ck, sk) {
+		t.Error("keys differ")
+	}
+
+	// A different password results in a different key.
+	other, err := newPakHash(PassToKey("wrong").AES[:], "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = newPak(other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck, err = client.finish(server.y)
+	if err == nil && bytes.Equal(ck, sk) {
+		t.Error("keys agree despite different passwords")
+	}
+}
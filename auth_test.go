@@ -0,0 +1,132 @@
+package qp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthSharedSecret(t *testing.T) {
+	secrets := map[string][]byte{"glenda": []byte("secret")}
+	srv := &Server{
+		FS: newRamServer(newRamFS()),
+		Auth: &SharedSecretAuth{Secret: func(user string) ([]byte, error) {
+			s, ok := secrets[user]
+			if !ok {
+				return nil, errors.New("unknown user")
+			}
+			return s, nil
+		}},
+	}
+
+	for _, version := range []string{Version, VersionDotu} {
+		c := serverClient(t, srv, version)
+		if _, err := c.AuthAttach(&SharedSecretClient{Secret: []byte("secret")}, "glenda", ""); err != nil {
+			t.Errorf("%s: authenticated attach failed: %v", version, err)
+		}
+		if _, err := c.AuthAttach(&SharedSecretClient{Secret: []byte("wrong")}, "glenda", ""); err == nil {
+			t.Errorf("%s: expected attach with wrong secret to fail", version)
+		}
+		if _, err := c.AuthAttach(&SharedSecretClient{Secret: []byte("secret")}, "other", ""); err == nil {
+			t.Errorf("%s: expected attach as unknown user to fail", version)
+		}
+		if _, err := c.Attach(nil, "glenda", ""); err == nil || !strings.Contains(err.Error(), ErrAuthRequired.Error()) {
+			t.Errorf("%s: expected attach without auth to be refused, got %v", version, err)
+		}
+	}
+}
+
+// TestAuthSharedSecretServer checks that the client refuses a server that
+// does not know the secret.
+func TestAuthSharedSecretServer(t *testing.T) {
+	x := &authExchange{user: "glenda", out: make([]byte, authNonceSize)}
+	x.steps = append(x.steps, func(msg []byte) ([]byte, error) {
+		return make([]byte, 32), nil
+	})
+	sc := &SharedSecretClient{Secret: []byte("secret")}
+	if err := sc.Authenticate(x, "glenda", ""); err != ErrAuthFailed {
+		t.Errorf("expected ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestAuthEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		FS: newRamServer(newRamFS()),
+		Auth: &Ed25519Auth{Keys: func(user string) ([]ed25519.PublicKey, error) {
+			return []ed25519.PublicKey{pub}, nil
+		}},
+	}
+
+	c := serverClient(t, srv, Version)
+	root, err := c.AuthAttach(&Ed25519Client{Key: priv}, "glenda", "")
+	if err != nil {
+		t.Fatalf("authenticated attach failed: %v", err)
+	}
+	if _, err := root.Stat(); err != nil {
+		t.Errorf("stat of root failed: %v", err)
+	}
+	if _, err := c.AuthAttach(&Ed25519Client{Key: other}, "glenda", ""); err == nil {
+		t.Errorf("expected attach with unknown key to fail")
+	}
+}
+
+func TestAuthIncomplete(t *testing.T) {
+	srv := &Server{
+		FS: newRamServer(newRamFS()),
+		Auth: &SharedSecretAuth{Secret: func(user string) ([]byte, error) {
+			return []byte("secret"), nil
+		}},
+	}
+	c := serverClient(t, srv, Version)
+
+	afid, err := c.Auth("glenda", "")
+	if err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	defer afid.Close()
+	if afid.Qid().Type&QTAUTH == 0 {
+		t.Errorf("expected auth qid, got %v", afid.Qid())
+	}
+	if _, err := c.Attach(afid, "glenda", ""); err == nil {
+		t.Errorf("expected attach before authentication to fail")
+	}
+
+	// Writing before reading the challenge is out of order.
+	conn := fileAuthConn{afid}
+	if err := conn.WriteMessage([]byte("response")); err == nil || !strings.Contains(err.Error(), ErrAuthPhase.Error()) {
+		t.Errorf("expected phase error, got %v", err)
+	}
+
+	// A completed conversation only authenticates its own user.
+	afid2, err := c.Auth("glenda", "")
+	if err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	defer afid2.Close()
+	if err := (&SharedSecretClient{Secret: []byte("secret")}).Authenticate(fileAuthConn{afid2}, "glenda", ""); err != nil {
+		t.Fatalf("authentication failed: %v", err)
+	}
+	if _, err := c.Attach(afid2, "other", ""); err == nil {
+		t.Errorf("expected attach as another user to fail")
+	}
+	if _, err := c.Attach(afid2, "glenda", ""); err != nil {
+		t.Errorf("attach failed: %v", err)
+	}
+}
+
+func TestAuthNotRequired(t *testing.T) {
+	srv := &Server{FS: newRamServer(newRamFS())}
+	c := serverClient(t, srv, Version)
+	if _, err := c.Auth("glenda", ""); err == nil || !strings.Contains(err.Error(), ErrNoAuth.Error()) {
+		t.Errorf("expected ErrNoAuth, got %v", err)
+	}
+}
@@ -0,0 +1,612 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrClientClosed indicates that the client connection has been closed.
+	ErrClientClosed = errors.New("client closed")
+
+	// ErrConnectionLost indicates that the connection failed while a request
+	// was in flight, and that the request was not retried.
+	ErrConnectionLost = errors.New("connection lost")
+
+	// ErrInvalidReply indicates that the server responded with a message that
+	// is not a valid response to the request.
+	ErrInvalidReply = errors.New("invalid reply")
+
+	// ErrNotAttached indicates a path based request on a client that has not
+	// attached to a service.
+	ErrNotAttached = errors.New("not attached")
+
+	// ErrVersionRejected indicates that the server did not accept any
+	// protocol version offered by the client.
+	ErrVersionRejected = errors.New("version rejected")
+)
+
+// RemoteError is an error reported by the server through ErrorResponse or
+// ErrorResponseDotu.
+type RemoteError struct {
+	// Message is the error string from the server.
+	Message string
+
+	// Errno is the numeric error code for 9P2000.u, or 0 if not provided.
+	Errno uint32
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// remoteErrors maps common server error strings to the corresponding fs
+// errors. Both the Plan 9 and the Unix wording are included, as 9P2000.u
+// servers usually report strerror messages.
+var remoteErrors = map[string]error{
+	"file does not exist":       fs.ErrNotExist,
+	"No such file or directory": fs.ErrNotExist,
+	"file exists":               fs.ErrExist,
+	"File exists":               fs.ErrExist,
+	"permission denied":         fs.ErrPermission,
+	"Permission denied":         fs.ErrPermission,
+	"Operation not permitted":   fs.ErrPermission,
+}
+
+// remoteErrnos maps 9P2000.u error numbers to the corresponding fs errors.
+var remoteErrnos = map[uint32]error{
+	1:  fs.ErrPermission, // EPERM
+	2:  fs.ErrNotExist,   // ENOENT
+	13: fs.ErrPermission, // EACCES
+	17: fs.ErrExist,      // EEXIST
+}
+
+// Is reports whether the remote error corresponds to target, allowing
+// errors.Is(err, fs.ErrNotExist) and similar checks on server errors.
+func (e *RemoteError) Is(target error) bool {
+	if err, ok := remoteErrnos[e.Errno]; ok && err == target {
+		return true
+	}
+	err, ok := remoteErrors[e.Message]
+	return ok && err == target
+}
+
+// tagSetter is implemented by all message structs through the embedded Tag.
+type tagSetter interface {
+	SetTag(Tag)
+}
+
+// ProtocolForVersion returns the protocol for a version string, or nil if the
+// version is unknown.
+func ProtocolForVersion(version string) Protocol {
+	switch version {
+	case Version:
+		return NineP2000
+	case VersionDotu:
+		return NineP2000Dotu
+	case VersionDote:
+		return NineP2000Dote
+	default:
+		return nil
+	}
+}
+
+// Client is a 9P client connection. A Client multiplexes requests from
+// arbitrary goroutines over a single connection, dispatching responses by
+// their tag. The connection must be negotiated with Negotiate before any
+// other request is made.
+//
+// If Redial is set, the client reconnects when the connection fails. See
+// Redial for details.
+type Client struct {
+	// WalkWindow is the maximum amount of directories read concurrently by
+	// WalkDirConcurrent, which is DefaultWalkWindow if zero. Transfers are
+	// pipelined per file instead; see File.SetWindow.
+	WalkWindow int
+
+	// Redial, if set, is used to establish a new connection when the current
+	// one fails. The new connection is negotiated with the version and
+	// message size of the original one. If 9P2000.e is in use and a session
+	// key has been set with SetSessionKey, the session is then resumed with
+	// Tsession, keeping all fids intact. Otherwise, the fids of all open
+	// files are restored by attaching, walking and opening them again.
+	// Redial must be set before Negotiate.
+	Redial func() (io.ReadWriteCloser, error)
+
+	// Retry decides whether a request in flight when the connection failed
+	// is sent again after reconnecting. Requests that are not retried fail
+	// with ErrConnectionLost. If nil, no request is retried. See
+	// RetryIdempotent.
+	Retry func(Message) bool
+
+	// Cache, if set, caches file contents and Stat results for ReadFile and
+	// Stat. See Cache for the requirements on the server. Cache must be set
+	// before use.
+	Cache *Cache
+
+	tags TagPool
+	fids FidPool
+
+	// flushmu serializes flushes sent with flushTag.
+	flushmu sync.Mutex
+
+	// protocol, msize and version are set by Negotiate.
+	protocol Protocol
+	msize    uint32
+	version  string
+
+	// mu protects all following fields, as well as the restore information
+	// of all files.
+	mu sync.Mutex
+
+	// conn, enc and dec are the current connection and its codecs.
+	conn io.ReadWriteCloser
+	enc  *Encoder
+	dec  *Decoder
+
+	// root is the file returned by the most recent Attach, used by the path
+	// based methods.
+	root *File
+
+	// files are the live files whose fids are restored after reconnecting.
+	files map[Fid]*File
+
+	// key is the 9P2000.e session key, or nil if not set.
+	key *[8]byte
+
+	// pending maps outstanding tags to the calls awaiting the response.
+	pending map[Tag]*call
+
+	// ready is non-nil while reconnecting, and closed once done.
+	ready chan struct{}
+
+	// closed is set by Close.
+	closed bool
+
+	// err is set when the connection fails, after which all requests fail
+	// with it.
+	err error
+}
+
+// call is an outstanding request.
+type call struct {
+	req  Message
+	resp Message
+	err  error
+	done chan struct{}
+
+	// unsent is set if writing the request failed, in which case it is
+	// always retried after reconnecting.
+	unsent atomic.Bool
+}
+
+func (cl *call) finish(resp Message, err error) {
+	cl.resp = resp
+	cl.err = err
+	close(cl.done)
+}
+
+// flushTag is withheld from the tag pool of clients, and used for flushes
+// while all other tags are in use, so that abandoning a request never waits
+// for a tag.
+const flushTag = NOTAG - 1
+
+// NewClient returns a new client for the provided connection.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:     conn,
+		enc:      &Encoder{Protocol: NineP2000, Writer: conn},
+		dec:      &Decoder{Protocol: NineP2000, Reader: conn},
+		protocol: NineP2000,
+		files:    make(map[Fid]*File),
+		pending:  make(map[Tag]*call),
+	}
+	c.tags.reserved = NOTAG - flushTag
+	return c
+}
+
+// handshake negotiates the version on a new connection, followed by a
+// session resume if key is not nil. It reports whether the session was
+// resumed. On success, the codecs are configured for the chosen protocol.
+func handshake(enc *Encoder, dec *Decoder, msize uint32, version string, key *[8]byte) (*VersionResponse, bool, error) {
+	err := enc.WriteMessage(&VersionRequest{
+		Tag:         NOTAG,
+		MessageSize: msize,
+		Version:     version,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	m, err := dec.ReadMessage()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var resp *VersionResponse
+	switch m := m.(type) {
+	case *VersionResponse:
+		resp = m
+	case *ErrorResponse:
+		return nil, false, &RemoteError{Message: m.Error}
+	default:
+		return nil, false, ErrInvalidReply
+	}
+
+	p := ProtocolForVersion(resp.Version)
+	if p == nil {
+		return nil, false, ErrVersionRejected
+	}
+	if resp.MessageSize > msize || resp.MessageSize < WriteOverhead+1 {
+		return nil, false, ErrInvalidReply
+	}
+
+	enc.Protocol = p
+	enc.MessageSize = resp.MessageSize
+	dec.Protocol = p
+	dec.MessageSize = resp.MessageSize
+
+	var resumed bool
+	if key != nil && p == NineP2000Dote {
+		if err := enc.WriteMessage(&SessionRequestDote{Tag: NOTAG, Key: *key}); err != nil {
+			return nil, false, err
+		}
+		m, err := dec.ReadMessage()
+		if err != nil {
+			return nil, false, err
+		}
+
+		// A failed resume leaves a new session on the connection.
+		switch m.(type) {
+		case *SessionResponseDote:
+			resumed = true
+		case *ErrorResponse:
+		default:
+			return nil, false, ErrInvalidReply
+		}
+	}
+
+	dec.Greedy = true
+	if err := dec.Reset(); err != nil {
+		return nil, false, err
+	}
+	return resp, resumed, nil
+}
+
+// Negotiate performs version negotiation, suggesting the provided maximum
+// message size and protocol version. On success, the client starts serving
+// requests using the protocol and message size chosen by the server. If
+// 9P2000.e is negotiated and a session key has been set, the key is
+// presented with Tsession, allowing servers to bind the new session to it.
+func (c *Client) Negotiate(msize uint32, version string) error {
+	c.mu.Lock()
+	key := c.key
+	c.mu.Unlock()
+
+	resp, _, err := handshake(c.enc, c.dec, msize, version, key)
+	if err != nil {
+		return err
+	}
+
+	c.protocol = c.enc.Protocol
+	c.msize = resp.MessageSize
+	c.version = resp.Version
+
+	go c.readLoop(c.conn, c.dec)
+	return nil
+}
+
+// Protocol returns the negotiated protocol.
+func (c *Client) Protocol() Protocol {
+	return c.protocol
+}
+
+// MessageSize returns the negotiated maximum message size.
+func (c *Client) MessageSize() uint32 {
+	return c.msize
+}
+
+// Version returns the negotiated protocol version string.
+func (c *Client) Version() string {
+	return c.version
+}
+
+// readLoop reads responses from the connection and dispatches them to the
+// waiting requests until the connection fails.
+func (c *Client) readLoop(conn io.ReadWriteCloser, dec *Decoder) {
+	for {
+		m, err := dec.ReadMessage()
+		if err != nil {
+			c.connLost(conn, err)
+			return
+		}
+
+		c.mu.Lock()
+		cl, ok := c.pending[m.GetTag()]
+		delete(c.pending, m.GetTag())
+		c.mu.Unlock()
+
+		// Responses to unknown tags are dropped.
+		if ok {
+			cl.finish(m, nil)
+		}
+	}
+}
+
+// failLocked marks the client as failed, and fails all outstanding
+// requests. The caller must hold mu.
+func (c *Client) failLocked(err error) {
+	if err == io.EOF {
+		err = ErrClientClosed
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	for tag, cl := range c.pending {
+		cl.finish(nil, c.err)
+		delete(c.pending, tag)
+	}
+}
+
+// Err returns the error that caused the connection to fail, or nil if the
+// connection is still alive.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// RPC sends a request with a newly allocated tag and waits for the response.
+// Error responses are returned as a *RemoteError, and responses that are not
+// valid for the request as ErrInvalidReply. While reconnecting, RPC waits
+// for the new connection to be established.
+func (c *Client) RPC(m Message) (Message, error) {
+	return c.rpc(context.Background(), m, false)
+}
+
+// RPCContext is like RPC, but gives up once ctx is done. A request that has
+// been sent is then flushed with Tflush, and its tag is only released once
+// the server has acknowledged the flush. If the response to the request
+// arrives before the acknowledgement, the request has taken effect, and its
+// response is returned as if ctx had not been done. Otherwise, the error of
+// ctx is returned.
+func (c *Client) RPCContext(ctx context.Context, m Message) (Message, error) {
+	return c.rpc(ctx, m, false)
+}
+
+// rpc implements RPC. Internal requests are used to restore fids while
+// reconnecting, and do not wait for the reconnect to finish.
+func (c *Client) rpc(ctx context.Context, m Message, internal bool) (Message, error) {
+	tag, err := c.tags.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.tags.Put(tag)
+	return c.send(ctx, tag, m, internal)
+}
+
+// send sends a request with the tag, and waits for the response.
+func (c *Client) send(ctx context.Context, tag Tag, m Message, internal bool) (Message, error) {
+	m.(tagSetter).SetTag(tag)
+	cl := &call{req: m, done: make(chan struct{})}
+
+	c.mu.Lock()
+	for !internal && c.ready != nil && c.err == nil {
+		ready := c.ready
+		c.mu.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.pending[tag] = cl
+	conn, enc := c.conn, c.enc
+	c.mu.Unlock()
+
+	if err := enc.WriteMessage(m); err != nil {
+		if c.Redial == nil || err == ErrMessageTooBig || err == ErrUnknownMessageType {
+			c.mu.Lock()
+			delete(c.pending, tag)
+			c.mu.Unlock()
+			return nil, err
+		}
+
+		// The request is now handled as in flight by the reconnect, which
+		// starts once the read loop notices the closed connection.
+		cl.unsent.Store(true)
+		conn.Close()
+	}
+
+	select {
+	case <-cl.done:
+	case <-ctx.Done():
+		if c.flush(tag, cl) {
+			return nil, ctx.Err()
+		}
+	}
+	<-cl.done
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	return c.checkReply(m, cl.resp)
+}
+
+// flush flushes the request of an abandoned call, and reports whether it was
+// flushed before its response arrived. Once flush returns, the tag of the
+// call can be reused.
+func (c *Client) flush(tag Tag, cl *call) bool {
+	// The response to the flush is not needed, as any response, including a
+	// failure of the connection, means that no response to the original
+	// request is pending on the current connection anymore. Responses are
+	// dispatched in order, so a response to the original request that
+	// preceded the acknowledgement has finished the call by now.
+	m := &FlushRequest{OldTag: tag}
+	if t, err := c.tags.Get(); err == nil {
+		c.send(context.Background(), t, m, false)
+		c.tags.Put(t)
+	} else {
+		c.flushmu.Lock()
+		c.send(context.Background(), flushTag, m, false)
+		c.flushmu.Unlock()
+	}
+
+	c.mu.Lock()
+	if c.pending[tag] == cl {
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		return true
+	}
+	c.mu.Unlock()
+
+	// The call has either been finished, or is held by a reconnect that
+	// will retry or fail it.
+	<-cl.done
+	return false
+}
+
+// checkReply converts error responses to errors, and verifies that other
+// responses are valid for the request.
+func (c *Client) checkReply(req, resp Message) (Message, error) {
+	switch r := resp.(type) {
+	case *ErrorResponse:
+		return nil, &RemoteError{Message: r.Error}
+	case *ErrorResponseDotu:
+		return nil, &RemoteError{Message: r.Error, Errno: r.Errno}
+	}
+	if !ValidReply(req, resp, c.protocol) {
+		return nil, ErrInvalidReply
+	}
+	return resp, nil
+}
+
+// newFile allocates a fid for a new file handle.
+func (c *Client) newFile() (*File, error) {
+	fid, err := c.fids.Wait(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &File{c: c, fid: fid}, nil
+}
+
+// releaseFid returns the fid of a failed request to the pool, unless the
+// request was abandoned because ctx is done, in which case the server may
+// have acted on it, and the fid may be in use on the server. Such fids are
+// never reused.
+func (c *Client) releaseFid(ctx context.Context, fid Fid, err error) {
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return
+	}
+	c.fids.Put(fid)
+}
+
+// untrack unregisters a file.
+func (c *Client) untrack(f *File) {
+	c.mu.Lock()
+	delete(c.files, f.fid)
+	c.mu.Unlock()
+}
+
+// Auth requests an authentication file for the provided user and service.
+// The returned file can be read from and written to in order to execute the
+// authentication protocol, after which it can be passed to Attach. As the
+// authentication cannot be replayed, authentication files are not restored
+// after reconnecting.
+func (c *Client) Auth(user, service string) (*File, error) {
+	return c.AuthContext(context.Background(), user, service)
+}
+
+// AuthContext is like Auth, but gives up once ctx is done. See RPCContext.
+func (c *Client) AuthContext(ctx context.Context, user, service string) (*File, error) {
+	f, err := c.newFile()
+	if err != nil {
+		return nil, err
+	}
+
+	var req Message = &AuthRequest{AuthFid: f.fid, Username: user, Service: service}
+	if c.protocol == NineP2000Dotu {
+		req = &AuthRequestDotu{AuthFid: f.fid, Username: user, Service: service, UIDno: NONUNAME}
+	}
+
+	resp, err := c.RPCContext(ctx, req)
+	if err != nil {
+		c.releaseFid(ctx, f.fid, err)
+		return nil, err
+	}
+	f.qid = resp.(*AuthResponse).AuthQid
+	return f, nil
+}
+
+// attachRequest returns an attach request for the negotiated protocol.
+func (c *Client) attachRequest(fid, afid Fid, user, service string) Message {
+	if c.protocol == NineP2000Dotu {
+		return &AttachRequestDotu{Fid: fid, AuthFid: afid, Username: user, Service: service, UIDno: NONUNAME}
+	}
+	return &AttachRequest{Fid: fid, AuthFid: afid, Username: user, Service: service}
+}
+
+// Attach attaches to the provided service as the provided user, returning a
+// file handle for the root of the service. The afid is the authentication
+// file returned by Auth, or nil if no authentication is required. Path based
+// methods such as ReadFile resolve paths relative to the root of the most
+// recent attach.
+func (c *Client) Attach(afid *File, user, service string) (*File, error) {
+	return c.AttachContext(context.Background(), afid, user, service)
+}
+
+// AttachContext is like Attach, but gives up once ctx is done. See
+// RPCContext.
+func (c *Client) AttachContext(ctx context.Context, afid *File, user, service string) (*File, error) {
+	f, err := c.newFile()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := NOFID
+	if afid != nil {
+		if err := afid.use(); err != nil {
+			c.fids.Put(f.fid)
+			return nil, err
+		}
+		defer afid.unuse()
+		auth = afid.fid
+	}
+
+	resp, err := c.RPCContext(ctx, c.attachRequest(f.fid, auth, user, service))
+	if err != nil {
+		c.releaseFid(ctx, f.fid, err)
+		return nil, err
+	}
+	f.qid = resp.(*AttachResponse).Qid
+
+	c.mu.Lock()
+	f.attach = &attachInfo{afid: auth, user: user, service: service}
+	c.root = f
+	c.files[f.fid] = f
+	c.mu.Unlock()
+	return f, nil
+}
+
+// Close closes the connection, failing all outstanding requests. Fids are
+// not clunked, as the server releases them when the connection closes.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	err := conn.Close()
+	c.mu.Lock()
+	c.failLocked(ErrClientClosed)
+	c.mu.Unlock()
+	return err
+}
@@ -0,0 +1,208 @@
+package qp
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache caches file contents and Stat results for a Client, relying on the
+// qid version changing whenever a file changes. Cached entries are only used
+// after a walk or open has confirmed that the version of the file is still
+// the one the entry was read at, which saves reading the file or stat'ing it
+// again, but not the round trip of the walk. As reading a file does not
+// change its version, the access times of cached Stat structs may be
+// outdated. Files with a qid of type QTTMP or QTAPPEND are never cached, and
+// entries are dropped when the file is written, truncated, removed or has its
+// stat changed through the client.
+//
+// Servers that do not maintain qid versions, such as many synthetic file
+// systems that always report version 0, must not be used with a Cache.
+//
+// As qid paths are only unique within a file tree, entries are kept per
+// Client and attach name, and a Cache may be shared by multiple clients.
+//
+// A Cache is created with NewCache. The zero value is an empty cache with a
+// budget of zero bytes, which holds no entries.
+type Cache struct {
+	// mu protects all following fields.
+	mu sync.Mutex
+
+	budget int64
+	size   int64
+
+	// entries maps files to their elements in lru, which holds the entries
+	// from most to least recently used.
+	entries map[cacheKey]*list.Element
+	lru     list.List
+}
+
+// cacheTree identifies the file tree of an attach, within which qid paths
+// identify files.
+type cacheTree struct {
+	c       *Client
+	service string
+}
+
+// cacheKey identifies a file across trees.
+type cacheKey struct {
+	tree cacheTree
+	path uint64
+}
+
+// cacheEntry holds the cached state of a file at a single qid version.
+type cacheEntry struct {
+	key  cacheKey
+	qid  Qid
+	stat *Stat
+
+	data    []byte
+	hasData bool
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.data))
+	if e.stat != nil {
+		n += int64(e.stat.EncodedSize())
+	}
+	return n
+}
+
+// NewCache returns a cache holding up to budget bytes of file contents and
+// encoded Stat structs, evicting the least recently used entries once the
+// budget is exceeded.
+func NewCache(budget int64) *Cache {
+	return &Cache{budget: budget, entries: make(map[cacheKey]*list.Element)}
+}
+
+// cacheable reports whether files with the qid may be cached.
+func cacheable(qid Qid) bool {
+	return qid.Type&(QTTMP|QTAPPEND) == 0
+}
+
+// lookup returns the entry for the qid in the tree, dropping entries of older
+// versions. The caller must hold mu.
+func (cc *Cache) lookup(t cacheTree, qid Qid) *cacheEntry {
+	elem, ok := cc.entries[cacheKey{t, qid.Path}]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*cacheEntry)
+	if e.qid != qid {
+		cc.remove(elem)
+		return nil
+	}
+	cc.lru.MoveToFront(elem)
+	return e
+}
+
+// update applies fn to the entry for the qid in the tree, creating it if
+// needed, and evicts entries until the cache fits its budget again.
+func (cc *Cache) update(t cacheTree, qid Qid, fn func(e *cacheEntry)) {
+	if !cacheable(qid) {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	e := cc.lookup(t, qid)
+	if e == nil {
+		if cc.entries == nil {
+			cc.entries = make(map[cacheKey]*list.Element)
+		}
+		e = &cacheEntry{key: cacheKey{t, qid.Path}, qid: qid}
+		cc.entries[e.key] = cc.lru.PushFront(e)
+	}
+	cc.size -= e.size()
+	fn(e)
+	cc.size += e.size()
+
+	for cc.size > cc.budget && cc.lru.Len() > 0 {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+// remove drops an entry. The caller must hold mu.
+func (cc *Cache) remove(elem *list.Element) {
+	e := cc.lru.Remove(elem).(*cacheEntry)
+	delete(cc.entries, e.key)
+	cc.size -= e.size()
+}
+
+// stat returns a copy of the cached Stat struct of the file, if any.
+func (cc *Cache) stat(t cacheTree, qid Qid) (*Stat, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	e := cc.lookup(t, qid)
+	if e == nil || e.stat == nil {
+		return nil, false
+	}
+	s := *e.stat
+	return &s, true
+}
+
+// putStat caches the Stat struct of a file.
+func (cc *Cache) putStat(t cacheTree, s *Stat) {
+	sc := *s
+	cc.update(t, s.Qid, func(e *cacheEntry) { e.stat = &sc })
+}
+
+// data returns the cached contents of the file, if any. The returned slice
+// must not be modified.
+func (cc *Cache) data(t cacheTree, qid Qid) ([]byte, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	e := cc.lookup(t, qid)
+	if e == nil || !e.hasData {
+		return nil, false
+	}
+	return e.data, true
+}
+
+// putData caches the contents of a file.
+func (cc *Cache) putData(t cacheTree, qid Qid, data []byte) {
+	cc.update(t, qid, func(e *cacheEntry) {
+		e.data = data
+		e.hasData = true
+	})
+}
+
+// invalidate drops the entry for the file with the qid path in the tree.
+func (cc *Cache) invalidate(t cacheTree, path uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if elem, ok := cc.entries[cacheKey{t, path}]; ok {
+		cc.remove(elem)
+	}
+}
+
+// Purge drops all entries.
+func (cc *Cache) Purge() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.entries = make(map[cacheKey]*list.Element)
+	cc.lru.Init()
+	cc.size = 0
+}
+
+// cacheTree returns the tree of the file, which is that of the attach it was
+// walked from.
+func (f *File) cacheTree() cacheTree {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	t := cacheTree{c: f.c}
+	root := f.root
+	if f.attach != nil {
+		root = f
+	}
+	if root != nil && root.attach != nil {
+		t.service = root.attach.service
+	}
+	return t
+}
+
+// invalidate drops the cached state of a file that is being modified.
+func (f *File) invalidate() {
+	if f.c.Cache != nil {
+		f.c.Cache.invalidate(f.cacheTree(), f.qid.Path)
+	}
+}
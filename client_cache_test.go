@@ -0,0 +1,159 @@
+package qp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClientCache(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("content"))
+	tmp := rfs.add("tmp", 0644, []byte("temporary"))
+	tmp.qid.Type |= QTTMP
+	c, _ := rfs.attach(t, Version)
+	c.Cache = NewCache(1 << 20)
+
+	read := func(path, expected string) {
+		t.Helper()
+		if b, err := c.ReadFile(path); err != nil || string(b) != expected {
+			t.Errorf("read of %s returned %q, %v", path, b, err)
+		}
+	}
+
+	read("file", "content")
+	reads := rfs.count(Tread)
+	read("file", "content")
+	if n := rfs.count(Tread) - reads; n != 0 {
+		t.Errorf("expected cached read, got %d reads", n)
+	}
+
+	// Writes through the client invalidate the entry.
+	if err := c.WriteFile("file", []byte("changed"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	read("file", "changed")
+
+	// Changes by others are detected by the version.
+	rfs.mu.Lock()
+	n := rfs.root.child("file")
+	n.data = []byte("external")
+	n.qid.Version++
+	rfs.mu.Unlock()
+	read("file", "external")
+
+	read("tmp", "temporary")
+	reads = rfs.count(Tread)
+	read("tmp", "temporary")
+	if rfs.count(Tread) == reads {
+		t.Error("expected temporary file not to be cached")
+	}
+
+	stats := rfs.count(Tstat)
+	for i := 0; i < 2; i++ {
+		if s, err := c.Stat("file"); err != nil || s.Length != 8 {
+			t.Errorf("stat returned %+v, %v", s, err)
+		}
+	}
+	if n := rfs.count(Tstat) - stats; n != 1 {
+		t.Errorf("expected one stat, got %d", n)
+	}
+	if err := c.Chmod("file", 0600); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	if s, err := c.Stat("file"); err != nil || s.Mode != 0600 {
+		t.Errorf("expected mode to be updated, got %+v, %v", s, err)
+	}
+
+	if err := c.Remove("file"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if len(c.Cache.entries) != 0 {
+		t.Errorf("expected no entries after remove, got %d", len(c.Cache.entries))
+	}
+}
+
+func TestClientCacheShared(t *testing.T) {
+	// Files of different servers and attach names share qid paths and
+	// versions, but not their entries in a shared cache.
+	cache := NewCache(1 << 20)
+	read := func(c *Client, path, expected string) {
+		t.Helper()
+		if b, err := c.ReadFile(path); err != nil || string(b) != expected {
+			t.Errorf("read of %s returned %q, %v", path, b, err)
+		}
+	}
+
+	var c *Client
+	var rfs *ramFS
+	for _, content := range []string{"first", "second"} {
+		rfs = newRamFS()
+		rfs.add("file", 0644, []byte(content))
+		c, _ = rfs.attach(t, Version)
+		c.Cache = cache
+		read(c, "file", content)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(cache.entries))
+	}
+
+	// The test server ignores attach names, so the file is the same, but
+	// is not known to be.
+	if _, err := c.Attach(nil, "glenda", "other"); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	reads := rfs.count(Tread)
+	read(c, "file", "second")
+	if rfs.count(Tread) == reads {
+		t.Error("expected file of other attach name to be read")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cc := NewCache(100)
+	for i := uint64(0); i < 3; i++ {
+		cc.putData(cacheTree{}, Qid{Path: i}, bytes.Repeat([]byte("x"), 40))
+	}
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 0}); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+
+	// Using an entry protects it from eviction.
+	cc.data(cacheTree{}, Qid{Path: 1})
+	cc.putData(cacheTree{}, Qid{Path: 3}, bytes.Repeat([]byte("x"), 40))
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 1}); !ok {
+		t.Error("expected recently used entry to be kept")
+	}
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 2}); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if cc.size != 80 {
+		t.Errorf("expected size 80, got %d", cc.size)
+	}
+
+	// Entries of other versions are not returned.
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 1, Version: 1}); ok {
+		t.Error("expected entry of other version to be ignored")
+	}
+	cc.putData(cacheTree{}, Qid{Path: 4}, bytes.Repeat([]byte("x"), 200))
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 4}); ok || cc.size > 100 {
+		t.Errorf("expected entry over budget not to be kept, size is %d", cc.size)
+	}
+	cc.putData(cacheTree{}, Qid{Path: 5, Type: QTAPPEND}, nil)
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 5, Type: QTAPPEND}); ok {
+		t.Error("expected append-only file not to be cached")
+	}
+}
+
+func TestCacheZero(t *testing.T) {
+	var cc Cache
+	cc.putData(cacheTree{}, Qid{Path: 1}, nil)
+	cc.putStat(cacheTree{}, &Stat{Qid: Qid{Path: 2}})
+	if _, ok := cc.data(cacheTree{}, Qid{Path: 1}); ok {
+		t.Error("expected zero cache to hold no data")
+	}
+	if _, ok := cc.stat(cacheTree{}, Qid{Path: 2}); ok {
+		t.Error("expected zero cache to hold no stat")
+	}
+	cc.invalidate(cacheTree{}, 1)
+	cc.Purge()
+}
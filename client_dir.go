@@ -0,0 +1,120 @@
+package qp
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+// DirIterator reads the entries of a directory one at a time. Each read
+// request returns as many entries as fit in the read unit of the file, which
+// are decoded as they are requested, so that directories of any size can be
+// listed without buffering all of their entries.
+type DirIterator struct {
+	f    *File
+	dotu bool
+
+	// buf is the read buffer, and data the part of the most recent read that
+	// has not been decoded yet.
+	buf  []byte
+	data []byte
+
+	// err is the error that ended the iteration, which is io.EOF at the end
+	// of the directory.
+	err error
+}
+
+// NewDirIterator returns an iterator over the entries of f from its current
+// offset. The file must be a directory opened for reading, and must not be
+// read from by other means while iterating. For 9P2000.u, the extended fields
+// of the entries are dropped.
+func NewDirIterator(f *File) *DirIterator {
+	return &DirIterator{f: f, dotu: f.c.protocol == NineP2000Dotu}
+}
+
+// Next returns the next entry of the directory, issuing a read request if
+// all entries of the previous one have been returned. At the end of the
+// directory, Next returns io.EOF.
+func (it *DirIterator) Next() (Stat, error) {
+	return it.NextContext(context.Background())
+}
+
+// NextContext is like Next, but gives up once ctx is done. The iteration
+// then ends with the error of ctx.
+func (it *DirIterator) NextContext(ctx context.Context) (Stat, error) {
+	for len(it.data) == 0 {
+		if it.err != nil {
+			return Stat{}, it.err
+		}
+		if it.buf == nil {
+			it.buf = make([]byte, it.f.readUnit())
+		}
+		n, err := it.f.ReadContext(ctx, it.buf)
+		if err != nil {
+			it.err = err
+			return Stat{}, err
+		}
+		it.data = it.buf[:n]
+	}
+
+	s, size, err := unmarshalDirEntry(it.data, it.dotu)
+	if err != nil {
+		it.data = nil
+		it.err = err
+		return Stat{}, err
+	}
+	it.data = it.data[size:]
+	return s, nil
+}
+
+// ReadDir returns the next entries of the directory with the semantics of
+// fs.ReadDirFile. If n > 0, ReadDir returns at most n entries, and io.EOF if
+// no entries are left. If n <= 0, ReadDir returns all remaining entries, and
+// a nil error at the end of the directory.
+func (it *DirIterator) ReadDir(n int) ([]Stat, error) {
+	return it.ReadDirContext(context.Background(), n)
+}
+
+// ReadDirContext is like ReadDir, but gives up once ctx is done.
+func (it *DirIterator) ReadDirContext(ctx context.Context, n int) ([]Stat, error) {
+	var stats []Stat
+	for n <= 0 || len(stats) < n {
+		s, err := it.NextContext(ctx)
+		if err == io.EOF {
+			if n > 0 && len(stats) == 0 {
+				return stats, io.EOF
+			}
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// unmarshalDirEntry decodes the first Stat entry of directory data as
+// returned by a read request, returning the entry and its encoded size.
+func unmarshalDirEntry(b []byte, dotu bool) (Stat, int, error) {
+	if len(b) < 2 {
+		return Stat{}, 0, ErrPayloadTooShort
+	}
+	size := 2 + int(binary.LittleEndian.Uint16(b[0:2]))
+	if len(b) < size {
+		return Stat{}, 0, ErrPayloadTooShort
+	}
+
+	if dotu {
+		var sd StatDotu
+		if err := sd.Unmarshal(b[:size]); err != nil {
+			return Stat{}, 0, err
+		}
+		return sd.stat(), size, nil
+	}
+	var s Stat
+	if err := s.Unmarshal(b[:size]); err != nil {
+		return Stat{}, 0, err
+	}
+	return s, size, nil
+}
@@ -0,0 +1,90 @@
+package qp
+
+import (
+	"io"
+	"strconv"
+	"testing"
+)
+
+func TestDirIterator(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu} {
+		rfs := newRamFS()
+		rfs.iounit = 200
+		for i := 0; i < 100; i++ {
+			rfs.add("dir/file"+strconv.Itoa(i), 0644, nil)
+		}
+		_, root := rfs.attach(t, version)
+
+		open := func() *DirIterator {
+			f, err := root.Walk("dir")
+			if err != nil {
+				t.Fatalf("%s: walk failed: %v", version, err)
+			}
+			if err := f.Open(OREAD); err != nil {
+				t.Fatalf("%s: open failed: %v", version, err)
+			}
+			return NewDirIterator(f)
+		}
+
+		// Entries are read on demand.
+		it := open()
+		reads := rfs.count(Tread)
+		s, err := it.Next()
+		if err != nil || s.Name != "file0" {
+			t.Errorf("%s: expected file0, got %q, %v", version, s.Name, err)
+		}
+		if n := rfs.count(Tread) - reads; n != 1 {
+			t.Errorf("%s: expected a single read, got %d", version, n)
+		}
+
+		seen := 1
+		for {
+			s, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: next failed: %v", version, err)
+			}
+			if expected := "file" + strconv.Itoa(seen); s.Name != expected {
+				t.Errorf("%s: expected %s, got %s", version, expected, s.Name)
+			}
+			seen++
+		}
+		if seen != 100 {
+			t.Errorf("%s: expected 100 entries, got %d", version, seen)
+		}
+		if n := rfs.count(Tread) - reads; n < 10 {
+			t.Errorf("%s: expected directory to be read in chunks, got %d reads", version, n)
+		}
+		if _, err := it.Next(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF after end, got %v", version, err)
+		}
+
+		it = open()
+		total := 0
+		for {
+			stats, err := it.ReadDir(7)
+			if err == io.EOF {
+				if len(stats) != 0 {
+					t.Errorf("%s: expected no entries with io.EOF, got %d", version, len(stats))
+				}
+				break
+			}
+			if err != nil || len(stats) == 0 || len(stats) > 7 {
+				t.Fatalf("%s: ReadDir(7) returned %d entries, %v", version, len(stats), err)
+			}
+			total += len(stats)
+		}
+		if total != 100 {
+			t.Errorf("%s: expected 100 entries, got %d", version, total)
+		}
+		if stats, err := it.ReadDir(-1); err != nil || len(stats) != 0 {
+			t.Errorf("%s: expected no remaining entries, got %d, %v", version, len(stats), err)
+		}
+
+		if stats, err := open().ReadDir(0); err != nil || len(stats) != 100 {
+			t.Errorf("%s: ReadDir(0) returned %d entries, %v", version, len(stats), err)
+		}
+	}
+}
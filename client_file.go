@@ -0,0 +1,619 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidOffset indicates a seek to a negative offset.
+var ErrInvalidOffset = errors.New("invalid offset")
+
+// File is a client handle for a fid. A File is obtained from Client.Attach or
+// Client.Auth, or by walking from another File. Once opened with Open or
+// Create, the File implements io.Reader, io.ReaderAt, io.Writer,
+// io.WriterAt, io.Seeker and io.Closer. A File may be used concurrently from
+// multiple goroutines, but the offset used by Read, Write and Seek is shared.
+// Once closed, all methods fail with fs.ErrClosed.
+type File struct {
+	c   *Client
+	fid Fid
+	qid Qid
+
+	// iounit is the iounit returned when the file was opened.
+	iounit uint32
+
+	// mu serializes Read, Write and Seek, and protects offset and the
+	// window of pipelined transfers.
+	mu     sync.Mutex
+	offset int64
+	window int
+
+	// cmu protects closed, the number of operations using the fid, and the
+	// function releasing the fid once the file is closed. The fid is only
+	// released after the last operation finishes, so that requests for the
+	// file cannot reach another file that was handed the fid.
+	cmu    sync.Mutex
+	closed bool
+	users  int
+	free   func()
+
+	// The following are used to restore the fid after reconnecting, and are
+	// protected by the mu of the client. attach is set for files returned by
+	// Attach. Other files are restored by walking names from root, and
+	// opened again with mode if opened is set.
+	attach *attachInfo
+	root   *File
+	names  []string
+	opened bool
+	mode   OpenMode
+}
+
+// Fid returns the fid of the file.
+func (f *File) Fid() Fid {
+	return f.fid
+}
+
+// Qid returns the qid of the file as of the last walk, open or create.
+func (f *File) Qid() Qid {
+	return f.qid
+}
+
+// readUnit returns the maximum amount of data to request in a single read.
+func (f *File) readUnit() uint32 {
+	max := f.c.msize - ReadOverhead
+	if f.iounit > 0 && f.iounit < max {
+		return f.iounit
+	}
+	return max
+}
+
+// writeUnit returns the maximum amount of data to send in a single write.
+func (f *File) writeUnit() uint32 {
+	max := f.c.msize - WriteOverhead
+	if f.iounit > 0 && f.iounit < max {
+		return f.iounit
+	}
+	return max
+}
+
+// use marks an operation on the fid as in progress, failing with
+// fs.ErrClosed if the file is closed. Each successful call must be followed
+// by a call to unuse once the operation is done with the fid.
+func (f *File) use() error {
+	f.cmu.Lock()
+	defer f.cmu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.users++
+	return nil
+}
+
+// unuse ends an operation started with use, releasing the fid if the file
+// was closed while the operation was in progress.
+func (f *File) unuse() {
+	f.cmu.Lock()
+	f.users--
+	var free func()
+	if f.users == 0 {
+		free, f.free = f.free, nil
+	}
+	f.cmu.Unlock()
+	if free != nil {
+		free()
+	}
+}
+
+// Walk walks from the file to the provided names, returning a handle for the
+// resulting file. Walks longer than MAXWELEM names are split into several
+// requests. If the walk is incomplete, an error wrapping fs.ErrNotExist is
+// returned.
+func (f *File) Walk(names ...string) (*File, error) {
+	return f.WalkContext(context.Background(), names...)
+}
+
+// WalkContext is like Walk, but gives up once ctx is done. See
+// Client.RPCContext.
+func (f *File) WalkContext(ctx context.Context, names ...string) (*File, error) {
+	if err := f.use(); err != nil {
+		return nil, err
+	}
+	defer f.unuse()
+	nf, err := f.c.newFile()
+	if err != nil {
+		return nil, err
+	}
+
+	wp := &WalkPlan{Fid: f.fid, NewFid: nf.fid, Names: names}
+	var resps []*WalkResponse
+	for _, req := range wp.Requests() {
+		resp, err := f.c.RPCContext(ctx, req)
+		if err != nil {
+			if wp.Established(resps) {
+				nf.Close()
+			} else {
+				f.c.releaseFid(ctx, nf.fid, err)
+			}
+			return nil, err
+		}
+		wr := resp.(*WalkResponse)
+		resps = append(resps, wr)
+		if !WalkComplete(req, wr) {
+			break
+		}
+	}
+
+	qids, complete := wp.Result(resps)
+	if !complete {
+		if wp.Established(resps) {
+			nf.Close()
+		} else {
+			f.c.fids.Put(nf.fid)
+		}
+		return nil, &fs.PathError{Op: "walk", Path: strings.Join(names, "/"), Err: fs.ErrNotExist}
+	}
+
+	nf.qid = f.qid
+	if len(qids) > 0 {
+		nf.qid = qids[len(qids)-1]
+	}
+
+	f.c.mu.Lock()
+	nf.root = f.root
+	if f.attach != nil {
+		nf.root = f
+	}
+	nf.names = append(append([]string{}, f.names...), names...)
+	f.c.files[nf.fid] = nf
+	f.c.mu.Unlock()
+	return nf, nil
+}
+
+// Open opens the file with the provided mode.
+func (f *File) Open(mode OpenMode) error {
+	return f.OpenContext(context.Background(), mode)
+}
+
+// OpenContext is like Open, but gives up once ctx is done. See
+// Client.RPCContext.
+func (f *File) OpenContext(ctx context.Context, mode OpenMode) error {
+	if err := f.use(); err != nil {
+		return err
+	}
+	defer f.unuse()
+	if mode&OTRUNC != 0 {
+		defer f.invalidate()
+	}
+	resp, err := f.c.RPCContext(ctx, &OpenRequest{Fid: f.fid, Mode: mode})
+	if err != nil {
+		return err
+	}
+	or := resp.(*OpenResponse)
+	f.qid = or.Qid
+	f.iounit = or.IOUnit
+
+	f.c.mu.Lock()
+	f.opened = true
+	f.mode = mode
+	f.c.mu.Unlock()
+	return nil
+}
+
+// Create creates a file with the provided name, permissions and mode in the
+// directory represented by the file. On success, the handle refers to the
+// new, opened file. If the file was returned by Attach, its fid is cloned
+// first to take its place as the root of the attach.
+func (f *File) Create(name string, perm FileMode, mode OpenMode) error {
+	return f.CreateContext(context.Background(), name, perm, mode)
+}
+
+// CreateContext is like Create, but gives up once ctx is done. See
+// Client.RPCContext.
+func (f *File) CreateContext(ctx context.Context, name string, perm FileMode, mode OpenMode) error {
+	if err := f.use(); err != nil {
+		return err
+	}
+	defer f.unuse()
+	f.c.mu.Lock()
+	attached := f.attach != nil
+	f.c.mu.Unlock()
+	var root *File
+	if attached {
+		var err error
+		if root, err = f.WalkContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	var req Message = &CreateRequest{Fid: f.fid, Name: name, Permissions: perm, Mode: mode}
+	if f.c.protocol == NineP2000Dotu {
+		req = &CreateRequestDotu{Fid: f.fid, Name: name, Permissions: perm, Mode: mode}
+	}
+
+	resp, err := f.c.RPCContext(ctx, req)
+	if err != nil {
+		if root != nil {
+			root.Close()
+		}
+		return err
+	}
+	cr := resp.(*CreateResponse)
+	f.qid = cr.Qid
+	f.iounit = cr.IOUnit
+
+	f.c.mu.Lock()
+	if root != nil {
+		f.c.reroot(f, root)
+	}
+	f.names = append(append([]string{}, f.names...), name)
+	f.opened = true
+	f.mode = mode
+	f.c.mu.Unlock()
+	return nil
+}
+
+// reroot makes root the attached file in place of f, whose fid no longer
+// refers to the root of the attach. The mu of the client must be held.
+func (c *Client) reroot(f, root *File) {
+	root.attach, root.root, root.names = f.attach, nil, nil
+	for _, g := range c.files {
+		if g.root == f {
+			g.root = root
+		}
+	}
+	if c.root == f {
+		c.root = root
+	}
+	f.attach = nil
+	f.root = root
+}
+
+// Stat returns the Stat struct of the file. For 9P2000.u, the extended fields
+// are dropped.
+func (f *File) Stat() (*Stat, error) {
+	return f.StatContext(context.Background())
+}
+
+// StatContext is like Stat, but gives up once ctx is done. See
+// Client.RPCContext.
+func (f *File) StatContext(ctx context.Context) (*Stat, error) {
+	if err := f.use(); err != nil {
+		return nil, err
+	}
+	defer f.unuse()
+	resp, err := f.c.RPCContext(ctx, &StatRequest{Fid: f.fid})
+	if err != nil {
+		return nil, err
+	}
+	switch sr := resp.(type) {
+	case *StatResponse:
+		return &sr.Stat, nil
+	case *StatResponseDotu:
+		s := sr.Stat.stat()
+		return &s, nil
+	default:
+		return nil, ErrInvalidReply
+	}
+}
+
+// NoChangeStat returns a Stat struct for WriteStat that leaves all fields
+// unchanged. Fields to modify are set on the returned value.
+func NoChangeStat() Stat {
+	return Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{Type: ^QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+// WriteStat applies the Stat struct to the file. Fields set to their
+// NoChangeStat values are left unchanged. For 9P2000.u, the extended fields
+// are left unchanged.
+func (f *File) WriteStat(s Stat) error {
+	return f.WriteStatContext(context.Background(), s)
+}
+
+// WriteStatContext is like WriteStat, but gives up once ctx is done. See
+// Client.RPCContext.
+func (f *File) WriteStatContext(ctx context.Context, s Stat) error {
+	if err := f.use(); err != nil {
+		return err
+	}
+	defer f.unuse()
+	var req Message = &WriteStatRequest{Fid: f.fid, Stat: s}
+	if f.c.protocol == NineP2000Dotu {
+		req = &WriteStatRequestDotu{Fid: f.fid, Stat: StatDotu{
+			Type:   s.Type,
+			Dev:    s.Dev,
+			Qid:    s.Qid,
+			Mode:   s.Mode,
+			Atime:  s.Atime,
+			Mtime:  s.Mtime,
+			Length: s.Length,
+			Name:   s.Name,
+			UID:    s.UID,
+			GID:    s.GID,
+			MUID:   s.MUID,
+			UIDno:  NONUNAME,
+			GIDno:  NONUNAME,
+			MUIDno: NONUNAME,
+		}}
+	}
+	_, err := f.c.RPCContext(ctx, req)
+	f.invalidate()
+	return err
+}
+
+// ReadDir reads the directory entries from the current offset until the end
+// of the directory. The file must be a directory opened for reading. For
+// 9P2000.u, the extended fields are dropped. Use a DirIterator to read large
+// directories without buffering all entries.
+func (f *File) ReadDir() ([]Stat, error) {
+	return f.ReadDirContext(context.Background())
+}
+
+// ReadDirContext is like ReadDir, but gives up once ctx is done, returning
+// the entries read so far and the error of ctx.
+func (f *File) ReadDirContext(ctx context.Context) ([]Stat, error) {
+	return NewDirIterator(f).ReadDirContext(ctx, -1)
+}
+
+// stat returns the Stat struct without the 9P2000.u extensions.
+func (s *StatDotu) stat() Stat {
+	return Stat{
+		Type:   s.Type,
+		Dev:    s.Dev,
+		Qid:    s.Qid,
+		Mode:   s.Mode,
+		Atime:  s.Atime,
+		Mtime:  s.Mtime,
+		Length: s.Length,
+		Name:   s.Name,
+		UID:    s.UID,
+		GID:    s.GID,
+		MUID:   s.MUID,
+	}
+}
+
+// read performs a single read request at the provided offset.
+func (f *File) read(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if err := f.use(); err != nil {
+		return 0, err
+	}
+	defer f.unuse()
+	count := f.readUnit()
+	if uint32(len(p)) < count {
+		count = uint32(len(p))
+	}
+
+	resp, err := f.c.RPCContext(ctx, &ReadRequest{Fid: f.fid, Offset: uint64(off), Count: count})
+	if err != nil {
+		return 0, err
+	}
+	data := resp.(*ReadResponse).Data
+	if uint32(len(data)) > count {
+		return 0, ErrInvalidReply
+	}
+	return copy(p, data), nil
+}
+
+// write performs a single write request at the provided offset.
+func (f *File) write(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if err := f.use(); err != nil {
+		return 0, err
+	}
+	defer f.unuse()
+	if unit := f.writeUnit(); uint32(len(p)) > unit {
+		p = p[:unit]
+	}
+
+	resp, err := f.c.RPCContext(ctx, &WriteRequest{Fid: f.fid, Offset: uint64(off), Data: p})
+	f.invalidate()
+	if err != nil {
+		return 0, err
+	}
+	n := int(resp.(*WriteResponse).Count)
+	if n > len(p) {
+		return 0, ErrInvalidReply
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes from the current offset using a single read
+// request. At end of file, Read returns 0, io.EOF.
+func (f *File) Read(p []byte) (int, error) {
+	return f.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but flushes the read request and returns the
+// error of ctx once ctx is done. This allows reads from files that block
+// until data is available to be abandoned. See Client.RPCContext.
+func (f *File) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.read(ctx, p, f.offset)
+	f.offset += int64(n)
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the provided offset, issuing as many read
+// requests as needed. A read returning no data is treated as end of file, in
+// which case ReadAt returns the data read so far and io.EOF.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is like ReadAt, but gives up once ctx is done, returning the
+// data read so far and the error of ctx.
+func (f *File) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := f.read(ctx, p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// Write writes p at the current offset, issuing as many write requests as
+// needed.
+func (f *File) Write(p []byte) (int, error) {
+	return f.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but gives up once ctx is done, returning the
+// amount of data written so far and the error of ctx.
+func (f *File) WriteContext(ctx context.Context, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.WriteAtContext(ctx, p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at the provided offset, issuing as many write requests as
+// needed. If the server accepts no data, io.ErrShortWrite is returned.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is like WriteAt, but gives up once ctx is done, returning
+// the amount of data written so far and the error of ctx.
+func (f *File) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := f.write(ctx, p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Seek sets the offset for the next Read or Write. Seeking relative to the
+// end of the file requires a stat request to learn the file length.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.use(); err != nil {
+		return 0, err
+	}
+	defer f.unuse()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		s, err := f.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += int64(s.Length)
+	default:
+		return f.offset, ErrInvalidOffset
+	}
+
+	if offset < 0 {
+		return f.offset, ErrInvalidOffset
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// release marks the handle as closed. It reports false if the handle was
+// already closed.
+func (f *File) release() bool {
+	f.cmu.Lock()
+	defer f.cmu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.closed = true
+	return true
+}
+
+// releaseFid returns the fid of the closed file to the client once no
+// operation uses it anymore. See Client.releaseFid.
+func (f *File) releaseFid(ctx context.Context, err error) {
+	free := func() { f.c.releaseFid(ctx, f.fid, err) }
+	f.cmu.Lock()
+	if f.users > 0 {
+		f.free = free
+		free = nil
+	}
+	f.cmu.Unlock()
+	if free != nil {
+		free()
+	}
+}
+
+// Close clunks the fid. The fid is released even if the server reports an
+// error, as a clunk always invalidates the fid.
+func (f *File) Close() error {
+	return f.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but gives up once ctx is done. The handle is
+// closed regardless, but a fid whose clunk was abandoned is not reused, as
+// the server may not have acted on it. See Client.RPCContext.
+func (f *File) CloseContext(ctx context.Context) error {
+	if !f.release() {
+		return fs.ErrClosed
+	}
+	_, err := f.c.RPCContext(ctx, &ClunkRequest{Fid: f.fid})
+	f.c.untrack(f)
+	f.releaseFid(ctx, err)
+	return err
+}
+
+// Remove removes the file and clunks the fid. The fid is released even if
+// the removal fails.
+func (f *File) Remove() error {
+	return f.RemoveContext(context.Background())
+}
+
+// RemoveContext is like Remove, but gives up once ctx is done, with the
+// handle closed as for CloseContext.
+func (f *File) RemoveContext(ctx context.Context) error {
+	if !f.release() {
+		return fs.ErrClosed
+	}
+	_, err := f.c.RPCContext(ctx, &RemoveRequest{Fid: f.fid})
+	f.invalidate()
+	f.c.untrack(f)
+	f.releaseFid(ctx, err)
+	return err
+}
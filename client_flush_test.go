@@ -0,0 +1,261 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallServer serves a single file whose reads and walks never complete on
+// their own. Once a read is flushed, the server responds to it first if
+// answer is set.
+type stallServer struct {
+	answer bool
+
+	mu      sync.Mutex
+	reads   []Tag
+	flushed []Tag
+}
+
+func (ss *stallServer) dial(t *testing.T) *Client {
+	cconn, sconn := net.Pipe()
+	go ss.serve(sconn)
+
+	c := NewClient(cconn)
+	if err := c.Negotiate(8192, Version); err != nil {
+		t.Fatalf("negotiate failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (ss *stallServer) serve(conn net.Conn) {
+	defer conn.Close()
+	enc := &Encoder{Protocol: NineP2000, Writer: conn}
+	dec := &Decoder{Protocol: NineP2000, Reader: conn}
+	for {
+		m, err := dec.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var resp Message
+		switch m := m.(type) {
+		case *VersionRequest:
+			resp = &VersionResponse{Tag: m.Tag, MessageSize: m.MessageSize, Version: Version}
+		case *AttachRequest:
+			resp = &AttachResponse{Tag: m.Tag}
+		case *OpenRequest:
+			resp = &OpenResponse{Tag: m.Tag}
+		case *ReadRequest, *WalkRequest:
+			ss.mu.Lock()
+			ss.reads = append(ss.reads, m.GetTag())
+			ss.mu.Unlock()
+		case *FlushRequest:
+			if ss.answer {
+				enc.WriteMessage(&ReadResponse{Tag: m.OldTag, Data: []byte("late")})
+			}
+			ss.mu.Lock()
+			ss.flushed = append(ss.flushed, m.OldTag)
+			ss.mu.Unlock()
+			resp = &FlushResponse{Tag: m.Tag}
+		default:
+			resp = &ErrorResponse{Tag: m.GetTag(), Error: "unexpected message"}
+		}
+		if resp != nil {
+			if err := enc.WriteMessage(resp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ss *stallServer) open(t *testing.T) (*Client, *File) {
+	c := ss.dial(t)
+	f, err := c.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if err := f.Open(OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	return c, f
+}
+
+func TestClientFlush(t *testing.T) {
+	ss := &stallServer{}
+	c, f := ss.open(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n, err := f.ReadContext(ctx, make([]byte, 10)); n != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %d, %v", n, err)
+	}
+
+	ss.mu.Lock()
+	if len(ss.reads) != 1 || len(ss.flushed) != 1 || ss.reads[0] != ss.flushed[0] {
+		t.Errorf("expected read to be flushed, got reads %v and flushes %v", ss.reads, ss.flushed)
+	}
+	ss.mu.Unlock()
+
+	c.mu.Lock()
+	if len(c.pending) != 0 {
+		t.Errorf("expected no pending requests, got %d", len(c.pending))
+	}
+	c.mu.Unlock()
+
+	// A cancelled context fails before anything is sent.
+	cancel()
+	if _, err := c.RPCContext(ctx, &ReadRequest{Fid: f.fid, Count: 10}); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestClientFlushTagsExhausted(t *testing.T) {
+	ss := &stallServer{}
+	c, f := ss.open(t)
+
+	// With all tags held by requests in flight, the flush is sent with the
+	// reserved tag instead of waiting for one.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.ReadContext(ctx, make([]byte, 10))
+		done <- err
+	}()
+	for {
+		ss.mu.Lock()
+		n := len(ss.reads)
+		ss.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var held []Tag
+	for {
+		tag, err := c.tags.Get()
+		if err != nil {
+			break
+		}
+		held = append(held, tag)
+	}
+	if len(held) != int(flushTag)-1 {
+		t.Errorf("expected %d tags to be available, got %d", flushTag-1, len(held))
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected read to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush waited for a tag")
+	}
+	ss.mu.Lock()
+	if len(ss.flushed) != 1 {
+		t.Errorf("expected read to be flushed, got flushes %v", ss.flushed)
+	}
+	ss.mu.Unlock()
+
+	for _, tag := range held {
+		c.tags.Put(tag)
+	}
+}
+
+func TestClientFlushAnswered(t *testing.T) {
+	ss := &stallServer{answer: true}
+	_, f := ss.open(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b := make([]byte, 10)
+	n, err := f.ReadContext(ctx, b)
+	if err != nil || string(b[:n]) != "late" {
+		t.Fatalf("expected response preceding the flush, got %q, %v", b[:n], err)
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 4 {
+		t.Errorf("expected offset 4, got %d", pos)
+	}
+}
+
+func TestClientWalkContext(t *testing.T) {
+	ss := &stallServer{}
+	c, root := ss.open(t)
+	inUse := len(c.fids.InUse())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := root.WalkContext(ctx, "file"); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+	if _, err := c.StatContext(ctx, "file"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline to be exceeded, got %v", err)
+	}
+
+	// The server may still establish the fids of the abandoned walks, so
+	// they are not reused.
+	if n := len(c.fids.InUse()); n != inUse+2 {
+		t.Errorf("expected %d fids in use, got %d", inUse+2, n)
+	}
+}
+
+func TestClientCloseInFlight(t *testing.T) {
+	ss := &stallServer{}
+	c, f := ss.open(t)
+
+	// A file closed while a read is in progress keeps its fid until the
+	// read returns, so that the fid is not reused by another file meanwhile.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.ReadContext(ctx, make([]byte, 10))
+		done <- err
+	}()
+	for {
+		ss.mu.Lock()
+		n := len(ss.reads)
+		ss.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	f.Close()
+	if fids := c.fids.InUse(); len(fids) != 1 || fids[0] != f.Fid() {
+		t.Errorf("expected fid of pending read to stay in use, got %v", fids)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected read to be cancelled, got %v", err)
+	}
+	if fids := c.fids.InUse(); len(fids) != 0 {
+		t.Errorf("expected fid to be released after the read, got %v", fids)
+	}
+}
+
+func TestClientWriteToContext(t *testing.T) {
+	ss := &stallServer{}
+	c, f := ss.open(t)
+	f.SetWindow(4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n, err := f.WriteToContext(ctx, io.Discard); n != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %d, %v", n, err)
+	}
+	ss.mu.Lock()
+	if len(ss.reads) != 4 || len(ss.flushed) != 4 {
+		t.Errorf("expected 4 reads to be flushed, got %v and %v", ss.reads, ss.flushed)
+	}
+	ss.mu.Unlock()
+	if tags := c.tags.InUse(); len(tags) != 0 {
+		t.Errorf("tags leaked: %v", tags)
+	}
+}
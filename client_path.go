@@ -0,0 +1,336 @@
+package qp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// ErrCrossDirRename indicates a rename to a different directory, which 9P
+// does not support.
+var ErrCrossDirRename = errors.New("rename across directories")
+
+// attached returns the root used by the path based methods.
+func (c *Client) attached() (*File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.root == nil {
+		return nil, ErrNotAttached
+	}
+	return c.root, nil
+}
+
+// walk walks from the root to the path.
+func (c *Client) walk(ctx context.Context, names []string) (*File, error) {
+	root, err := c.attached()
+	if err != nil {
+		return nil, err
+	}
+	return root.WalkContext(ctx, names...)
+}
+
+// pathError wraps err in a *fs.PathError, unwrapping the errors returned by
+// File.Walk.
+func pathError(op, path string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// splitParent splits the path into the names of the parent directory and the
+// final name. It fails for paths without names.
+func splitParent(op, path string) ([]string, string, error) {
+	names := SplitPath(path)
+	if len(names) == 0 || names[len(names)-1] == ".." {
+		return nil, "", &fs.PathError{Op: op, Path: path, Err: fs.ErrInvalid}
+	}
+	return names[:len(names)-1], names[len(names)-1], nil
+}
+
+// ReadFile reads the file at the path. If 9P2000.e was negotiated, the file
+// is read with a single Tsread, continuing with regular reads only if the
+// content did not fit in the response. If the client has a Cache, the file
+// is instead walked to, and only read if the cache does not hold its current
+// version.
+func (c *Client) ReadFile(path string) ([]byte, error) {
+	return c.ReadFileContext(context.Background(), path)
+}
+
+// ReadFileContext is like ReadFile, but gives up once ctx is done. See
+// RPCContext.
+func (c *Client) ReadFileContext(ctx context.Context, path string) ([]byte, error) {
+	names := SplitPath(path)
+
+	var data []byte
+	if c.protocol == NineP2000Dote && c.Cache == nil {
+		root, err := c.attached()
+		if err != nil {
+			return nil, pathError("read", path, err)
+		}
+		resp, err := c.RPCContext(ctx, &SimpleReadRequestDote{Fid: root.fid, Names: names})
+		if err != nil {
+			return nil, pathError("read", path, err)
+		}
+		data = resp.(*SimpleReadResponseDote).Data
+		if uint32(len(data)) < c.msize-ReadOverhead {
+			return data, nil
+		}
+	}
+
+	f, err := c.walk(ctx, names)
+	if err != nil {
+		return nil, pathError("read", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	// A walk of no names does not return a qid, leaving the qid of the
+	// attach in place, which may be outdated.
+	if c.Cache != nil && len(names) > 0 {
+		if cached, ok := c.Cache.data(f.cacheTree(), f.qid); ok {
+			return append([]byte(nil), cached...), nil
+		}
+	}
+
+	if err := f.OpenContext(ctx, OREAD); err != nil {
+		return nil, pathError("read", path, err)
+	}
+	f.offset = int64(len(data))
+	buf := bytes.NewBuffer(data)
+	if _, err := f.pipelineRead(ctx, buf, f.offset); err != nil {
+		return nil, pathError("read", path, err)
+	}
+	if c.Cache != nil {
+		c.Cache.putData(f.cacheTree(), f.qid, append([]byte(nil), buf.Bytes()...))
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile writes data to the file at the path, creating it with the
+// provided permissions if it does not exist, and truncating it otherwise. If
+// 9P2000.e was negotiated and the data fits in a single message, the file is
+// written with a single Tswrite, in which case the server decides the
+// permissions of a new file. Clients with a Cache do not use Tswrite, as it
+// does not identify the file written to.
+func (c *Client) WriteFile(path string, data []byte, perm FileMode) error {
+	return c.WriteFileContext(context.Background(), path, data, perm)
+}
+
+// WriteFileContext is like WriteFile, but gives up once ctx is done. See
+// RPCContext.
+func (c *Client) WriteFileContext(ctx context.Context, path string, data []byte, perm FileMode) error {
+	dir, name, err := splitParent("write", path)
+	if err != nil {
+		return err
+	}
+
+	if c.protocol == NineP2000Dote && c.Cache == nil {
+		root, err := c.attached()
+		if err != nil {
+			return pathError("write", path, err)
+		}
+		req := &SimpleWriteRequestDote{Fid: root.fid, Names: append(dir[:len(dir):len(dir)], name), Data: data}
+		if uint32(req.EncodedSize()+HeaderSize) <= c.msize {
+			resp, err := c.RPCContext(ctx, req)
+			if err != nil {
+				return pathError("write", path, err)
+			}
+			if int(resp.(*SimpleWriteResponseDote).Count) != len(data) {
+				return pathError("write", path, io.ErrShortWrite)
+			}
+			return nil
+		}
+	}
+
+	// Like create(2) on Plan 9, an existing file is truncated rather than
+	// created anew.
+	f, err := c.walk(ctx, append(dir[:len(dir):len(dir)], name))
+	if err == nil {
+		err = f.OpenContext(ctx, OWRITE|OTRUNC)
+		if err != nil {
+			f.CloseContext(ctx)
+		}
+	} else {
+		f, err = c.walk(ctx, dir)
+		if err == nil {
+			err = f.CreateContext(ctx, name, perm, OWRITE)
+			if err != nil {
+				f.CloseContext(ctx)
+			}
+		}
+	}
+	if err != nil {
+		return pathError("write", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	if _, err := f.pipelineWrite(ctx, bytes.NewReader(data), 0); err != nil {
+		return pathError("write", path, err)
+	}
+	return nil
+}
+
+// Mkdir creates a directory at the path with the provided permissions.
+func (c *Client) Mkdir(path string, perm FileMode) error {
+	return c.MkdirContext(context.Background(), path, perm)
+}
+
+// MkdirContext is like Mkdir, but gives up once ctx is done. See RPCContext.
+func (c *Client) MkdirContext(ctx context.Context, path string, perm FileMode) error {
+	dir, name, err := splitParent("mkdir", path)
+	if err != nil {
+		return err
+	}
+	f, err := c.walk(ctx, dir)
+	if err != nil {
+		return pathError("mkdir", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	if err := f.CreateContext(ctx, name, DMDIR|perm&0777, OREAD); err != nil {
+		return pathError("mkdir", path, err)
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory at the path.
+func (c *Client) Remove(path string) error {
+	return c.RemoveContext(context.Background(), path)
+}
+
+// RemoveContext is like Remove, but gives up once ctx is done. See RPCContext.
+func (c *Client) RemoveContext(ctx context.Context, path string) error {
+	f, err := c.walk(ctx, SplitPath(path))
+	if err != nil {
+		return pathError("remove", path, err)
+	}
+	if err := f.RemoveContext(ctx); err != nil {
+		return pathError("remove", path, err)
+	}
+	return nil
+}
+
+// Rename renames the file at oldpath to newpath. As 9P renames files by
+// changing their name, both paths must be in the same directory.
+func (c *Client) Rename(oldpath, newpath string) error {
+	return c.RenameContext(context.Background(), oldpath, newpath)
+}
+
+// RenameContext is like Rename, but gives up once ctx is done. See RPCContext.
+func (c *Client) RenameContext(ctx context.Context, oldpath, newpath string) error {
+	olddir, _, err := splitParent("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	newdir, name, err := splitParent("rename", newpath)
+	if err != nil {
+		return err
+	}
+	if len(olddir) != len(newdir) {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: ErrCrossDirRename}
+	}
+	for i := range olddir {
+		if olddir[i] != newdir[i] {
+			return &fs.PathError{Op: "rename", Path: oldpath, Err: ErrCrossDirRename}
+		}
+	}
+
+	f, err := c.walk(ctx, SplitPath(oldpath))
+	if err != nil {
+		return pathError("rename", oldpath, err)
+	}
+	defer f.CloseContext(ctx)
+
+	s := NoChangeStat()
+	s.Name = name
+	if err := f.WriteStatContext(ctx, s); err != nil {
+		return pathError("rename", oldpath, err)
+	}
+	return nil
+}
+
+// Chmod changes the permission bits of the file at the path. Other mode bits,
+// such as DMDIR, are retained.
+func (c *Client) Chmod(path string, perm FileMode) error {
+	return c.ChmodContext(context.Background(), path, perm)
+}
+
+// ChmodContext is like Chmod, but gives up once ctx is done. See RPCContext.
+func (c *Client) ChmodContext(ctx context.Context, path string, perm FileMode) error {
+	f, err := c.walk(ctx, SplitPath(path))
+	if err != nil {
+		return pathError("chmod", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	cur, err := f.StatContext(ctx)
+	if err != nil {
+		return pathError("chmod", path, err)
+	}
+	s := NoChangeStat()
+	s.Mode = cur.Mode&^0777 | perm&0777
+	if err := f.WriteStatContext(ctx, s); err != nil {
+		return pathError("chmod", path, err)
+	}
+	return nil
+}
+
+// Stat returns the Stat struct of the file at the path. If the client has a
+// Cache, a cached Stat struct is returned if the walk shows that the file has
+// not changed since.
+func (c *Client) Stat(path string) (*Stat, error) {
+	return c.StatContext(context.Background(), path)
+}
+
+// StatContext is like Stat, but gives up once ctx is done. See RPCContext.
+func (c *Client) StatContext(ctx context.Context, path string) (*Stat, error) {
+	names := SplitPath(path)
+	f, err := c.walk(ctx, names)
+	if err != nil {
+		return nil, pathError("stat", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	if c.Cache != nil && len(names) > 0 {
+		if s, ok := c.Cache.stat(f.cacheTree(), f.qid); ok {
+			return s, nil
+		}
+	}
+
+	s, err := f.StatContext(ctx)
+	if err != nil {
+		return nil, pathError("stat", path, err)
+	}
+	if c.Cache != nil {
+		c.Cache.putStat(f.cacheTree(), s)
+	}
+	return s, nil
+}
+
+// ReadDir returns the entries of the directory at the path, in the order
+// returned by the server.
+func (c *Client) ReadDir(path string) ([]Stat, error) {
+	return c.ReadDirContext(context.Background(), path)
+}
+
+// ReadDirContext is like ReadDir, but gives up once ctx is done. See
+// RPCContext.
+func (c *Client) ReadDirContext(ctx context.Context, path string) ([]Stat, error) {
+	f, err := c.walk(ctx, SplitPath(path))
+	if err != nil {
+		return nil, pathError("readdir", path, err)
+	}
+	defer f.CloseContext(ctx)
+
+	if err := f.OpenContext(ctx, OREAD); err != nil {
+		return nil, pathError("readdir", path, err)
+	}
+	stats, err := f.ReadDirContext(ctx)
+	if err != nil {
+		return nil, pathError("readdir", path, err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,113 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestClientPath(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu, VersionDote} {
+		rfs := newRamFS()
+		c, _ := rfs.attach(t, version)
+
+		if err := c.Mkdir("dir", 0750); err != nil {
+			t.Fatalf("%s: mkdir failed: %v", version, err)
+		}
+		if s, err := c.Stat("dir"); err != nil || s.Mode != DMDIR|0750 {
+			t.Errorf("%s: stat returned %+v, %v", version, s, err)
+		}
+
+		if err := c.WriteFile("dir/file", []byte("hello"), 0640); err != nil {
+			t.Fatalf("%s: write failed: %v", version, err)
+		}
+		if err := c.WriteFile("dir/file", []byte("bye"), 0640); err != nil {
+			t.Fatalf("%s: overwrite failed: %v", version, err)
+		}
+		if b, err := c.ReadFile("dir/file"); err != nil || string(b) != "bye" {
+			t.Errorf("%s: read returned %q, %v", version, b, err)
+		}
+
+		if err := c.Chmod("dir", 0700); err != nil {
+			t.Errorf("%s: chmod failed: %v", version, err)
+		}
+		if n := rfs.lookup("dir"); n.mode != DMDIR|0700 {
+			t.Errorf("%s: expected mode %v, got %v", version, DMDIR|0700, n.mode)
+		}
+
+		if err := c.Rename("dir/file", "dir/renamed"); err != nil {
+			t.Errorf("%s: rename failed: %v", version, err)
+		}
+		if err := c.Rename("dir/renamed", "elsewhere"); !errors.Is(err, ErrCrossDirRename) {
+			t.Errorf("%s: expected ErrCrossDirRename, got %v", version, err)
+		}
+
+		stats, err := c.ReadDir("dir")
+		if err != nil || len(stats) != 1 || stats[0].Name != "renamed" || stats[0].Length != 3 {
+			t.Errorf("%s: readdir returned %+v, %v", version, stats, err)
+		}
+
+		if err := c.Remove("dir/renamed"); err != nil {
+			t.Errorf("%s: remove failed: %v", version, err)
+		}
+		if _, err := c.ReadFile("dir/renamed"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist, got %v", version, err)
+		}
+
+		if fids := c.fids.InUse(); len(fids) != 1 {
+			t.Errorf("%s: fids leaked: %v", version, fids)
+		}
+	}
+}
+
+func TestClientPathDote(t *testing.T) {
+	rfs := newRamFS()
+	rfs.msize = 1024
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 1000)
+	rfs.add("small", 0644, small)
+	rfs.add("large", 0644, large)
+	c, _ := rfs.attach(t, VersionDote)
+
+	if b, err := c.ReadFile("small"); err != nil || !bytes.Equal(b, small) {
+		t.Errorf("read of small file returned %q, %v", b, err)
+	}
+	if n := rfs.count(Tread); n != 0 {
+		t.Errorf("expected no Tread for small file, got %d", n)
+	}
+
+	// The large file does not fit in a Tsread, so the remainder must be
+	// read regularly.
+	if b, err := c.ReadFile("large"); err != nil || !bytes.Equal(b, large) {
+		t.Errorf("read of large file returned %d bytes, %v", len(b), err)
+	}
+	if n := rfs.count(Tsread); n != 2 {
+		t.Errorf("expected 2 Tsread, got %d", n)
+	}
+
+	if err := c.WriteFile("new", small, 0644); err != nil {
+		t.Errorf("write of small file failed: %v", err)
+	}
+	if err := c.WriteFile("large", small, 0644); err != nil {
+		t.Errorf("write of small file failed: %v", err)
+	}
+	if err := c.WriteFile("small", large, 0644); err != nil {
+		t.Errorf("write of large file failed: %v", err)
+	}
+	if n := rfs.count(Tswrite); n != 2 {
+		t.Errorf("expected 2 Tswrite, got %d", n)
+	}
+	for path, expected := range map[string][]byte{"new": small, "large": small, "small": large} {
+		if n := rfs.lookup(path); !bytes.Equal(n.data, expected) {
+			t.Errorf("%s: expected %d bytes, got %d", path, len(expected), len(n.data))
+		}
+	}
+}
+
+func TestClientNotAttached(t *testing.T) {
+	c := newRamFS().client(t, Version)
+	if _, err := c.ReadFile("file"); !errors.Is(err, ErrNotAttached) {
+		t.Errorf("expected ErrNotAttached, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package qp
+
+import (
+	"context"
+	"io"
+)
+
+// DefaultWalkWindow is the amount of directories read concurrently by
+// WalkDirConcurrent if Client.WalkWindow is not set.
+const DefaultWalkWindow = 8
+
+// walkWindow returns the configured window of WalkDirConcurrent.
+func (c *Client) walkWindow() int {
+	if c.WalkWindow <= 0 {
+		return DefaultWalkWindow
+	}
+	return c.WalkWindow
+}
+
+// SetWindow sets the maximum amount of read or write requests kept in
+// flight by WriteTo and ReadFrom. Files are not pipelined unless a window
+// is set, and a window of 1 disables pipelining again. See WriteTo for files
+// that must not be pipelined.
+func (f *File) SetWindow(n int) {
+	f.mu.Lock()
+	f.window = n
+	f.mu.Unlock()
+}
+
+// transferWindow returns the window of pipelined transfers. The mu of the
+// file must be held.
+func (f *File) transferWindow() int {
+	return max(f.window, 1)
+}
+
+// transfer is the result of a read or write request issued by a pipelined
+// transfer.
+type transfer struct {
+	buf []byte
+	off int64
+	n   int
+	err error
+}
+
+// pipeline keeps track of the requests in flight for a pipelined transfer,
+// in the order they were issued.
+type pipeline struct {
+	size  int
+	queue []chan transfer
+	free  [][]byte
+}
+
+func (p *pipeline) buffer() []byte {
+	if n := len(p.free); n > 0 {
+		b := p.free[n-1]
+		p.free = p.free[:n-1]
+		return b[:cap(b)]
+	}
+	return make([]byte, p.size)
+}
+
+// issue runs fn in the background, queueing its result.
+func (p *pipeline) issue(ctx context.Context, buf []byte, off int64, fn func(context.Context, []byte, int64) (int, error)) {
+	ch := make(chan transfer, 1)
+	go func() {
+		n, err := fn(ctx, buf, off)
+		ch <- transfer{buf: buf, off: off, n: n, err: err}
+	}()
+	p.queue = append(p.queue, ch)
+}
+
+// next waits for the oldest request in flight.
+func (p *pipeline) next() transfer {
+	t := <-p.queue[0]
+	p.queue = p.queue[1:]
+	return t
+}
+
+// drain waits for all requests in flight, discarding their results.
+func (p *pipeline) drain() {
+	for len(p.queue) > 0 {
+		p.release(p.next().buf)
+	}
+}
+
+func (p *pipeline) release(b []byte) {
+	p.free = append(p.free, b)
+}
+
+// WriteTo writes the content of the file from the current offset until end
+// of file to w, keeping up to the window set with SetWindow of read
+// requests in flight at consecutive offsets. A short read ends the current
+// window, after which reading resumes where the short read ended,
+// discarding the data of the requests in flight. Files that ignore the
+// offset, such as devices and event files, have consumed that data, so a
+// window must only be set for files that honor offsets. Directories and
+// append-only files are read sequentially. WriteTo implements io.WriterTo,
+// and is used by io.Copy.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	return f.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo, but flushes the requests in flight and
+// returns the error of ctx once ctx is done. See Client.RPCContext.
+func (f *File) WriteToContext(ctx context.Context, w io.Writer) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.pipelineRead(ctx, w, f.offset)
+	f.offset += n
+	return n, err
+}
+
+func (f *File) pipelineRead(ctx context.Context, w io.Writer, off int64) (int64, error) {
+	unit := int64(f.readUnit())
+	p := &pipeline{size: int(unit)}
+	defer p.drain()
+
+	window := f.transferWindow()
+	if f.qid.Type&(QTDIR|QTAPPEND) != 0 {
+		window = 1
+	}
+
+	var written int64
+	next := off
+	for {
+		for len(p.queue) < window {
+			p.issue(ctx, p.buffer(), next, f.read)
+			next += unit
+		}
+
+		t := p.next()
+		if t.err != nil {
+			p.release(t.buf)
+			return written, t.err
+		}
+		if t.n == 0 {
+			p.release(t.buf)
+			return written, nil
+		}
+
+		m, err := w.Write(t.buf[:t.n])
+		written += int64(m)
+		p.release(t.buf)
+		if err != nil {
+			return written, err
+		}
+		if m < t.n {
+			return written, io.ErrShortWrite
+		}
+
+		// The requests in flight were issued past the end of the short
+		// read, and must be discarded to not leave a gap.
+		if int64(t.n) < unit {
+			p.drain()
+			next = off + written
+		}
+	}
+}
+
+// ReadFrom writes the content of r to the file at the current offset until
+// r returns io.EOF, keeping up to the window set with SetWindow of write
+// requests in flight at consecutive offsets. A short write is completed
+// before later data is considered written. Append-only files are written
+// sequentially. ReadFrom implements io.ReaderFrom, and is used by io.Copy.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	return f.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but flushes the requests in flight and
+// returns the error of ctx once ctx is done. See Client.RPCContext.
+func (f *File) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.pipelineWrite(ctx, r, f.offset)
+	f.offset += n
+	return n, err
+}
+
+func (f *File) pipelineWrite(ctx context.Context, r io.Reader, off int64) (int64, error) {
+	p := &pipeline{size: int(f.writeUnit())}
+	defer p.drain()
+
+	window := f.transferWindow()
+	if f.qid.Type&QTAPPEND != 0 {
+		window = 1
+	}
+
+	var (
+		written, next int64
+		eof           bool
+		readErr       error
+	)
+	for {
+		for !eof && len(p.queue) < window {
+			buf := p.buffer()
+			m, err := io.ReadFull(r, buf)
+			if m > 0 {
+				p.issue(ctx, buf[:m], off+next, f.write)
+				next += int64(m)
+			} else {
+				p.release(buf)
+			}
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				eof = true
+			default:
+				eof = true
+				readErr = err
+			}
+		}
+		if len(p.queue) == 0 {
+			return written, readErr
+		}
+
+		t := p.next()
+		if t.err == nil && t.n < len(t.buf) {
+			// Later requests may already have succeeded, so only the
+			// remainder of this one needs to be written again.
+			var m int
+			m, t.err = f.WriteAtContext(ctx, t.buf[t.n:], t.off+int64(t.n))
+			t.n += m
+		}
+		written += int64(t.n)
+		p.release(t.buf)
+		if t.err != nil {
+			return written, t.err
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package qp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFileWriteTo(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		window int
+		short  func(uint64, uint32) uint32
+	}{
+		{1, nil},
+		{4, nil},
+		{8, nil},
+		{4, func(off uint64, count uint32) uint32 {
+			if off == 3000 {
+				return 10
+			}
+			return count
+		}},
+		{4, func(off uint64, count uint32) uint32 { return count / 3 }},
+	}
+
+	for i, tt := range tests {
+		rfs := newRamFS()
+		rfs.iounit = 256
+		rfs.add("file", 0644, data)
+		rfs.short = tt.short
+		c, root := rfs.attach(t, Version)
+
+		f, err := root.Walk("file")
+		if err != nil {
+			t.Fatalf("test %d: walk failed: %v", i, err)
+		}
+		if err := f.Open(OREAD); err != nil {
+			t.Fatalf("test %d: open failed: %v", i, err)
+		}
+		f.SetWindow(tt.window)
+		f.Seek(100, io.SeekStart)
+
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, f)
+		if err != nil || n != int64(len(data)-100) {
+			t.Errorf("test %d: copy returned %d, %v", i, n, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[100:]) {
+			t.Errorf("test %d: data mismatch", i)
+		}
+		if pos, _ := f.Seek(0, io.SeekCurrent); pos != int64(len(data)) {
+			t.Errorf("test %d: expected offset %d, got %d", i, len(data), pos)
+		}
+		if tags := c.tags.InUse(); len(tags) != 0 {
+			t.Errorf("test %d: tags leaked: %v", i, tags)
+		}
+	}
+}
+
+func TestFileWriteToStream(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	rfs := newRamFS()
+	rfs.iounit = 256
+	rfs.add("events", 0444, data).stream = true
+
+	// Every read returns short, which would discard the data of reads in
+	// flight, so files are not pipelined by default, regardless of the
+	// window of concurrent walks.
+	rfs.short = func(off uint64, count uint32) uint32 { return count / 2 }
+	c, root := rfs.attach(t, Version)
+	c.WalkWindow = 8
+	f, err := root.Walk("events")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if err := f.Open(OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if n, err := io.Copy(&buf, f); err != nil || n != int64(len(data)) {
+		t.Errorf("copy returned %d, %v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("data mismatch")
+	}
+	if tags := c.tags.InUse(); len(tags) != 0 {
+		t.Errorf("tags leaked: %v", tags)
+	}
+}
+
+func TestFileReadFrom(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+
+	tests := []struct {
+		window int
+		short  func(uint64, uint32) uint32
+		writes int
+	}{
+		{1, nil, 40},
+		{8, nil, 40},
+		{4, func(off uint64, count uint32) uint32 {
+			if off == 2560 {
+				return 100
+			}
+			return count
+		}, 41},
+	}
+
+	for i, tt := range tests {
+		rfs := newRamFS()
+		rfs.iounit = 256
+		rfs.short = tt.short
+		c, root := rfs.attach(t, Version)
+
+		f, err := root.Walk()
+		if err != nil {
+			t.Fatalf("test %d: clone failed: %v", i, err)
+		}
+		if err := f.Create("file", 0644, OWRITE); err != nil {
+			t.Fatalf("test %d: create failed: %v", i, err)
+		}
+		f.SetWindow(tt.window)
+
+		// Hide the bytes.Reader WriterTo implementation, so that io.Copy
+		// uses File.ReadFrom.
+		n, err := io.Copy(f, struct{ io.Reader }{bytes.NewReader(data)})
+		if err != nil || n != int64(len(data)) {
+			t.Errorf("test %d: copy returned %d, %v", i, n, err)
+		}
+		if node := rfs.lookup("file"); !bytes.Equal(node.data, data) {
+			t.Errorf("test %d: data mismatch", i)
+		}
+		if w := rfs.count(Twrite); w != tt.writes {
+			t.Errorf("test %d: expected %d writes, got %d", i, tt.writes, w)
+		}
+		if tags := c.tags.InUse(); len(tags) != 0 {
+			t.Errorf("test %d: tags leaked: %v", i, tags)
+		}
+	}
+}
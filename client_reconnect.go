@@ -0,0 +1,204 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// ErrSessionLost indicates that a session could not be restored after
+// reconnecting.
+var ErrSessionLost = errors.New("session lost")
+
+// attachInfo records the parameters of an attach for restoring it.
+type attachInfo struct {
+	afid    Fid
+	user    string
+	service string
+}
+
+// SetSessionKey sets the 9P2000.e session key used to resume the session
+// after reconnecting. The key must have been agreed upon with the server
+// through other means, such as an authentication protocol, or be a fresh
+// random key set before Negotiate for servers that bind sessions to keys
+// chosen by the client.
+func (c *Client) SetSessionKey(key [8]byte) {
+	c.mu.Lock()
+	c.key = &key
+	c.mu.Unlock()
+}
+
+// RetryIdempotent is a Retry policy that retries requests that have no side
+// effects, which are reads and stats.
+func RetryIdempotent(m Message) bool {
+	switch m.(type) {
+	case *ReadRequest, *StatRequest, *SimpleReadRequestDote:
+		return true
+	default:
+		return false
+	}
+}
+
+// connLost handles the failure of a connection, reconnecting if Redial is
+// set.
+func (c *Client) connLost(conn io.ReadWriteCloser, cause error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	if c.closed || c.Redial == nil {
+		c.failLocked(cause)
+		c.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	c.ready = ready
+	calls := c.pending
+	c.pending = make(map[Tag]*call)
+	c.mu.Unlock()
+
+	conn.Close()
+	err := c.reconnect(calls)
+
+	c.mu.Lock()
+	if err != nil {
+		c.failLocked(err)
+	}
+	if c.ready == ready {
+		c.ready = nil
+	}
+	c.mu.Unlock()
+	close(ready)
+
+	if err != nil {
+		for _, cl := range calls {
+			cl.finish(nil, err)
+		}
+	}
+}
+
+// reconnect establishes a new connection and restores the session, after
+// which the calls in flight on the old connection are retried or failed.
+func (c *Client) reconnect(calls map[Tag]*call) error {
+	conn, err := c.Redial()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	key := c.key
+	c.mu.Unlock()
+
+	enc := &Encoder{Protocol: NineP2000, Writer: conn}
+	dec := &Decoder{Protocol: NineP2000, Reader: conn}
+	resp, resumed, err := handshake(enc, dec, c.msize, c.version, key)
+	if err == nil && (resp.Version != c.version || resp.MessageSize != c.msize) {
+		err = ErrSessionLost
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClientClosed
+	}
+	c.conn, c.enc, c.dec = conn, enc, dec
+	c.mu.Unlock()
+	go c.readLoop(conn, dec)
+
+	if !resumed {
+		c.restoreAll()
+	}
+
+	for tag, cl := range calls {
+		if !cl.unsent.Load() && (c.Retry == nil || !c.Retry(cl.req)) {
+			cl.finish(nil, ErrConnectionLost)
+			continue
+		}
+		c.mu.Lock()
+		c.pending[tag] = cl
+		c.mu.Unlock()
+		if err := enc.WriteMessage(cl.req); err != nil {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// restoreAll restores the fids of all files on a new connection. Attach
+// roots are restored first, as all other files are walked from them.
+func (c *Client) restoreAll() {
+	c.mu.Lock()
+	files := make([]*File, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if (files[i].attach != nil) != (files[j].attach != nil) {
+			return files[i].attach != nil
+		}
+		return files[i].fid < files[j].fid
+	})
+	c.mu.Unlock()
+
+	// Files that cannot be restored are left in place, and fail with the
+	// error of the server when used.
+	for _, f := range files {
+		c.restore(f)
+	}
+}
+
+// restore restores the fid of a file by attaching or walking, and opening it
+// again if it was open. Files are never truncated when reopened.
+func (c *Client) restore(f *File) error {
+	c.mu.Lock()
+	attach, root, names := f.attach, f.root, f.names
+	opened, mode := f.opened, f.mode
+	c.mu.Unlock()
+
+	switch {
+	case attach != nil:
+		if attach.afid != NOFID {
+			return ErrSessionLost
+		}
+		if _, err := c.rpc(context.Background(), c.attachRequest(f.fid, NOFID, attach.user, attach.service), true); err != nil {
+			return err
+		}
+	case root != nil:
+		wp := &WalkPlan{Fid: root.fid, NewFid: f.fid, Names: names}
+		var resps []*WalkResponse
+		for _, req := range wp.Requests() {
+			resp, err := c.rpc(context.Background(), req, true)
+			if err != nil {
+				break
+			}
+			wr := resp.(*WalkResponse)
+			resps = append(resps, wr)
+			if !WalkComplete(req, wr) {
+				break
+			}
+		}
+		if _, complete := wp.Result(resps); !complete {
+			if wp.Established(resps) {
+				c.rpc(context.Background(), &ClunkRequest{Fid: f.fid}, true)
+			}
+			return fs.ErrNotExist
+		}
+	default:
+		return ErrSessionLost
+	}
+
+	if opened {
+		if _, err := c.rpc(context.Background(), &OpenRequest{Fid: f.fid, Mode: mode &^ OTRUNC}, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package qp
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// dropConn closes the current connection of the client, and waits for the
+// client to reconnect or fail.
+func dropConn(t *testing.T, c *Client) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	conn.Close()
+
+	for i := 0; i < 1000; i++ {
+		c.mu.Lock()
+		done := (c.conn != conn && c.ready == nil) || c.err != nil
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("client did not reconnect")
+}
+
+func TestClientReconnectResume(t *testing.T) {
+	key := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	rfs := newRamFS()
+	rfs.key = &key
+	rfs.add("file", 0644, []byte("content"))
+
+	conn, _ := rfs.dial()
+	c := NewClient(conn)
+	c.Redial = rfs.dial
+	c.SetSessionKey(key)
+	if err := c.Negotiate(8192, VersionDote); err != nil {
+		t.Fatalf("negotiate failed: %v", err)
+	}
+	defer c.Close()
+
+	root, err := c.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	f, err := root.Walk("file")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if err := f.Open(OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	dropConn(t, c)
+
+	buf := make([]byte, 7)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "content" {
+		t.Errorf("read after resume returned %q, %v", buf, err)
+	}
+	// The key is presented both at negotiation and when resuming.
+	if n := rfs.count(Tsession); n != 2 {
+		t.Errorf("expected 2 Tsession, got %d", n)
+	}
+	if n := rfs.count(Tattach); n != 1 {
+		t.Errorf("expected 1 Tattach, got %d", n)
+	}
+}
+
+func TestClientReconnectRestore(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu, VersionDote} {
+		rfs := newRamFS()
+		rfs.add("dir/file", 0644, []byte("content"))
+		c, root := rfs.attach(t, version)
+		c.Redial = rfs.dial
+
+		// A resume attempt with an unknown key must fall back to restoring
+		// the fids.
+		c.SetSessionKey([8]byte{9})
+
+		f, err := root.Walk("dir", "file")
+		if err != nil {
+			t.Fatalf("%s: walk failed: %v", version, err)
+		}
+		if err := f.Open(OREAD); err != nil {
+			t.Fatalf("%s: open failed: %v", version, err)
+		}
+
+		d, err := root.Walk("dir")
+		if err != nil {
+			t.Fatalf("%s: walk failed: %v", version, err)
+		}
+		if err := d.Create("new", 0644, ORDWR|OTRUNC); err != nil {
+			t.Fatalf("%s: create failed: %v", version, err)
+		}
+		if _, err := d.Write([]byte("written")); err != nil {
+			t.Fatalf("%s: write failed: %v", version, err)
+		}
+
+		dropConn(t, c)
+
+		buf := make([]byte, 7)
+		if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "content" {
+			t.Errorf("%s: read after restore returned %q, %v", version, buf, err)
+		}
+		if _, err := d.ReadAt(buf, 0); err != nil || string(buf) != "written" {
+			t.Errorf("%s: read of created file after restore returned %q, %v", version, buf, err)
+		}
+		if n := rfs.count(Tattach); n != 2 {
+			t.Errorf("%s: expected 2 Tattach, got %d", version, n)
+		}
+
+		// The path based API uses the restored root.
+		if b, err := c.ReadFile("dir/new"); err != nil || string(b) != "written" {
+			t.Errorf("%s: ReadFile after restore returned %q, %v", version, b, err)
+		}
+	}
+}
+
+func TestClientReconnectInFlight(t *testing.T) {
+	tests := []struct {
+		retry    func(Message) bool
+		op       func(f *File) error
+		expected error
+	}{
+		{RetryIdempotent, func(f *File) error { _, err := f.Stat(); return err }, nil},
+		{nil, func(f *File) error { _, err := f.Stat(); return err }, ErrConnectionLost},
+		{RetryIdempotent, func(f *File) error { _, err := f.WriteAt([]byte("x"), 0); return err }, ErrConnectionLost},
+	}
+
+	for i, tt := range tests {
+		rfs := newRamFS()
+		rfs.add("file", 0644, nil)
+		c, root := rfs.attach(t, Version)
+		c.Redial = rfs.dial
+		c.Retry = tt.retry
+
+		f, err := root.Walk("file")
+		if err != nil {
+			t.Fatalf("test %d: walk failed: %v", i, err)
+		}
+		if err := f.Open(ORDWR); err != nil {
+			t.Fatalf("test %d: open failed: %v", i, err)
+		}
+
+		held := make(chan struct{})
+		release := make(chan struct{})
+		rfs.mu.Lock()
+		rfs.hold = func(m Message) {
+			switch m.(type) {
+			case *StatRequest, *WriteRequest:
+			default:
+				return
+			}
+			select {
+			case held <- struct{}{}:
+				<-release
+			default:
+			}
+		}
+		rfs.mu.Unlock()
+
+		errc := make(chan error, 1)
+		go func() { errc <- tt.op(f) }()
+		<-held
+		dropConn(t, c)
+		close(release)
+
+		if err := <-errc; err != tt.expected {
+			t.Errorf("test %d: expected %v, got %v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestClientConnectionFailure(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("file", 0644, nil)
+	c, root := rfs.attach(t, Version)
+
+	dropConn(t, c)
+	if err := c.Err(); err == nil {
+		t.Error("expected client to fail")
+	}
+	if _, err := root.Walk("file"); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("expected client error, got %v", err)
+	}
+}
+
+func TestClientReconnectCreateRoot(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("dir/file", 0644, []byte("content"))
+	c, root := rfs.attach(t, Version)
+	c.Redial = rfs.dial
+
+	d, err := root.Walk("dir")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	// The handle returned by Attach becomes the created file.
+	if err := root.Create("new", 0644, ORDWR); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := root.Write([]byte("written")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	dropConn(t, c)
+
+	buf := make([]byte, 7)
+	if _, err := root.ReadAt(buf, 0); err != nil || string(buf) != "written" {
+		t.Errorf("read of created file after restore returned %q, %v", buf, err)
+	}
+	if _, err := d.Walk("file"); err != nil {
+		t.Errorf("walk from directory after restore failed: %v", err)
+	}
+	if b, err := c.ReadFile("dir/file"); err != nil || string(b) != "content" {
+		t.Errorf("ReadFile after restore returned %q, %v", b, err)
+	}
+}
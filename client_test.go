@@ -0,0 +1,219 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClientNegotiate(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{Version, Version},
+		{VersionDotu, VersionDotu},
+		{VersionDote, VersionDote},
+		{"9P2000.L", Version},
+	}
+
+	for i, tt := range tests {
+		c := newRamFS().client(t, tt.version)
+		if c.Version() != tt.expected {
+			t.Errorf("test %d: expected version %s, got %s", i, tt.expected, c.Version())
+		}
+		if c.MessageSize() != 8192 {
+			t.Errorf("test %d: expected message size 8192, got %d", i, c.MessageSize())
+		}
+	}
+}
+
+func TestClientFileReadWrite(t *testing.T) {
+	rfs := newRamFS()
+	rfs.iounit = 100
+	c, root := rfs.attach(t, Version)
+
+	f, err := root.Walk()
+	if err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+	if err := f.Create("file", 0644, ORDWR); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	if n, err := f.Write(data); err != nil || n != len(data) {
+		t.Fatalf("write returned %d, %v", n, err)
+	}
+	if n := rfs.count(Twrite); n != 10 {
+		t.Errorf("expected write to be split into 10 requests, got %d", n)
+	}
+
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != int64(len(data)) {
+		t.Errorf("expected offset %d, got %d, %v", len(data), pos, err)
+	}
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data)-10) {
+		t.Errorf("expected offset %d, got %d, %v", len(data)-10, pos, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err != ErrInvalidOffset {
+		t.Errorf("expected ErrInvalidOffset, got %v", err)
+	}
+
+	buf := make([]byte, 250)
+	if n, err := f.ReadAt(buf, 500); err != nil || !bytes.Equal(buf[:n], data[500:750]) {
+		t.Errorf("ReadAt returned %d, %v", n, err)
+	}
+	if n, err := f.ReadAt(buf, 900); err != io.EOF || !bytes.Equal(buf[:n], data[900:]) {
+		t.Errorf("ReadAt at end of file returned %d, %v", n, err)
+	}
+
+	f.Seek(0, io.SeekStart)
+	b, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("ReadAll returned %d bytes, %v", len(b), err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+	if err := f.Close(); err != fs.ErrClosed {
+		t.Errorf("expected fs.ErrClosed, got %v", err)
+	}
+	if fids := c.fids.InUse(); len(fids) != 1 || fids[0] != root.Fid() {
+		t.Errorf("expected only the root fid in use, got %v", fids)
+	}
+}
+
+func TestClientFileClosed(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("a", 0644, []byte("a"))
+	rfs.add("b", 0644, []byte("b"))
+	_, root := rfs.attach(t, Version)
+
+	f, err := root.Walk("a")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if err := f.Open(ORDWR); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	f.Close()
+
+	// The fid of the closed file is handed to the next file, which the
+	// closed handle must not reach.
+	g, err := root.Walk("b")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if g.Fid() != f.Fid() {
+		t.Fatalf("expected fid %d to be reused, got %d", f.Fid(), g.Fid())
+	}
+	if err := g.Open(ORDWR); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	s := NoChangeStat()
+	s.Name = "c"
+	ops := map[string]func() error{
+		"Read":      func() error { _, err := f.Read(make([]byte, 1)); return err },
+		"ReadAt":    func() error { _, err := f.ReadAt(make([]byte, 1), 0); return err },
+		"Write":     func() error { _, err := f.Write([]byte("x")); return err },
+		"WriteAt":   func() error { _, err := f.WriteAt([]byte("x"), 0); return err },
+		"Seek":      func() error { _, err := f.Seek(0, io.SeekStart); return err },
+		"Stat":      func() error { _, err := f.Stat(); return err },
+		"WriteStat": func() error { return f.WriteStat(s) },
+		"Walk":      func() error { _, err := f.Walk(); return err },
+		"Open":      func() error { return f.Open(OREAD) },
+		"Create":    func() error { return f.Create("c", 0644, OREAD) },
+		"Remove":    func() error { return f.Remove() },
+		"ReadDir":   func() error { _, err := f.ReadDir(); return err },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, fs.ErrClosed) {
+			t.Errorf("%s: expected fs.ErrClosed, got %v", name, err)
+		}
+	}
+
+	b := make([]byte, 10)
+	if n, err := g.ReadAt(b, 0); string(b[:n]) != "b" || err != io.EOF {
+		t.Errorf("file reached through closed handle: %q, %v", b[:n], err)
+	}
+	if st, err := g.Stat(); err != nil || st.Name != "b" {
+		t.Errorf("file renamed through closed handle: %v, %v", st, err)
+	}
+}
+
+func TestClientWalk(t *testing.T) {
+	rfs := newRamFS()
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, "d"+strconv.Itoa(i))
+	}
+	node := rfs.add(strings.Join(names, "/")+"/file", 0644, []byte("deep"))
+	c, root := rfs.attach(t, Version)
+
+	f, err := root.Walk(append(names, "file")...)
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if f.Qid() != node.qid {
+		t.Errorf("expected qid %v, got %v", node.qid, f.Qid())
+	}
+	if n := rfs.count(Twalk); n != 2 {
+		t.Errorf("expected 2 walk requests, got %d", n)
+	}
+	if err := f.Open(OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "deep" {
+		t.Errorf("read returned %q, %v", b, err)
+	}
+	f.Close()
+
+	// Walks failing in the first and in a later request must both report
+	// fs.ErrNotExist without leaking fids.
+	for _, bad := range [][]string{{"nope"}, append(names[:18:18], "nope")} {
+		if _, err := root.Walk(bad...); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("walk to %v: expected fs.ErrNotExist, got %v", bad, err)
+		}
+	}
+	if fids := c.fids.InUse(); len(fids) != 1 {
+		t.Errorf("expected only the root fid in use, got %v", fids)
+	}
+}
+
+func TestClientRemoteError(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu} {
+		rfs := newRamFS()
+		rfs.add("file", 0644, []byte("data"))
+		_, root := rfs.attach(t, version)
+
+		f, err := root.Walk("file")
+		if err != nil {
+			t.Fatalf("%s: walk failed: %v", version, err)
+		}
+		if err := f.Open(OREAD); err != nil {
+			t.Fatalf("%s: open failed: %v", version, err)
+		}
+
+		var re *RemoteError
+		if _, err := f.Write([]byte("x")); !errors.As(err, &re) || re.Message != "file not open for writing" {
+			t.Errorf("%s: expected remote error, got %v", version, err)
+		}
+
+		s, err := f.Stat()
+		if err != nil || s.Name != "file" || s.Length != 4 {
+			t.Errorf("%s: stat returned %+v, %v", version, s, err)
+		}
+		if err := f.Remove(); err != nil {
+			t.Errorf("%s: remove failed: %v", version, err)
+		}
+		if rfs.lookup("file") != nil {
+			t.Errorf("%s: file not removed", version)
+		}
+	}
+}
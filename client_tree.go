@@ -0,0 +1,343 @@
+package qp
+
+import (
+	"io/fs"
+	"path"
+	"sync"
+)
+
+// dirKey identifies a directory on the server. Directories are told apart by
+// the path of their qid, qualified by the type and device of the server that
+// provides them, as bound trees may contain directories of several servers.
+type dirKey struct {
+	typ  uint16
+	dev  uint32
+	path uint64
+}
+
+func keyOf(s *Stat) dirKey {
+	return dirKey{typ: s.Type, dev: s.Dev, path: s.Qid.Path}
+}
+
+// isDir reports whether the entry is a directory, as indicated by its qid.
+func isDir(s *Stat) bool {
+	return s.Qid.Type&QTDIR != 0
+}
+
+// readDirFile reads the entries of a directory without affecting the fid of
+// dir, which can then still be walked from.
+func readDirFile(dir *File) ([]Stat, error) {
+	f, err := dir.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Open(OREAD); err != nil {
+		return nil, err
+	}
+	return f.ReadDir()
+}
+
+// walkRoot stats the root of a walk, reporting failures to fn as
+// fs.WalkDir does. It returns a nil Stat if the walk is done.
+func (c *Client) walkRoot(root string, fn fs.WalkDirFunc) (*Stat, error) {
+	s, err := c.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+		if err == fs.SkipDir || err == fs.SkipAll {
+			err = nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// WalkDir walks the tree at the path, calling fn for each file and
+// directory, including the root, with the semantics of fs.WalkDir. Entries
+// are visited in the order returned by the server rather than in lexical
+// order. Directories are recognized by the type of their qid, and the
+// entries are taken from the directory listings, so that no file is
+// stat'ed other than the root. Directories that have been visited before, as
+// happens with bind loops, are passed to fn but not descended into again.
+func (c *Client) WalkDir(root string, fn fs.WalkDirFunc) error {
+	s, err := c.walkRoot(root, fn)
+	if s == nil {
+		return err
+	}
+	parent, err := c.attached()
+	if err != nil {
+		return err
+	}
+
+	w := &treeWalk{fn: fn, visited: make(map[dirKey]bool)}
+	err = w.walk(parent, SplitPath(root), root, s)
+	if err == fs.SkipDir || err == fs.SkipAll {
+		err = nil
+	}
+	return err
+}
+
+// treeWalk is the state of a sequential walk.
+type treeWalk struct {
+	fn      fs.WalkDirFunc
+	visited map[dirKey]bool
+}
+
+// walk visits the entry reached by walking names from parent, descending
+// into it if it is a directory.
+func (w *treeWalk) walk(parent *File, names []string, name string, s *Stat) error {
+	d := fs.FileInfoToDirEntry(newFileInfo(s, name))
+	if err := w.fn(name, d, nil); err != nil || !isDir(s) {
+		return err
+	}
+	if w.visited[keyOf(s)] {
+		return nil
+	}
+	w.visited[keyOf(s)] = true
+
+	dir, err := parent.Walk(names...)
+	if err != nil {
+		return w.fail(name, d, err)
+	}
+	defer dir.Close()
+	stats, err := readDirFile(dir)
+	if err != nil {
+		return w.fail(name, d, err)
+	}
+
+	for i := range stats {
+		s := &stats[i]
+		err := w.walk(dir, []string{s.Name}, path.Join(name, s.Name), s)
+		if err == fs.SkipDir {
+			if isDir(s) {
+				continue
+			}
+			// Skipping a file skips the remaining entries of the directory.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail reports an error reading a directory to fn.
+func (w *treeWalk) fail(name string, d fs.DirEntry, err error) error {
+	err = w.fn(name, d, pathError("readdir", name, err))
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// WalkDirConcurrent is like WalkDir, but reads up to Client.WalkWindow
+// directories concurrently, keeping several walk and read requests in
+// flight. Calls to fn are serialized, but entries are visited in no
+// particular order, other than each directory being visited before its
+// entries. Returning fs.SkipDir for a directory skips it, while fs.SkipDir
+// for a file has no effect. Once fn returns fs.SkipAll or any other error,
+// no further entries are visited.
+func (c *Client) WalkDirConcurrent(root string, fn fs.WalkDirFunc) error {
+	s, err := c.walkRoot(root, fn)
+	if s == nil {
+		return err
+	}
+	parent, err := c.attached()
+	if err != nil {
+		return err
+	}
+
+	w := &concurrentWalk{fn: fn, visited: make(map[dirKey]bool)}
+	w.cond = sync.NewCond(&w.mu)
+	if !w.visit(root, s) {
+		return w.result()
+	}
+	w.root, err = parent.Walk(SplitPath(root)...)
+	if err != nil {
+		w.fail(root, s, err)
+		return w.result()
+	}
+	defer w.root.Close()
+	w.queue = append(w.queue, dirJob{name: root, stat: s})
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.walkWindow(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	return w.result()
+}
+
+// dirJob is a directory waiting to be read by a concurrent walk. Queued
+// directories are only walked to once they are read, so that the size of the
+// queue does not bound the amount of fids held.
+type dirJob struct {
+	// names leads from the root of the walk to the directory.
+	names []string
+	name  string
+	stat  *Stat
+}
+
+// concurrentWalk is the state of a concurrent walk.
+type concurrentWalk struct {
+	// fnMu serializes calls to fn.
+	fnMu sync.Mutex
+	fn   fs.WalkDirFunc
+
+	// root is the directory the walk started at.
+	root *File
+
+	// mu protects all following fields.
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// queue holds the directories waiting to be read, and active is the
+	// amount of directories being read.
+	queue  []dirJob
+	active int
+
+	visited map[dirKey]bool
+
+	// done is set once the walk has been stopped by fn, with err holding the
+	// error to return.
+	done bool
+	err  error
+}
+
+// call calls fn, stopping the walk if it returns an error other than
+// fs.SkipDir. It reports whether fn returned nil.
+func (w *concurrentWalk) call(name string, s *Stat, err error) bool {
+	var d fs.DirEntry
+	if s != nil {
+		d = fs.FileInfoToDirEntry(newFileInfo(s, name))
+	}
+
+	w.fnMu.Lock()
+	err = w.fn(name, d, err)
+	w.fnMu.Unlock()
+
+	if err != nil && err != fs.SkipDir {
+		w.mu.Lock()
+		if !w.done {
+			w.done = true
+			if err != fs.SkipAll {
+				w.err = err
+			}
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+	return err == nil
+}
+
+// visit calls fn for an entry, and reports whether it is a directory that
+// should be descended into.
+func (w *concurrentWalk) visit(name string, s *Stat) bool {
+	if !w.call(name, s, nil) || !isDir(s) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done || w.visited[keyOf(s)] {
+		return false
+	}
+	w.visited[keyOf(s)] = true
+	return true
+}
+
+// fail reports an error reading a directory to fn.
+func (w *concurrentWalk) fail(name string, s *Stat, err error) {
+	w.call(name, s, pathError("readdir", name, err))
+}
+
+// result returns the error that ended the walk.
+func (w *concurrentWalk) result() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// work reads directories from the queue until all directories have been
+// read, or the walk has been stopped.
+func (w *concurrentWalk) work() {
+	w.mu.Lock()
+	for {
+		for len(w.queue) == 0 && w.active > 0 && !w.done {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.cond.Broadcast()
+			w.mu.Unlock()
+			return
+		}
+		job := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		if w.done {
+			continue
+		}
+		w.active++
+		w.mu.Unlock()
+
+		w.read(job)
+
+		w.mu.Lock()
+		w.active--
+		w.cond.Broadcast()
+	}
+}
+
+// read reads a directory, visiting its entries and queueing the
+// subdirectories to descend into.
+func (w *concurrentWalk) read(job dirJob) {
+	dir, err := w.root.Walk(job.names...)
+	if err != nil {
+		w.fail(job.name, job.stat, err)
+		return
+	}
+	defer dir.Close()
+	if err := dir.Open(OREAD); err != nil {
+		w.fail(job.name, job.stat, err)
+		return
+	}
+	stats, err := dir.ReadDir()
+	if err != nil {
+		w.fail(job.name, job.stat, err)
+		return
+	}
+
+	for i := range stats {
+		w.mu.Lock()
+		done := w.done
+		w.mu.Unlock()
+		if done {
+			return
+		}
+
+		s := &stats[i]
+		name := path.Join(job.name, s.Name)
+		if !w.visit(name, s) {
+			continue
+		}
+		names := append(job.names[:len(job.names):len(job.names)], s.Name)
+		w.mu.Lock()
+		w.queue = append(w.queue, dirJob{names: names, name: name, stat: s})
+		w.cond.Signal()
+		w.mu.Unlock()
+	}
+}
+
+// Glob returns the names of all files matching the pattern, with the syntax
+// and semantics of fs.Glob. Patterns are resolved relative to the root of
+// the most recent attach, and must not start with a slash.
+func (c *Client) Glob(pattern string) ([]string, error) {
+	root, err := c.attached()
+	if err != nil {
+		return nil, err
+	}
+	return fs.Glob(NewFS(root), pattern)
+}
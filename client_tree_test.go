@@ -0,0 +1,210 @@
+package qp
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// treeFS returns a ramFS with a small tree containing a bind loop from
+// a/b/loop back to a.
+func treeFS() *ramFS {
+	rfs := newRamFS()
+	for _, p := range []string{"a/b/c/file1", "a/b/file2", "a/file3", "d/file4", "e/f/file5", "file6"} {
+		rfs.add(p, 0644, []byte(p))
+	}
+	a := rfs.lookup("a")
+	b := rfs.lookup("a/b")
+	loop := &ramNode{name: "loop", mode: a.mode, qid: a.qid, mtime: a.mtime, parent: b}
+	b.children = append(b.children, loop)
+	loop.children = a.children
+	return rfs
+}
+
+var treePaths = []string{
+	".", "a", "a/b", "a/b/c", "a/b/c/file1", "a/b/file2", "a/b/loop", "a/file3",
+	"d", "d/file4", "e", "e/f", "e/f/file5", "file6",
+}
+
+func TestClientWalkDir(t *testing.T) {
+	rfs := treeFS()
+	c, _ := rfs.attach(t, Version)
+
+	var paths []string
+	stats := rfs.count(Tstat)
+	err := c.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if !reflect.DeepEqual(paths, treePaths) {
+		t.Errorf("expected %v, got %v", treePaths, paths)
+	}
+	if n := rfs.count(Tstat) - stats; n != 1 {
+		t.Errorf("expected only the root to be stat'ed, got %d stats", n)
+	}
+
+	// Skipping a directory, and the rest of a directory through a file.
+	paths = nil
+	err = c.WalkDir("/", func(path string, d fs.DirEntry, err error) error {
+		paths = append(paths, path)
+		switch path {
+		case "/a/b", "/e/f/file5":
+			return fs.SkipDir
+		case "/file6":
+			if d.IsDir() || d.Name() != "file6" {
+				t.Errorf("unexpected entry for file6: %v", d)
+			}
+		}
+		return nil
+	})
+	expected := []string{"/", "/a", "/a/b", "/a/file3", "/d", "/d/file4", "/e", "/e/f", "/e/f/file5", "/file6"}
+	if err != nil || !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, paths, err)
+	}
+
+	paths = nil
+	err = c.WalkDir("a", func(path string, d fs.DirEntry, err error) error {
+		paths = append(paths, path)
+		if path == "a/b/c" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	expected = []string{"a", "a/b", "a/b/c"}
+	if err != nil || !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, paths, err)
+	}
+
+	errStop := errors.New("stop")
+	if err := c.WalkDir("d", func(string, fs.DirEntry, error) error { return errStop }); err != errStop {
+		t.Errorf("expected error from fn, got %v", err)
+	}
+
+	var walkErr error
+	err = c.WalkDir("nope", func(path string, d fs.DirEntry, err error) error {
+		walkErr = err
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) || !errors.Is(walkErr, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v and %v", err, walkErr)
+	}
+}
+
+func TestClientWalkDirConcurrent(t *testing.T) {
+	rfs := treeFS()
+	for i := 0; i < 20; i++ {
+		rfs.add("many/dir"+string(rune('a'+i))+"/file", 0644, nil)
+	}
+
+	// Walks are held briefly to measure how many are in flight at once.
+	var mu sync.Mutex
+	var inflight, peak int
+	rfs.hold = func(m Message) {
+		if _, ok := m.(*WalkRequest); !ok {
+			return
+		}
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+	}
+	c, _ := rfs.attach(t, Version)
+
+	var paths []string
+	err := c.WalkDirConcurrent(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "many" {
+			return nil
+		}
+		if len(path) > 4 && path[:4] == "many" {
+			return fs.SkipDir
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, treePaths) {
+		t.Errorf("expected %v, got %v", treePaths, paths)
+	}
+
+	paths = nil
+	err = c.WalkDirConcurrent("many", func(path string, d fs.DirEntry, err error) error {
+		paths = append(paths, path)
+		return err
+	})
+	if err != nil || len(paths) != 41 {
+		t.Errorf("expected 41 entries, got %d, %v", len(paths), err)
+	}
+
+	// Queued directories hold no fids, leaving only the root, the start of
+	// the walk and the directory being read open.
+	c.WalkWindow = 1
+	open := 0
+	err = c.WalkDirConcurrent("many", func(path string, d fs.DirEntry, err error) error {
+		c.mu.Lock()
+		open = max(open, len(c.files))
+		c.mu.Unlock()
+		return err
+	})
+	c.WalkWindow = 0
+	if err != nil || open > 3 {
+		t.Errorf("expected at most 3 open files, got %d, %v", open, err)
+	}
+	mu.Lock()
+	if peak < 2 {
+		t.Errorf("expected concurrent walks, got at most %d in flight", peak)
+	}
+	mu.Unlock()
+
+	errStop := errors.New("stop")
+	err = c.WalkDirConcurrent(".", func(path string, d fs.DirEntry, err error) error {
+		if path == "a" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("expected error from fn, got %v", err)
+	}
+
+	c.mu.Lock()
+	if len(c.files) != 1 {
+		t.Errorf("expected only the root to be open, got %d files", len(c.files))
+	}
+	c.mu.Unlock()
+}
+
+func TestClientGlob(t *testing.T) {
+	c, _ := treeFS().attach(t, Version)
+
+	matches, err := c.Glob("*/*/file?")
+	expected := []string{"a/b/file2", "e/f/file5"}
+	if err != nil || !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, matches, err)
+	}
+	if _, err := c.Glob("[x"); err != path.ErrBadPattern {
+		t.Errorf("expected path.ErrBadPattern, got %v", err)
+	}
+}
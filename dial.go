@@ -0,0 +1,340 @@
+package qp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidDialString indicates a dial string that cannot be parsed.
+var ErrInvalidDialString = errors.New("invalid dial string")
+
+// DefaultService is the service dialed if a dial string names none.
+const DefaultService = "9fs"
+
+// services maps the service names used for 9P and its auth servers to their
+// ports, which are not known to the services database of most systems.
+var services = map[string]string{
+	"9fs":    "564",
+	"ticket": "567",
+	"styx":   "6666",
+}
+
+// ParseDialString converts a Plan 9 dial string of the form
+// network!host!service to a network and address for the net package. The
+// network is one of tcp, tcp4, tcp6 and unix, or net, which is taken to mean
+// tcp. The service is a port number or name, including the 9fs and styx
+// services of Plan 9. If the network is omitted, tcp is used, and if the
+// service is omitted, DefaultService is used. Unix sockets are named as
+// unix!path, and a dial string consisting of a single path is taken to name
+// a unix socket as well. The host * stands for all addresses when listening.
+func ParseDialString(addr string) (network, address string, err error) {
+	parts := strings.Split(addr, "!")
+	switch {
+	case len(parts) == 1 && strings.Contains(addr, "/"):
+		return "unix", addr, nil
+	case len(parts) == 1:
+		parts = []string{"tcp", parts[0], DefaultService}
+	case len(parts) == 2 && parts[0] == "unix":
+		if parts[1] == "" {
+			return "", "", ErrInvalidDialString
+		}
+		return "unix", parts[1], nil
+	case len(parts) == 2 && isNetwork(parts[0]):
+		parts = append(parts, DefaultService)
+	case len(parts) == 2:
+		parts = append([]string{"tcp"}, parts...)
+	case len(parts) != 3:
+		return "", "", ErrInvalidDialString
+	}
+
+	network, host, service := parts[0], parts[1], parts[2]
+	switch network {
+	case "net":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", ErrInvalidDialString
+	}
+	if host == "*" {
+		host = ""
+	}
+	port, err := lookupService(network, service)
+	if err != nil {
+		return "", "", err
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// isNetwork reports whether the name is a network of a dial string.
+func isNetwork(name string) bool {
+	switch name {
+	case "net", "tcp", "tcp4", "tcp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// lookupService returns the port of a service.
+func lookupService(network, service string) (string, error) {
+	if port, ok := services[service]; ok {
+		return port, nil
+	}
+	if _, err := strconv.ParseUint(service, 10, 16); err == nil {
+		return service, nil
+	}
+	if service == "" {
+		return "", ErrInvalidDialString
+	}
+	port, err := net.LookupPort(network, service)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(port), nil
+}
+
+// Conn is a network connection on which the protocol version has been
+// negotiated. The codecs are configured for the negotiated protocol and
+// message size.
+type Conn struct {
+	net.Conn
+
+	Encoder *Encoder
+	Decoder *Decoder
+
+	// Version is the negotiated protocol version.
+	Version string
+}
+
+// Dialer dials 9P servers by dial string, negotiating the protocol version.
+type Dialer struct {
+	// MessageSize is the maximum message size suggested to the server. If
+	// zero, DefaultMessageSize is used.
+	MessageSize uint32
+
+	// Version is the protocol version suggested to the server. If empty,
+	// Version is used.
+	Version string
+
+	// TLSConfig, if set, secures connections with TLS, negotiating
+	// ALPNProtocol. See DialTLS.
+	TLSConfig *tls.Config
+}
+
+// Dial dials the dial string with the default options of Dialer. See
+// ParseDialString for the syntax of dial strings.
+func Dial(addr string) (*Conn, error) {
+	var d Dialer
+	return d.DialContext(context.Background(), addr)
+}
+
+// Dial dials the dial string, and negotiates the protocol version.
+func (d *Dialer) Dial(addr string) (*Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but gives up once ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	network, address, err := ParseDialString(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.dial(ctx, network, address)
+}
+
+// dial dials the address on the network, as understood by the net package,
+// and negotiates the protocol version.
+func (d *Dialer) dial(ctx context.Context, network, address string) (*Conn, error) {
+	var nd net.Dialer
+	var conn net.Conn
+	var err error
+	if d.TLSConfig != nil {
+		td := &tls.Dialer{NetDialer: &nd, Config: tlsConfig(d.TLSConfig)}
+		conn, err = td.DialContext(ctx, network, address)
+	} else {
+		conn, err = nd.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkALPN(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	msize, version := d.MessageSize, d.Version
+	if msize == 0 {
+		msize = DefaultMessageSize
+	}
+	if version == "" {
+		version = Version
+	}
+
+	// The handshake is abandoned once ctx is done by expiring the deadline
+	// of the connection.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	enc := &Encoder{Protocol: NineP2000, Writer: conn}
+	dec := &Decoder{Protocol: NineP2000, Reader: conn}
+	resp, _, err := handshake(enc, dec, msize, version, nil)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{Conn: conn, Encoder: enc, Decoder: dec, Version: resp.Version}, nil
+}
+
+// NewClientConn returns a client for a negotiated connection, which is ready
+// to use without calling Negotiate.
+func NewClientConn(conn *Conn) *Client {
+	c := &Client{
+		conn:     conn,
+		enc:      conn.Encoder,
+		dec:      conn.Decoder,
+		protocol: conn.Encoder.Protocol,
+		msize:    conn.Encoder.MessageSize,
+		version:  conn.Version,
+		files:    make(map[Fid]*File),
+		pending:  make(map[Tag]*call),
+	}
+	go c.readLoop(conn, conn.Decoder)
+	return c
+}
+
+// negotiateTimeout limits how long an accepted connection may take to send
+// its Tversion.
+const negotiateTimeout = 30 * time.Second
+
+// Listener accepts connections by dial string, negotiating the protocol
+// version of each connection in the background. Listener implements
+// net.Listener, allowing it to be passed to Server.Serve, in which case the
+// versions and message size negotiated by the listener take the place of
+// those configured for the server.
+type Listener struct {
+	// MessageSize is the maximum message size accepted. If zero,
+	// DefaultMessageSize is used.
+	MessageSize uint32
+
+	// Versions are the protocol versions offered, as for Server.Versions.
+	Versions []string
+
+	l     net.Listener
+	once  sync.Once
+	conns chan *Conn
+
+	// done is closed once accepting has failed with err.
+	done chan struct{}
+	err  error
+}
+
+// Listen listens on the dial string. See ParseDialString for the syntax of
+// dial strings. The listener must be configured before the first call to
+// Accept.
+func Listen(addr string) (*Listener, error) {
+	network, address, err := ParseDialString(addr)
+	if err != nil {
+		return nil, err
+	}
+	return listen(network, address)
+}
+
+// listen listens on the address on the network, as understood by the net
+// package.
+func listen(network, address string) (*Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{l: l, conns: make(chan *Conn), done: make(chan struct{})}, nil
+}
+
+// acceptLoop accepts connections until the listener fails, negotiating each
+// in its own goroutine, so that slow clients do not hold up others.
+func (l *Listener) acceptLoop() {
+	msize := l.MessageSize
+	if msize == 0 {
+		msize = DefaultMessageSize
+	}
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			enc := &Encoder{Protocol: NineP2000, Writer: conn}
+			dec := &Decoder{Protocol: NineP2000, Reader: conn}
+			conn.SetDeadline(time.Now().Add(negotiateTimeout))
+			if err := checkALPN(conn); err != nil {
+				conn.Close()
+				return
+			}
+			if err := acceptVersion(enc, dec, msize, l.Versions); err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			c := &Conn{Conn: conn, Encoder: enc, Decoder: dec, Version: negotiatedVersion(enc.Protocol)}
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// negotiatedVersion returns the version string of a protocol.
+func negotiatedVersion(p Protocol) string {
+	switch p {
+	case NineP2000Dotu:
+		return VersionDotu
+	case NineP2000Dote:
+		return VersionDote
+	default:
+		return Version
+	}
+}
+
+// AcceptConn waits for the next connection, and returns it once its
+// protocol version has been negotiated. Connections that fail to negotiate
+// are closed and never returned.
+func (l *Listener) AcceptConn() (*Conn, error) {
+	l.once.Do(func() { go l.acceptLoop() })
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Accept implements net.Listener, returning a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptConn()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops listening. Connections that are still negotiating are closed
+// once they complete negotiation.
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+// Addr returns the address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
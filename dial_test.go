@@ -0,0 +1,113 @@
+package qp
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseDialString(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		ok      bool
+	}{
+		{"tcp!fileserver!9fs", "tcp", "fileserver:564", true},
+		{"net!host!564", "tcp", "host:564", true},
+		{"tcp!host!styx", "tcp", "host:6666", true},
+		{"tcp6!::1!9fs", "tcp6", "[::1]:564", true},
+		{"host!1234", "tcp", "host:1234", true},
+		{"tcp!host", "tcp", "host:564", true},
+		{"host", "tcp", "host:564", true},
+		{"tcp!*!9fs", "tcp", ":564", true},
+		{"unix!/tmp/ns.glenda/acme", "unix", "/tmp/ns.glenda/acme", true},
+		{"/tmp/ns.glenda/acme", "unix", "/tmp/ns.glenda/acme", true},
+		{"unix!", "", "", false},
+		{"udp!host!9fs", "", "", false},
+		{"tcp!host!", "", "", false},
+		{"a!b!c!d", "", "", false},
+	}
+
+	for _, tt := range tests {
+		network, address, err := ParseDialString(tt.addr)
+		if (err == nil) != tt.ok || network != tt.network || address != tt.address {
+			t.Errorf("%s: expected %s %s, got %s %s, %v", tt.addr, tt.network, tt.address, network, address, err)
+		}
+	}
+}
+
+func TestDialListen(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("content"))
+	srv := &Server{FS: newRamServer(rfs)}
+	defer srv.Close()
+
+	sock := filepath.Join(t.TempDir(), "sock")
+	for _, addr := range []string{"tcp!127.0.0.1!0", "unix!" + sock} {
+		l, err := Listen(addr)
+		if err != nil {
+			t.Fatalf("%s: listen failed: %v", addr, err)
+		}
+		l.MessageSize = 4096
+		go srv.Serve(l)
+
+		dialAddr := "unix!" + sock
+		if ta, ok := l.Addr().(*net.TCPAddr); ok {
+			dialAddr = "tcp!127.0.0.1!" + strconv.Itoa(ta.Port)
+
+			// A client that never negotiates does not hold up others.
+			stall, err := net.Dial("tcp", ta.String())
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			defer stall.Close()
+		}
+
+		for _, version := range []string{Version, VersionDotu} {
+			d := &Dialer{Version: version}
+			conn, err := d.Dial(dialAddr)
+			if err != nil {
+				t.Fatalf("%s: dial failed: %v", dialAddr, err)
+			}
+			if conn.Version != version || conn.Encoder.MessageSize != 4096 {
+				t.Errorf("%s: negotiated %s with message size %d", dialAddr, conn.Version, conn.Encoder.MessageSize)
+			}
+
+			c := NewClientConn(conn)
+			if _, err := c.Attach(nil, "glenda", ""); err != nil {
+				t.Fatalf("%s: attach failed: %v", dialAddr, err)
+			}
+			if b, err := c.ReadFile("file"); err != nil || string(b) != "content" {
+				t.Errorf("%s: read returned %q, %v", dialAddr, b, err)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept, but never respond.
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var d Dialer
+	if _, err := d.DialContext(ctx, "tcp!127.0.0.1!"+strconv.Itoa(l.Addr().(*net.TCPAddr).Port)); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrIsDirectory indicates an attempt to read a directory as a file.
+	ErrIsDirectory = errors.New("is a directory")
+
+	// ErrNotDirectory indicates an attempt to list a file as a directory.
+	ErrNotDirectory = errors.New("not a directory")
+)
+
+// FS is a read-only fs.FS backed by a remote 9P tree. Names are resolved by
+// walking from the root file, which remains owned by the caller. FS
+// implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS.
+type FS struct {
+	root *File
+}
+
+// NewFS returns a file system rooted at the provided file, which is usually
+// obtained from Client.Attach.
+func NewFS(root *File) *FS {
+	return &FS{root: root}
+}
+
+// walk walks to the named file, returning errors as *fs.PathError.
+func (fsys *FS) walk(op, name string) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := fsys.root.Walk(SplitPath(name)...)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return f, nil
+}
+
+// open walks to and opens the named file for reading.
+func (fsys *FS) open(op, name string) (*File, error) {
+	f, err := fsys.walk(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Open(OREAD); err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// Open opens the named file for reading. The returned file implements
+// io.ReaderAt and io.Seeker, and fs.ReadDirFile for directories.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	f, err := fsys.open("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{File: f, name: name}, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := f.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return newFileInfo(s, name), nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.open("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.qid.Type&QTDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDirectory}
+	}
+	stats, err := f.ReadDir()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, len(stats))
+	for i := range stats {
+		entries[i] = fs.FileInfoToDirEntry(newFileInfo(&stats[i], ""))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadFile reads the named file, returning its content.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.open("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.qid.Type&QTDIR != 0 {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: ErrIsDirectory}
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
+}
+
+// fsFile is a file opened through FS.
+type fsFile struct {
+	*File
+	name string
+
+	// dir is the iterator used by ReadDir, created on first use.
+	dir *DirIterator
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	s, err := f.File.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return newFileInfo(s, f.name), nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.qid.Type&QTDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: ErrIsDirectory}
+	}
+	return f.File.Read(p)
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.qid.Type&QTDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: ErrIsDirectory}
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.qid.Type&QTDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: ErrNotDirectory}
+	}
+
+	if f.dir == nil {
+		f.dir = NewDirIterator(f.File)
+	}
+	stats, err := f.dir.ReadDir(n)
+	entries := make([]fs.DirEntry, len(stats))
+	for i := range stats {
+		entries[i] = fs.FileInfoToDirEntry(newFileInfo(&stats[i], ""))
+	}
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+	}
+	return entries, err
+}
+
+// fileInfo implements fs.FileInfo for a Stat struct.
+type fileInfo struct {
+	stat *Stat
+	name string
+}
+
+// newFileInfo returns a fs.FileInfo for the Stat struct. If name is not
+// empty, the base name of the path is used in place of the name in the stat,
+// as servers usually name the root "/".
+func newFileInfo(s *Stat, name string) fs.FileInfo {
+	fi := &fileInfo{stat: s, name: s.Name}
+	if name != "" {
+		names := SplitPath(name)
+		if len(names) == 0 {
+			fi.name = "."
+		} else {
+			fi.name = names[len(names)-1]
+		}
+	}
+	return fi
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.stat.Length) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.stat.Mode.FileMode() }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.stat.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.stat.Mode&DMDIR != 0 }
+
+// Sys returns the underlying *Stat.
+func (fi *fileInfo) Sys() interface{} { return fi.stat }
+
+// FileMode converts the file mode to a fs.FileMode.
+func (m FileMode) FileMode() fs.FileMode {
+	fm := fs.FileMode(m & 0777)
+	for _, x := range []struct {
+		from FileMode
+		to   fs.FileMode
+	}{
+		{DMDIR, fs.ModeDir},
+		{DMAPPEND, fs.ModeAppend},
+		{DMEXCL, fs.ModeExclusive},
+		{DMTMP, fs.ModeTemporary},
+		{DMSYMLINK, fs.ModeSymlink},
+		{DMDEVICE, fs.ModeDevice},
+		{DMNAMEDPIPE, fs.ModeNamedPipe},
+		{DMSOCKET, fs.ModeSocket},
+		{DMSETUID, fs.ModeSetuid},
+		{DMSETGID, fs.ModeSetgid},
+	} {
+		if m&x.from != 0 {
+			fm |= x.to
+		}
+	}
+	return fm
+}
@@ -0,0 +1,78 @@
+package qp
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestFS(t *testing.T, version string) *FS {
+	rfs := newRamFS()
+	rfs.iounit = 200
+	rfs.add("hello.txt", 0644, []byte("hello, world\n"))
+	rfs.add("empty", 0600, nil)
+	rfs.add("dir/a", 0644, []byte("a"))
+	rfs.add("dir/b", 0755, make([]byte, 1000))
+	rfs.add("dir/sub/c", 0444, []byte("c"))
+	for i := 0; i < 30; i++ {
+		rfs.add("many/file"+strconv.Itoa(i), 0644, []byte{byte(i)})
+	}
+	rfs.add("emptydir", DMDIR|0755, nil)
+	_, root := rfs.attach(t, version)
+	return NewFS(root)
+}
+
+func TestFS(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu} {
+		fsys := newTestFS(t, version)
+		if err := fstest.TestFS(fsys, "hello.txt", "empty", "dir/a", "dir/b", "dir/sub/c", "emptydir"); err != nil {
+			t.Errorf("%s: %v", version, err)
+		}
+	}
+}
+
+func TestFSErrors(t *testing.T) {
+	fsys := newTestFS(t, Version)
+
+	if _, err := fsys.Open("nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := fsys.Open("dir/../hello.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected fs.ErrInvalid, got %v", err)
+	}
+	if _, err := fsys.ReadFile("dir"); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected ErrIsDirectory, got %v", err)
+	}
+	if _, err := fsys.ReadDir("hello.txt"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("expected ErrNotDirectory, got %v", err)
+	}
+
+	fi, err := fsys.Stat("dir/b")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if fi.Name() != "b" || fi.Size() != 1000 || fi.Mode() != 0755 || fi.Sys().(*Stat).UID != "glenda" {
+		t.Errorf("unexpected file info: %v %v %v", fi.Name(), fi.Size(), fi.Mode())
+	}
+}
+
+func TestFileModeFileMode(t *testing.T) {
+	tests := []struct {
+		in       FileMode
+		expected fs.FileMode
+	}{
+		{0644, 0644},
+		{DMDIR | 0755, fs.ModeDir | 0755},
+		{DMAPPEND | DMEXCL | 0600, fs.ModeAppend | fs.ModeExclusive | 0600},
+		{DMSYMLINK | 0777, fs.ModeSymlink | 0777},
+		{DMAUTH | 0600, 0600},
+	}
+
+	for i, tt := range tests {
+		if got := tt.in.FileMode(); got != tt.expected {
+			t.Errorf("test %d: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package qp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ErrInvalidJSON indicates that a JSON message was malformed, such as missing
+// the type field or containing unknown fields.
+var ErrInvalidJSON = errors.New("invalid JSON message")
+
+// EncodeJSON encodes a message as a JSON object. The object contains a "type"
+// field with the name of the message type, such as "Twalk", followed by the
+// message fields under the names used in the 9P manual pages. Qids, file
+// modes and open modes are rendered symbolically, and data is base64 encoded.
+// An example of an encoded message is:
+//
+//	{"type":"Twalk","tag":1,"fid":0,"newfid":1,"wname":["a"]}
+func EncodeJSON(m Message) ([]byte, error) {
+	s := SchemaOf(m)
+	if s == nil {
+		return nil, ErrUnknownMessageType
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"type":`)
+	b, _ := json.Marshal(s.Name)
+	buf.Write(b)
+
+	v := reflect.ValueOf(m).Elem()
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		fv := v.FieldByName(f.GoName)
+
+		// Empty lists and data are rendered as such, rather than as null.
+		var x interface{}
+		switch {
+		case fv.Kind() == reflect.Slice && fv.IsNil() && f.Type == WireData:
+			x = []byte{}
+		case fv.Kind() == reflect.Slice && fv.IsNil():
+			x = reflect.MakeSlice(fv.Type(), 0, 0).Interface()
+		default:
+			x = fv.Interface()
+		}
+
+		b, err := json.Marshal(x)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.WriteByte(',')
+		name, _ := json.Marshal(f.Name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// DecodeJSON decodes a message encoded by EncodeJSON. The protocol is used to
+// select the message struct for the type, as extensions may replace messages.
+// Fields not present in the object are left at their zero value.
+func DecodeJSON(p Protocol, b []byte) (Message, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+
+	var name string
+	if raw, ok := obj["type"]; !ok {
+		return nil, ErrInvalidJSON
+	} else if err := json.Unmarshal(raw, &name); err != nil {
+		return nil, ErrInvalidJSON
+	}
+	delete(obj, "type")
+
+	var s *Schema
+	for _, x := range schemas {
+		if x.Name == name && x.In(p) {
+			s = x
+			break
+		}
+	}
+	if s == nil {
+		return nil, ErrUnknownMessageType
+	}
+
+	m := s.New()
+	v := reflect.ValueOf(m).Elem()
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		raw, ok := obj[f.Name]
+		if !ok {
+			continue
+		}
+		delete(obj, f.Name)
+
+		if err := json.Unmarshal(raw, v.FieldByName(f.GoName).Addr().Interface()); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(obj) != 0 {
+		return nil, ErrInvalidJSON
+	}
+
+	return m, nil
+}
+
+// JSONEncoder writes messages to an io.Writer as JSON, one message per line.
+// JSONEncoder is thread safe, and may be called in parallel from arbitrary
+// goroutines.
+type JSONEncoder struct {
+	// Writer is the writer to encode messages to.
+	Writer io.Writer
+
+	// writeLock is used to synchronize writes.
+	writeLock sync.Mutex
+}
+
+// WriteMessage encodes a message as JSON and writes it, followed by a
+// newline, to the JSONEncoders associated io.Writer.
+func (e *JSONEncoder) WriteMessage(m Message) error {
+	b, err := EncodeJSON(m)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	_, err = e.Writer.Write(b)
+	return err
+}
+
+// JSONDecoder reads JSON encoded messages from an io.Reader. The messages may
+// be separated by any amount of whitespace, such as one message per line. A
+// JSONDecoder is not thread safe. Only one goroutine may call ReadMessage at
+// a time.
+type JSONDecoder struct {
+	// Protocol is the protocol used to select message structs.
+	Protocol Protocol
+
+	// Reader is the reader to decode from. It must not be changed after the
+	// first call to ReadMessage.
+	Reader io.Reader
+
+	dec *json.Decoder
+}
+
+// ReadMessage reads and decodes the next message.
+func (d *JSONDecoder) ReadMessage() (Message, error) {
+	if d.dec == nil {
+		d.dec = json.NewDecoder(d.Reader)
+	}
+
+	var raw json.RawMessage
+	if err := d.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return DecodeJSON(d.Protocol, raw)
+}
+
+// qidJSON, statJSON and statDotuJSON give Qid, Stat and StatDotu the field
+// names of the 9P manual pages when encoded as JSON.
+type qidJSON struct {
+	Type    QidType `json:"type"`
+	Version uint32  `json:"version"`
+	Path    uint64  `json:"path"`
+}
+
+type statJSON struct {
+	Type   uint16   `json:"type"`
+	Dev    uint32   `json:"dev"`
+	Qid    Qid      `json:"qid"`
+	Mode   FileMode `json:"mode"`
+	Atime  uint32   `json:"atime"`
+	Mtime  uint32   `json:"mtime"`
+	Length uint64   `json:"length"`
+	Name   string   `json:"name"`
+	UID    string   `json:"uid"`
+	GID    string   `json:"gid"`
+	MUID   string   `json:"muid"`
+}
+
+type statDotuJSON struct {
+	Type       uint16   `json:"type"`
+	Dev        uint32   `json:"dev"`
+	Qid        Qid      `json:"qid"`
+	Mode       FileMode `json:"mode"`
+	Atime      uint32   `json:"atime"`
+	Mtime      uint32   `json:"mtime"`
+	Length     uint64   `json:"length"`
+	Name       string   `json:"name"`
+	UID        string   `json:"uid"`
+	GID        string   `json:"gid"`
+	MUID       string   `json:"muid"`
+	Extensions string   `json:"extension"`
+	UIDno      uint32   `json:"n_uid"`
+	GIDno      uint32   `json:"n_gid"`
+	MUIDno     uint32   `json:"n_muid"`
+}
+
+func (q Qid) MarshalJSON() ([]byte, error) { return json.Marshal(qidJSON(q)) }
+
+func (q *Qid) UnmarshalJSON(b []byte) error { return json.Unmarshal(b, (*qidJSON)(q)) }
+
+func (s Stat) MarshalJSON() ([]byte, error) { return json.Marshal(statJSON(s)) }
+
+func (s *Stat) UnmarshalJSON(b []byte) error { return json.Unmarshal(b, (*statJSON)(s)) }
+
+func (s StatDotu) MarshalJSON() ([]byte, error) { return json.Marshal(statDotuJSON(s)) }
+
+func (s *StatDotu) UnmarshalJSON(b []byte) error { return json.Unmarshal(b, (*statDotuJSON)(s)) }
@@ -0,0 +1,158 @@
+package qp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJSONReencode(t *testing.T) {
+	sets := []struct {
+		p    Protocol
+		data []MessageTestEntry
+	}{
+		{NineP2000, MessageTestData},
+		{NineP2000Dotu, MessageTestDataDotu},
+		{NineP2000Dote, MessageTestDataDote},
+	}
+
+	for _, set := range sets {
+		for i, tt := range set.data {
+			b, err := EncodeJSON(tt.input)
+			if err != nil {
+				t.Errorf("test %d: encoding failed for %T: %v", i, tt.input, err)
+				continue
+			}
+			m, err := DecodeJSON(set.p, b)
+			if err != nil {
+				t.Errorf("test %d: decoding failed for %T: %v\n\tJSON: %s", i, tt.input, err, b)
+				continue
+			}
+
+			// Compare the binary representations, as JSON does not
+			// distinguish between nil and empty slices.
+			s := make([]byte, m.EncodedSize())
+			m.Marshal(s)
+			if !bytes.Equal(s, tt.reference) {
+				t.Errorf("test %d: %T did not reencode correctly\n\tJSON:     %s\n\tExpected: %v\n\tGot:      %v", i, tt.input, b, tt.reference, s)
+			}
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	tests := []struct {
+		m        Message
+		expected string
+	}{
+		{
+			&WalkRequest{Tag: 1, Fid: 0, NewFid: 1, Names: []string{"a"}},
+			`{"type":"Twalk","tag":1,"fid":0,"newfid":1,"wname":["a"]}`,
+		}, {
+			&WalkResponse{Tag: 1},
+			`{"type":"Rwalk","tag":1,"wqid":[]}`,
+		}, {
+			&OpenRequest{Tag: 2, Fid: 3, Mode: ORDWR | OTRUNC},
+			`{"type":"Topen","tag":2,"fid":3,"mode":"ORDWR|OTRUNC"}`,
+		}, {
+			&CreateRequest{Tag: 2, Fid: 3, Name: "d", Permissions: DMDIR | 0755, Mode: OREAD},
+			`{"type":"Tcreate","tag":2,"fid":3,"name":"d","perm":"DMDIR|0755","mode":"OREAD"}`,
+		}, {
+			&AttachResponse{Tag: 4, Qid: Qid{Type: QTDIR | QTAPPEND, Version: 1, Path: 2}},
+			`{"type":"Rattach","tag":4,"qid":{"type":"QTDIR|QTAPPEND","version":1,"path":2}}`,
+		}, {
+			&ReadResponse{Tag: 5, Data: []byte("hello")},
+			`{"type":"Rread","tag":5,"data":"aGVsbG8="}`,
+		}, {
+			&StatResponse{Tag: 6, Stat: Stat{Qid: Qid{Path: 7}, Mode: 0644, Name: "f", UID: "glenda"}},
+			`{"type":"Rstat","tag":6,"stat":{"type":0,"dev":0,"qid":{"type":"QTFILE","version":0,"path":7},"mode":"0644","atime":0,"mtime":0,"length":0,"name":"f","uid":"glenda","gid":"","muid":""}}`,
+		},
+	}
+
+	for i, tt := range tests {
+		b, err := EncodeJSON(tt.m)
+		if err != nil {
+			t.Errorf("test %d: encoding failed: %v", i, err)
+			continue
+		}
+		if string(b) != tt.expected {
+			t.Errorf("test %d: expected %s, got %s", i, tt.expected, b)
+		}
+	}
+}
+
+func TestJSONDecodeErrors(t *testing.T) {
+	tests := []string{
+		`{"tag":1}`,
+		`{"type":"Tnonsense","tag":1}`,
+		`{"type":"Tclunk","tag":1,"fid":2,"bogus":3}`,
+		`{"type":"Topen","tag":1,"fid":2,"mode":"OBOGUS"}`,
+		`{"type":"Tsession","tag":1}`,
+	}
+
+	for i, tt := range tests {
+		if _, err := DecodeJSON(NineP2000, []byte(tt)); err == nil {
+			t.Errorf("test %d: decoding %s did not fail", i, tt)
+		}
+	}
+}
+
+func TestJSONEncoderDecoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := JSONEncoder{Writer: buf}
+	for _, tt := range MessageTestDataDote {
+		if err := e.WriteMessage(tt.input); err != nil {
+			t.Fatalf("unable to write to buffer: %v", err)
+		}
+	}
+
+	d := JSONDecoder{Protocol: NineP2000Dote, Reader: buf}
+	for i, tt := range MessageTestDataDote {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: failed on %T with error: %v", i, tt.input, err)
+		}
+		if !CompareMarshallables(tt.input, m) {
+			t.Errorf("test %d: failed on %T\n\tExpected: %#v\n\tGot:      %#v", i, tt.input, tt.input, m)
+		}
+	}
+}
+
+func TestFlagStrings(t *testing.T) {
+	tests := []struct {
+		v interface {
+			String() string
+			MarshalText() ([]byte, error)
+		}
+		expected string
+	}{
+		{QTFILE, "QTFILE"},
+		{QTDIR | QTTMP, "QTDIR|QTTMP"},
+		{QidType(0x80 | 0x01), "QTDIR|QTLINK"},
+		{FileMode(0644), "0644"},
+		{DMDIR | DMEXCL | 0700, "DMDIR|DMEXCL|0700"},
+		{FileMode(0x400000) | 0600, "0x400000|0600"},
+		{OREAD, "OREAD"},
+		{OEXEC | ORCLOSE | OCEXEC, "OEXEC|OCEXEC|ORCLOSE"},
+	}
+
+	for i, tt := range tests {
+		if s := tt.v.String(); s != tt.expected {
+			t.Errorf("test %d: expected %q, got %q", i, tt.expected, s)
+		}
+	}
+
+	var (
+		qt QidType
+		fm FileMode
+		om OpenMode
+	)
+	if err := qt.UnmarshalText([]byte("QTDIR|QTAUTH")); err != nil || qt != QTDIR|QTAUTH {
+		t.Errorf("QidType parsed to %v, %v", qt, err)
+	}
+	if err := fm.UnmarshalText([]byte("DMDIR | 0x1ed")); err != nil || fm != DMDIR|0755 {
+		t.Errorf("FileMode parsed to %v, %v", fm, err)
+	}
+	if err := om.UnmarshalText([]byte("OWRITE|OTRUNC")); err != nil || om != OWRITE|OTRUNC {
+		t.Errorf("OpenMode parsed to %v, %v", om, err)
+	}
+}
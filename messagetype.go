@@ -0,0 +1,110 @@
+package qp
+
+import "strconv"
+
+var messageTypeNames = map[MessageType]string{
+	Tversion: "Tversion",
+	Rversion: "Rversion",
+	Tauth:    "Tauth",
+	Rauth:    "Rauth",
+	Tattach:  "Tattach",
+	Rattach:  "Rattach",
+	Terror:   "Terror",
+	Rerror:   "Rerror",
+	Tflush:   "Tflush",
+	Rflush:   "Rflush",
+	Twalk:    "Twalk",
+	Rwalk:    "Rwalk",
+	Topen:    "Topen",
+	Ropen:    "Ropen",
+	Tcreate:  "Tcreate",
+	Rcreate:  "Rcreate",
+	Tread:    "Tread",
+	Rread:    "Rread",
+	Twrite:   "Twrite",
+	Rwrite:   "Rwrite",
+	Tclunk:   "Tclunk",
+	Rclunk:   "Rclunk",
+	Tremove:  "Tremove",
+	Rremove:  "Rremove",
+	Tstat:    "Tstat",
+	Rstat:    "Rstat",
+	Twstat:   "Twstat",
+	Rwstat:   "Rwstat",
+	Tsession: "Tsession",
+	Rsession: "Rsession",
+	Tsread:   "Tsread",
+	Rsread:   "Rsread",
+	Tswrite:  "Tswrite",
+	Rswrite:  "Rswrite",
+}
+
+// String returns the name of the message type, such as "Twalk". Unknown
+// message types are returned as "MessageType(n)".
+func (mt MessageType) String() string {
+	if s, ok := messageTypeNames[mt]; ok {
+		return s
+	}
+	return "MessageType(" + strconv.Itoa(int(mt)) + ")"
+}
+
+// known reports whether the message type is defined by 9P2000 or one of its
+// supported extensions.
+func (mt MessageType) known() bool {
+	_, ok := messageTypeNames[mt]
+	return ok
+}
+
+// IsRequest reports whether the message type is sent by a client. All 9P
+// protocols and extensions use even numbers for requests, with the response
+// type immediately following the request type, so that types of extensions
+// unknown to this package are classified as well. Terror is not a valid
+// message, and is therefore not considered a request.
+func (mt MessageType) IsRequest() bool {
+	return mt%2 == 0 && mt != Terror
+}
+
+// IsResponse reports whether the message type is sent by a server, which is
+// the case for odd numbers.
+func (mt MessageType) IsResponse() bool {
+	return mt%2 == 1
+}
+
+// ResponseType returns the message type of a successful response to the
+// request type, such as Rwalk for Twalk. Any request may also be answered
+// with Rerror. ResponseType returns 0 if the message type is not a request
+// known to this package.
+func (mt MessageType) ResponseType() MessageType {
+	if !mt.known() || !mt.IsRequest() {
+		return 0
+	}
+	return mt + 1
+}
+
+// ValidReply reports whether resp is a valid response to req under the
+// provided protocol. The response must carry the tag of the request, and be
+// either the type following the request type or an error, which also holds
+// for extensions unknown to this package. Flush requests cannot fail, and
+// are therefore never validly answered with an error.
+func ValidReply(req, resp Message, p Protocol) bool {
+	rt, err := p.MessageType(req)
+	if err != nil || !rt.IsRequest() {
+		return false
+	}
+	st, err := p.MessageType(resp)
+	if err != nil || !st.IsResponse() {
+		return false
+	}
+	if req.GetTag() != resp.GetTag() {
+		return false
+	}
+
+	switch st {
+	case rt + 1:
+		return true
+	case Rerror:
+		return rt != Tflush
+	default:
+		return false
+	}
+}
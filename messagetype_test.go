@@ -0,0 +1,103 @@
+package qp
+
+import "testing"
+
+func TestMessageTypeNames(t *testing.T) {
+	for _, s := range Schemas() {
+		if s.Type.String() != s.Name {
+			t.Errorf("%s: String returned %q", s.Name, s.Type.String())
+		}
+		switch s.Name[0] {
+		case 'T':
+			if !s.Type.IsRequest() || s.Type.IsResponse() {
+				t.Errorf("%s: not classified as a request", s.Name)
+			}
+			if r := s.Type.ResponseType().String(); r != "R"+s.Name[1:] {
+				t.Errorf("%s: response type was %s", s.Name, r)
+			}
+		case 'R':
+			if s.Type.IsRequest() || !s.Type.IsResponse() {
+				t.Errorf("%s: not classified as a response", s.Name)
+			}
+			if r := s.Type.ResponseType(); r != 0 {
+				t.Errorf("%s: response type was %s", s.Name, r)
+			}
+		}
+	}
+
+	if Terror.IsRequest() || Terror.IsResponse() {
+		t.Errorf("Terror classified as request or response")
+	}
+	if s := MessageType(42).String(); s != "MessageType(42)" {
+		t.Errorf("unknown message type returned %q", s)
+	}
+
+	// Types unknown to this package are classified by parity, but have no
+	// known response type.
+	for _, mt := range []MessageType{0, 42, 98, 254} {
+		if !mt.IsRequest() || mt.IsResponse() || mt.ResponseType() != 0 {
+			t.Errorf("unknown %v not classified as a request", mt)
+		}
+		if r := mt + 1; r.IsRequest() || !r.IsResponse() || r.ResponseType() != 0 {
+			t.Errorf("unknown %v not classified as a response", r)
+		}
+	}
+}
+
+// extProtocol is a protocol extension with a request and response type
+// unknown to this package.
+type extProtocol struct{}
+
+type extRequest struct{ *FlushRequest }
+
+type extResponse struct{ *FlushResponse }
+
+func (extProtocol) MessageType(m Message) (MessageType, error) {
+	switch m.(type) {
+	case extRequest:
+		return 150, nil
+	case extResponse:
+		return 151, nil
+	}
+	return NineP2000.MessageType(m)
+}
+
+func (extProtocol) Message(mt MessageType) (Message, error) {
+	return NineP2000.Message(mt)
+}
+
+func TestValidReply(t *testing.T) {
+	tests := []struct {
+		req      Message
+		resp     Message
+		p        Protocol
+		expected bool
+	}{
+		{&WalkRequest{Tag: 1}, &WalkResponse{Tag: 1}, NineP2000, true},
+		{&WalkRequest{Tag: 1}, &ErrorResponse{Tag: 1}, NineP2000, true},
+		{&WalkRequest{Tag: 1}, &WalkResponse{Tag: 2}, NineP2000, false},
+		{&WalkRequest{Tag: 1}, &OpenResponse{Tag: 1}, NineP2000, false},
+		{&WalkResponse{Tag: 1}, &WalkResponse{Tag: 1}, NineP2000, false},
+		{&WalkRequest{Tag: 1}, &WalkRequest{Tag: 1}, NineP2000, false},
+		{&FlushRequest{Tag: 1}, &FlushResponse{Tag: 1}, NineP2000, true},
+		{&FlushRequest{Tag: 1}, &ErrorResponse{Tag: 1}, NineP2000, false},
+		{&VersionRequest{Tag: NOTAG}, &VersionResponse{Tag: NOTAG}, NineP2000, true},
+		{&AuthRequestDotu{Tag: 1}, &ErrorResponseDotu{Tag: 1}, NineP2000Dotu, true},
+		{&AuthRequestDotu{Tag: 1}, &AuthResponse{Tag: 1}, NineP2000, false},
+		{&SessionRequestDote{Tag: NOTAG}, &SessionResponseDote{Tag: NOTAG}, NineP2000Dote, true},
+		{&SimpleReadRequestDote{Tag: 3}, &SimpleReadResponseDote{Tag: 3}, NineP2000Dote, true},
+		{&SimpleWriteRequestDote{Tag: 3}, &ErrorResponse{Tag: 3}, NineP2000Dote, true},
+		{&SimpleWriteRequestDote{Tag: 3}, &SimpleReadResponseDote{Tag: 3}, NineP2000Dote, false},
+		{&SimpleReadRequestDote{Tag: 3}, &SimpleReadResponseDote{Tag: 3}, NineP2000, false},
+		{extRequest{&FlushRequest{Tag: 4}}, extResponse{&FlushResponse{Tag: 4}}, extProtocol{}, true},
+		{extRequest{&FlushRequest{Tag: 4}}, &ErrorResponse{Tag: 4}, extProtocol{}, true},
+		{extRequest{&FlushRequest{Tag: 4}}, &WalkResponse{Tag: 4}, extProtocol{}, false},
+		{extResponse{&FlushResponse{Tag: 4}}, extResponse{&FlushResponse{Tag: 4}}, extProtocol{}, false},
+	}
+
+	for i, tt := range tests {
+		if v := ValidReply(tt.req, tt.resp, tt.p); v != tt.expected {
+			t.Errorf("test %d: %T answered by %T: expected %v, got %v", i, tt.req, tt.resp, tt.expected, v)
+		}
+	}
+}
@@ -0,0 +1,664 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BindFlag controls how a tree is added to a mount point of a Namespace.
+type BindFlag uint32
+
+// Bind flags, with the values used by Plan 9.
+const (
+	// MREPL replaces the mount point with the new tree.
+	MREPL BindFlag = 0x0000
+
+	// MBEFORE adds the new tree to the front of the union directory at the
+	// mount point.
+	MBEFORE BindFlag = 0x0001
+
+	// MAFTER adds the new tree to the end of the union directory at the
+	// mount point.
+	MAFTER BindFlag = 0x0002
+
+	// MCREATE permits files to be created in the new tree when creating in
+	// the union directory.
+	MCREATE BindFlag = 0x0004
+)
+
+var (
+	// ErrNotMounted indicates an attempt to unmount a path that is not a
+	// mount point.
+	ErrNotMounted = errors.New("not mounted")
+
+	// ErrNoCreate indicates an attempt to create a file in a directory that
+	// does not permit it, which is a mount point without a tree bound with
+	// MCREATE, or a tree that is not served over 9P.
+	ErrNoCreate = errors.New("create prohibited")
+)
+
+// nsTree is a directory or file in a tree of a namespace, named by its path
+// within the tree.
+type nsTree struct {
+	fsys fs.FS
+
+	// root is the root of the tree if it is served over 9P, or nil.
+	root *File
+
+	names  []string
+	create bool
+}
+
+// walk returns the tree for the name within the directory.
+func (t nsTree) walk(name string) nsTree {
+	t.names = append(t.names[:len(t.names):len(t.names)], name)
+	return t
+}
+
+// path returns the path of the tree as accepted by its fs.FS.
+func (t nsTree) path() string {
+	if len(t.names) == 0 {
+		return "."
+	}
+	return strings.Join(t.names, "/")
+}
+
+func (t nsTree) stat() (fs.FileInfo, error) {
+	return fs.Stat(t.fsys, t.path())
+}
+
+// nsTarget is a file found by resolving a path in a namespace.
+type nsTarget struct {
+	// union holds the trees providing the file. Unless the file is a mount
+	// point, the union has a single tree.
+	union []nsTree
+
+	// mount is set if the file is a mount point.
+	mount bool
+
+	// file is the file of the first tree of union if the tree is served
+	// over 9P, or nil. Unless taken by setting it to nil, it is closed by
+	// close.
+	file *File
+}
+
+func (r *nsTarget) close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// info returns the file info of the file, named name.
+func (r *nsTarget) info(name string) (fs.FileInfo, error) {
+	if r.file == nil {
+		fi, err := r.union[0].stat()
+		if err != nil {
+			return nil, err
+		}
+		return &nsFileInfo{FileInfo: fi, name: name}, nil
+	}
+	s, err := r.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &nsFileInfo{FileInfo: newFileInfo(s, ""), name: name}, nil
+}
+
+// Namespace composes 9P trees and fs.FS trees into a single path space with
+// the bind semantics of Plan 9. Each mount point holds a union of trees,
+// which are searched in order when walking, and whose directory listings are
+// merged when reading. The first tree must be mounted or bound at "/".
+//
+// Paths name files from the root of the namespace, with ".." resolved
+// lexically, so that ".." of a mount point is the parent of the mount point
+// rather than the parent of the root of the mounted tree. A Namespace is safe
+// for concurrent use.
+type Namespace struct {
+	// mu protects mounts, which maps the cleaned paths of mount points to
+	// their unions. The map is never modified, but replaced on changes.
+	mu     sync.Mutex
+	mounts map[string][]nsTree
+}
+
+// NewNamespace returns an empty namespace.
+func NewNamespace() *Namespace {
+	return &Namespace{mounts: make(map[string][]nsTree)}
+}
+
+// cleanPath returns the names of a path together with its canonical form.
+func cleanPath(path string) ([]string, string) {
+	names := SplitPath("/" + path)
+	return names, "/" + strings.Join(names, "/")
+}
+
+// table returns the current mount table.
+func (ns *Namespace) table() map[string][]nsTree {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.mounts
+}
+
+// resolve walks the names from the root, returning the file with the union
+// of trees that provide it. Unless the file is a mount point, the union has a
+// single tree: the first one in which the name exists. Trees served over 9P
+// are walked one name at a time from the file of the previous name, rather
+// than from their root for every name, and the file reached is kept for use
+// by the caller, which must close the target.
+func (ns *Namespace) resolve(names []string) (*nsTarget, error) {
+	mounts := ns.table()
+	union, ok := mounts["/"]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	// dir is the file of the single tree in union, if it was reached by a
+	// walk over 9P.
+	var dir *File
+	defer func() {
+		if dir != nil {
+			dir.Close()
+		}
+	}()
+
+	path := ""
+	mount := true
+	for _, name := range names {
+		path += "/" + name
+		if u, ok := mounts[path]; ok {
+			union = u
+			mount = true
+			if dir != nil {
+				dir.Close()
+				dir = nil
+			}
+			continue
+		}
+
+		var next []nsTree
+		var file *File
+		for _, t := range union {
+			t = t.walk(name)
+			if t.root == nil {
+				if _, err := t.stat(); err == nil {
+					next = []nsTree{t}
+					break
+				}
+				continue
+			}
+
+			var err error
+			if dir != nil {
+				file, err = dir.Walk(name)
+			} else {
+				file, err = t.root.Walk(t.names...)
+			}
+			if err == nil {
+				next = []nsTree{t}
+				break
+			}
+		}
+		if dir != nil {
+			dir.Close()
+		}
+		dir = file
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		union = next
+		mount = false
+	}
+
+	r := &nsTarget{union: union, mount: mount, file: dir}
+	dir = nil
+	if r.file == nil && union[0].root != nil {
+		f, err := union[0].root.Walk(union[0].names...)
+		if err != nil {
+			return nil, err
+		}
+		r.file = f
+	}
+	return r, nil
+}
+
+// Bind makes the file at the path name available at the path old as well,
+// with flag controlling how it is combined with the files already at old.
+// Directories may only be bound onto directories, and files onto files.
+func (ns *Namespace) Bind(name, old string, flag BindFlag) error {
+	names, _ := cleanPath(name)
+	r, err := ns.resolve(names)
+	if err != nil {
+		return &fs.PathError{Op: "bind", Path: name, Err: err}
+	}
+	r.close()
+	t := r.union[0]
+	t.create = false
+	return ns.mount("bind", t, old, flag)
+}
+
+// Mount mounts the 9P tree of the root file, which is usually obtained from
+// Client.Attach, at the path old. The root file remains owned by the caller.
+func (ns *Namespace) Mount(root *File, old string, flag BindFlag) error {
+	return ns.mount("mount", nsTree{fsys: NewFS(root), root: root}, old, flag)
+}
+
+// MountFS mounts the tree of fsys at the path old. Files cannot be created in
+// such trees.
+func (ns *Namespace) MountFS(fsys fs.FS, old string, flag BindFlag) error {
+	return ns.mount("mount", nsTree{fsys: fsys}, old, flag)
+}
+
+// mount adds a tree to the mount point at the path old.
+func (ns *Namespace) mount(op string, t nsTree, old string, flag BindFlag) error {
+	fi, err := t.stat()
+	if err != nil {
+		return &fs.PathError{Op: op, Path: old, Err: err}
+	}
+	t.create = flag&MCREATE != 0
+
+	names, path := cleanPath(old)
+	var cur []nsTree
+	if len(ns.table()) > 0 || path != "/" {
+		r, err := ns.resolve(names)
+		if err != nil {
+			return &fs.PathError{Op: op, Path: old, Err: err}
+		}
+		cfi, err := r.info(baseName(path))
+		r.close()
+		cur = r.union
+		if err != nil {
+			return &fs.PathError{Op: op, Path: old, Err: err}
+		}
+		switch {
+		case fi.IsDir() && !cfi.IsDir():
+			return &fs.PathError{Op: op, Path: old, Err: ErrNotDirectory}
+		case !fi.IsDir() && cfi.IsDir():
+			return &fs.PathError{Op: op, Path: old, Err: ErrIsDirectory}
+		}
+	}
+	if !fi.IsDir() && flag&(MBEFORE|MAFTER) != 0 {
+		return &fs.PathError{Op: op, Path: old, Err: ErrNotDirectory}
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	// A mount point that is not yet a union starts out with the tree that
+	// provided it, as found by the walk.
+	union, ok := ns.mounts[path]
+	if !ok && len(cur) > 0 {
+		union = cur[:1]
+	}
+	switch {
+	case flag&MBEFORE != 0:
+		union = append([]nsTree{t}, union...)
+	case flag&MAFTER != 0:
+		union = append(union[:len(union):len(union)], t)
+	default:
+		union = []nsTree{t}
+	}
+
+	mounts := make(map[string][]nsTree, len(ns.mounts)+1)
+	for k, v := range ns.mounts {
+		mounts[k] = v
+	}
+	mounts[path] = union
+	ns.mounts = mounts
+	return nil
+}
+
+// Unmount removes all trees mounted or bound at the path old.
+func (ns *Namespace) Unmount(old string) error {
+	_, path := cleanPath(old)
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if _, ok := ns.mounts[path]; !ok {
+		return &fs.PathError{Op: "unmount", Path: old, Err: ErrNotMounted}
+	}
+	mounts := make(map[string][]nsTree, len(ns.mounts))
+	for k, v := range ns.mounts {
+		if k != path {
+			mounts[k] = v
+		}
+	}
+	ns.mounts = mounts
+	return nil
+}
+
+// baseName returns the name of the file at the canonical path.
+func baseName(path string) string {
+	if path == "/" {
+		return path
+	}
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// stat returns the file info of the file at the path, named by the last
+// element of the path.
+func (ns *Namespace) stat(names []string, name string) (fs.FileInfo, error) {
+	r, err := ns.resolve(names)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+	return r.info(name)
+}
+
+// Stat returns the file info of the file at the path.
+func (ns *Namespace) Stat(path string) (fs.FileInfo, error) {
+	names, clean := cleanPath(path)
+	fi, err := ns.stat(names, baseName(clean))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return fi, nil
+}
+
+// readDir returns the merged entries of the union directory at the path,
+// sorted by name.
+func (ns *Namespace) readDir(names []string, path string) ([]fs.DirEntry, error) {
+	r, err := ns.resolve(names)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+	return ns.readUnion(r, names, path)
+}
+
+// readUnion returns the merged entries of the resolved union directory at
+// the path, sorted by name. Entries of the same name in later trees are
+// hidden by the earlier ones, just as they are when walking. The file of the
+// target is opened to read the first tree.
+func (ns *Namespace) readUnion(r *nsTarget, names []string, path string) ([]fs.DirEntry, error) {
+	mounts := ns.table()
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for i, t := range r.union {
+		var list []fs.DirEntry
+		var err error
+		if i == 0 && r.file != nil {
+			list, err = r.entries()
+		} else {
+			list, err = fs.ReadDir(t.fsys, t.path())
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range list {
+			if seen[e.Name()] {
+				continue
+			}
+			seen[e.Name()] = true
+
+			// Mount points are listed as the file mounted on them.
+			child := strings.TrimSuffix(path, "/") + "/" + e.Name()
+			if _, ok := mounts[child]; ok {
+				fi, err := ns.stat(append(names[:len(names):len(names)], e.Name()), e.Name())
+				if err != nil {
+					return nil, err
+				}
+				e = fs.FileInfoToDirEntry(fi)
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadDir returns the entries of the directory at the path, sorted by name.
+// The entries of union directories are merged.
+func (ns *Namespace) ReadDir(path string) ([]fs.DirEntry, error) {
+	names, clean := cleanPath(path)
+	entries, err := ns.readDir(names, clean)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	return entries, nil
+}
+
+// entries opens the file of the target for reading and returns its
+// directory entries.
+func (r *nsTarget) entries() ([]fs.DirEntry, error) {
+	if r.file.qid.Type&QTDIR == 0 {
+		return nil, ErrNotDirectory
+	}
+	if err := r.file.Open(OREAD); err != nil {
+		return nil, err
+	}
+	stats, err := r.file.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(stats))
+	for i := range stats {
+		entries[i] = fs.FileInfoToDirEntry(newFileInfo(&stats[i], ""))
+	}
+	return entries, nil
+}
+
+// ReadFile reads the file at the path.
+func (ns *Namespace) ReadFile(path string) ([]byte, error) {
+	names, _ := cleanPath(path)
+	r, err := ns.resolve(names)
+	if err != nil {
+		return nil, pathError("readfile", path, err)
+	}
+	defer r.close()
+
+	if r.file == nil {
+		b, err := fs.ReadFile(r.union[0].fsys, r.union[0].path())
+		if err != nil {
+			return nil, pathError("readfile", path, err)
+		}
+		return b, nil
+	}
+	if r.file.qid.Type&QTDIR != 0 {
+		return nil, &fs.PathError{Op: "readfile", Path: path, Err: ErrIsDirectory}
+	}
+	if err := r.file.Open(OREAD); err != nil {
+		return nil, pathError("readfile", path, err)
+	}
+	var buf bytes.Buffer
+	if _, err := r.file.WriteTo(&buf); err != nil {
+		return nil, pathError("readfile", path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// open opens the file at the path for reading, named by the last element of
+// the path.
+func (ns *Namespace) open(names []string, path, name string) (fs.File, error) {
+	r, err := ns.resolve(names)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+	fi, err := r.info(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		entries, err := ns.readUnion(r, names, path)
+		if err != nil {
+			return nil, err
+		}
+		return &nsDir{info: fi, entries: entries}, nil
+	}
+	if r.file == nil {
+		f, err := r.union[0].fsys.Open(r.union[0].path())
+		if err != nil {
+			return nil, err
+		}
+		return &nsFile{File: f, info: fi}, nil
+	}
+	if err := r.file.Open(OREAD); err != nil {
+		return nil, err
+	}
+	f := &fsFile{File: r.file, name: path}
+	r.file = nil
+	return &nsFile{File: f, info: fi}, nil
+}
+
+// Open opens the file at the path for reading. Directories implement
+// fs.ReadDirFile, listing the merged entries of union directories.
+func (ns *Namespace) Open(path string) (fs.File, error) {
+	names, clean := cleanPath(path)
+	f, err := ns.open(names, clean, baseName(clean))
+	if err != nil {
+		return nil, pathError("open", path, err)
+	}
+	return f, nil
+}
+
+// Create creates a file at the path with the provided permissions, opened
+// with the provided mode. In a mount point, including a union directory, the
+// file is created in the first tree bound with MCREATE, and creation fails
+// if there is none. Other directories permit creation regardless of MCREATE.
+// The tree must be served over 9P.
+func (ns *Namespace) Create(path string, perm FileMode, mode OpenMode) (*File, error) {
+	dir, name, err := splitParent("create", path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ns.resolve(dir)
+	if err != nil {
+		return nil, pathError("create", path, err)
+	}
+	defer r.close()
+
+	i := 0
+	if r.mount {
+		for i = 0; i < len(r.union) && !r.union[i].create; i++ {
+		}
+	}
+	if i == len(r.union) || r.union[i].root == nil {
+		return nil, &fs.PathError{Op: "create", Path: path, Err: ErrNoCreate}
+	}
+
+	f := r.file
+	if i == 0 {
+		r.file = nil
+	} else {
+		t := r.union[i]
+		if f, err = t.root.Walk(t.names...); err != nil {
+			return nil, pathError("create", path, err)
+		}
+	}
+	if err := f.Create(name, perm, mode); err != nil {
+		f.Close()
+		return nil, pathError("create", path, err)
+	}
+	return f, nil
+}
+
+// FS returns a view of the namespace as a fs.FS, which implements
+// fs.StatFS, fs.ReadDirFS and fs.ReadFileFS. Names are relative to the root
+// of the namespace, and must be valid according to fs.ValidPath.
+func (ns *Namespace) FS() fs.FS {
+	return nsFS{ns}
+}
+
+// nsFS implements Namespace.FS.
+type nsFS struct {
+	ns *Namespace
+}
+
+func (fsys nsFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	names, clean := cleanPath(name)
+	f, err := fsys.ns.open(names, clean, fsBaseName(name))
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+
+func (fsys nsFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := fsys.ns.stat(SplitPath(name), fsBaseName(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+func (fsys nsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.ns.ReadDir(name)
+}
+
+func (fsys nsFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.ns.ReadFile(name)
+}
+
+// fsBaseName returns the last element of a name valid for fs.FS.
+func fsBaseName(name string) string {
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
+
+// nsFileInfo renames the file info of a file to its name in the namespace.
+type nsFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *nsFileInfo) Name() string { return fi.name }
+
+// nsFile is a file opened through a namespace.
+type nsFile struct {
+	fs.File
+	info fs.FileInfo
+}
+
+func (f *nsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// nsDir is a directory opened through a namespace, holding the entries read
+// when it was opened.
+type nsDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *nsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *nsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: ErrIsDirectory}
+}
+
+func (d *nsDir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *nsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	count := len(d.entries)
+	if n > 0 && count > n {
+		count = n
+	}
+	entries := d.entries[:count:count]
+	d.entries = d.entries[count:]
+	if n > 0 && count == 0 {
+		return entries, io.EOF
+	}
+	return entries, nil
+}
@@ -0,0 +1,244 @@
+package qp
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func entryNames(entries []fs.DirEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestNamespace(t *testing.T) {
+	local := fstest.MapFS{
+		"bin/ls":          {Data: []byte("local ls")},
+		"bin/cat":         {Data: []byte("local cat")},
+		"n/remote/.keep":  {Data: nil},
+		"tmp/local":       {Data: []byte("local tmp")},
+		"lib/profile":     {Data: []byte("profile")},
+		"lib/ndb/local":   {Data: []byte("ndb")},
+		"mnt/placeholder": {Data: nil},
+	}
+
+	rfs := newRamFS()
+	rfs.add("bin/ls", 0755, []byte("remote ls"))
+	rfs.add("bin/rc", 0755, []byte("remote rc"))
+	rfs.add("usr/glenda/file", 0644, []byte("remote file"))
+	_, remote := rfs.attach(t, Version)
+
+	scratch := newRamFS()
+	scratch.add("existing", 0644, []byte("scratch"))
+	_, tmp := scratch.attach(t, Version)
+
+	ns := NewNamespace()
+	if _, err := ns.Stat("/"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected empty namespace to have no root, got %v", err)
+	}
+	if err := ns.MountFS(local, "/", MREPL); err != nil {
+		t.Fatalf("mount of root failed: %v", err)
+	}
+	if err := ns.Mount(remote, "/n/remote", MREPL); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+	if err := ns.Bind("/n/remote/bin", "/bin", MAFTER); err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	if err := ns.Mount(tmp, "/tmp", MBEFORE|MCREATE); err != nil {
+		t.Fatalf("mount of tmp failed: %v", err)
+	}
+
+	for path, expected := range map[string]string{
+		"/n/remote/usr/glenda/file": "remote file",
+		"/bin/ls":                   "local ls",
+		"/bin/rc":                   "remote rc",
+		"/tmp/local":                "local tmp",
+		"/tmp/existing":             "scratch",
+		// ".." is resolved in the namespace rather than in the mounted tree.
+		"/n/remote/usr/../../remote/usr/glenda/file": "remote file",
+		"/n/remote/../../lib/profile":                "profile",
+	} {
+		if b, err := ns.ReadFile(path); err != nil || string(b) != expected {
+			t.Errorf("%s: expected %q, got %q, %v", path, expected, b, err)
+		}
+	}
+
+	entries, err := ns.ReadDir("/bin")
+	if expected := []string{"cat", "ls", "rc"}; err != nil || !reflect.DeepEqual(entryNames(entries), expected) {
+		t.Errorf("expected union of %v, got %v, %v", expected, entryNames(entries), err)
+	}
+	if fi, err := ns.Stat("/n/remote"); err != nil || fi.Name() != "remote" || !fi.IsDir() {
+		t.Errorf("unexpected stat of mount point: %v, %v", fi, err)
+	}
+
+	// Files are created in the tree bound with MCREATE.
+	f, err := ns.Create("/tmp/new", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f.Write([]byte("created"))
+	f.Close()
+	if n := scratch.lookup("new"); n == nil || string(n.data) != "created" {
+		t.Error("expected file to be created in scratch tree")
+	}
+	if _, err := ns.Create("/bin/new", 0644, OWRITE); !errors.Is(err, ErrNoCreate) {
+		t.Errorf("expected ErrNoCreate for union without MCREATE, got %v", err)
+	}
+	if _, err := ns.Create("/lib/new", 0644, OWRITE); !errors.Is(err, ErrNoCreate) {
+		t.Errorf("expected ErrNoCreate for local tree, got %v", err)
+	}
+	if f, err := ns.Create("/n/remote/usr/new", 0644, OWRITE); err != nil {
+		t.Errorf("create in mounted tree failed: %v", err)
+	} else {
+		f.Close()
+	}
+
+	// Files may be bound onto files, but not onto directories.
+	if err := ns.Bind("/bin/rc", "/lib/profile", MREPL); err != nil {
+		t.Errorf("bind of file failed: %v", err)
+	}
+	if b, err := ns.ReadFile("/lib/profile"); err != nil || string(b) != "remote rc" {
+		t.Errorf("expected bound file, got %q, %v", b, err)
+	}
+	if err := ns.Bind("/bin/rc", "/lib", MREPL); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected ErrIsDirectory, got %v", err)
+	}
+	if err := ns.Bind("/bin", "/lib/ndb/local", MREPL); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("expected ErrNotDirectory, got %v", err)
+	}
+	if err := ns.Bind("/nope", "/lib", MREPL); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	if err := fstest.TestFS(ns.FS(),
+		"bin/cat", "bin/ls", "bin/rc", "lib/profile", "lib/ndb/local",
+		"n/remote/bin/ls", "n/remote/usr/glenda/file", "tmp/existing", "tmp/local", "tmp/new",
+	); err != nil {
+		t.Error(err)
+	}
+
+	if err := ns.Unmount("/bin"); err != nil {
+		t.Fatalf("unmount failed: %v", err)
+	}
+	if _, err := ns.Stat("/bin/rc"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected unmounted file to be gone, got %v", err)
+	}
+	if err := ns.Unmount("/bin"); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("expected ErrNotMounted, got %v", err)
+	}
+}
+
+func TestNamespaceUnionOrder(t *testing.T) {
+	a := fstest.MapFS{"dir/file": {Data: []byte("a")}, "dir/a": {}}
+	b := fstest.MapFS{"file": {Data: []byte("b")}, "b": {}}
+
+	for _, tt := range []struct {
+		flag     BindFlag
+		expected string
+	}{
+		{MREPL, "b"},
+		{MBEFORE, "b"},
+		{MAFTER, "a"},
+	} {
+		ns := NewNamespace()
+		if err := ns.MountFS(a, "/", MREPL); err != nil {
+			t.Fatalf("mount failed: %v", err)
+		}
+		if err := ns.MountFS(b, "/dir", tt.flag); err != nil {
+			t.Fatalf("mount failed: %v", err)
+		}
+		if data, err := ns.ReadFile("/dir/file"); err != nil || string(data) != tt.expected {
+			t.Errorf("flag %d: expected %q, got %q, %v", tt.flag, tt.expected, data, err)
+		}
+
+		entries, err := ns.ReadDir("/dir")
+		expected := []string{"a", "b", "file"}
+		if tt.flag == MREPL {
+			expected = []string{"b", "file"}
+		}
+		if err != nil || !reflect.DeepEqual(entryNames(entries), expected) {
+			t.Errorf("flag %d: expected %v, got %v, %v", tt.flag, expected, entryNames(entries), err)
+		}
+	}
+}
+
+func TestNamespaceResolveWalks(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("a/b/c/d/e/f/g/h/file", 0644, nil)
+	_, root := rfs.attach(t, Version)
+
+	ns := NewNamespace()
+	if err := ns.Mount(root, "/", MREPL); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+
+	// Each name is walked once from the previous one, and the file reached
+	// is used by the operation. Create only walks to the directory.
+	path := "/a/b/c/d/e/f/g/h/file"
+	walks := map[string]int{"stat": 9, "readfile": 9, "open": 9, "create": 8}
+	for op, fn := range map[string]func() error{
+		"stat":     func() error { _, err := ns.Stat(path); return err },
+		"readfile": func() error { _, err := ns.ReadFile(path); return err },
+		"open": func() error {
+			f, err := ns.Open(path)
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+		"create": func() error {
+			f, err := ns.Create("/a/b/c/d/e/f/g/h/new", 0644, OWRITE)
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+	} {
+		before := rfs.count(Twalk)
+		if err := fn(); err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if n := rfs.count(Twalk) - before; n != walks[op] {
+			t.Errorf("%s: expected %d walks, got %d", op, walks[op], n)
+		}
+	}
+}
+
+func TestNamespaceCreateMountPoint(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("dir/file", 0644, nil)
+	_, root := rfs.attach(t, Version)
+
+	// Mount points forbid creation unless bound with MCREATE, even if they
+	// hold a single tree.
+	ns := NewNamespace()
+	if err := ns.Mount(root, "/", MREPL); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+	if err := ns.Bind("/", "/dir", MREPL); err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	for _, path := range []string{"/new", "/dir/new"} {
+		if _, err := ns.Create(path, 0644, OWRITE); !errors.Is(err, ErrNoCreate) {
+			t.Errorf("%s: expected ErrNoCreate, got %v", path, err)
+		}
+	}
+
+	if err := ns.Bind("/", "/dir", MREPL|MCREATE); err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	f, err := ns.Create("/dir/new", 0644, OWRITE)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f.Close()
+	if rfs.lookup("new") == nil {
+		t.Error("expected file to be created in bound tree")
+	}
+}
@@ -0,0 +1,78 @@
+package qp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os/user"
+	"strconv"
+)
+
+// ErrNoPeerCred indicates a connection whose peer credentials are not
+// available, as only unix sockets provide them, and only on some systems.
+var ErrNoPeerCred = errors.New("peer credentials not available")
+
+// PeerCred holds the credentials of the process at the other end of a unix
+// socket, as reported by the kernel when the connection was established.
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// connPeerCred returns the peer credentials of a connection, unwrapping
+// negotiated connections.
+func connPeerCred(rw io.ReadWriteCloser) (*PeerCred, error) {
+	if c, ok := rw.(*Conn); ok {
+		rw = c.Conn
+	}
+	uc, ok := rw.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNoPeerCred
+	}
+	return peerCred(uc)
+}
+
+// username returns the name of the user of the credentials, or the decimal
+// user ID if the user is unknown.
+func (cred *PeerCred) username() string {
+	uid := strconv.FormatUint(uint64(cred.UID), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// CheckPeerCred is a Server.Credentials policy that only permits attaches
+// as the user at the other end of the connection. For 9P2000.u, a numeric
+// user ID, if provided, identifies the user instead of the user name, which
+// clients such as the Linux kernel often leave empty or set to "nobody", and
+// the attach proceeds as the user of the credentials. Otherwise, the user
+// name must be the name of that user. Attaches over connections without peer
+// credentials are rejected.
+func CheckPeerCred(cred *PeerCred, uname string, uidno uint32) (string, error) {
+	if cred == nil {
+		return "", ErrNoPeerCred
+	}
+	if uidno != NONUNAME {
+		if uidno != cred.UID {
+			return "", fs.ErrPermission
+		}
+		return cred.username(), nil
+	}
+	if uname != cred.username() {
+		return "", fs.ErrPermission
+	}
+	return uname, nil
+}
+
+// OverridePeerCred is a Server.Credentials policy that attaches as the user
+// at the other end of the connection, regardless of the user name requested.
+// Attaches over connections without peer credentials are rejected.
+func OverridePeerCred(cred *PeerCred, uname string, uidno uint32) (string, error) {
+	if cred == nil {
+		return "", ErrNoPeerCred
+	}
+	return cred.username(), nil
+}
@@ -0,0 +1,107 @@
+package qp
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// unameServer records the user names of attaches.
+type unameServer struct {
+	*ramServer
+
+	mu     sync.Mutex
+	unames []string
+}
+
+func (us *unameServer) Attach(uname, aname string) (Node, error) {
+	us.mu.Lock()
+	us.unames = append(us.unames, uname)
+	us.mu.Unlock()
+	return us.ramServer.Attach(uname, aname)
+}
+
+func (us *unameServer) last() string {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.unames[len(us.unames)-1]
+}
+
+func TestServerPeerCred(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skipf("current user unknown: %v", err)
+	}
+	us := &unameServer{ramServer: newRamServer(newRamFS())}
+
+	// serve returns the address of a server using the policy.
+	serve := func(policy func(*PeerCred, string, uint32) (string, error)) (*Server, string) {
+		srv := &Server{FS: us, Credentials: policy}
+		t.Cleanup(func() { srv.Close() })
+		l, err := Listen("unix!" + filepath.Join(t.TempDir(), "sock"))
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		go srv.Serve(l)
+		return srv, "unix!" + l.Addr().String()
+	}
+
+	var addr string
+	attach := func(version, uname string) error {
+		d := &Dialer{Version: version}
+		conn, err := d.Dial(addr)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		c := NewClientConn(conn)
+		defer c.Close()
+		_, err = c.Attach(nil, uname, "")
+		return err
+	}
+
+	_, addr = serve(CheckPeerCred)
+	if err := attach(Version, me.Username); err != nil {
+		t.Errorf("attach as peer failed: %v", err)
+	}
+	if err := attach(Version, "other"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected attach as other user to be denied, got %v", err)
+	}
+
+	// The numeric user ID of 9P2000.u attaches must match as well.
+	if err := attach(VersionDotu, me.Username); err != nil {
+		t.Errorf("attach as peer failed: %v", err)
+	}
+	conn, err := (&Dialer{Version: VersionDotu}).Dial(addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	c := NewClientConn(conn)
+	defer c.Close()
+	_, err = c.RPC(&AttachRequestDotu{Fid: 1, AuthFid: NOFID, Username: me.Username, UIDno: uint32(os.Getuid()) + 1})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected attach with other uid to be denied, got %v", err)
+	}
+
+	// A matching user ID stands in for the user name, as sent by v9fs.
+	for i, uname := range []string{"nobody", ""} {
+		_, err = c.RPC(&AttachRequestDotu{Fid: Fid(2 + i), AuthFid: NOFID, Username: uname, UIDno: uint32(os.Getuid())})
+		if err != nil || us.last() != me.Username {
+			t.Errorf("%q: expected attach as %s, got %s, %v", uname, me.Username, us.last(), err)
+		}
+	}
+
+	srv, addr := serve(OverridePeerCred)
+	if err := attach(Version, "other"); err != nil || us.last() != me.Username {
+		t.Errorf("expected attach as %s, got %s, %v", me.Username, us.last(), err)
+	}
+
+	// Connections other than unix sockets have no credentials.
+	pc := serverClient(t, srv, Version)
+	if _, err := pc.Attach(nil, me.Username, ""); err == nil || err.Error() != ErrNoPeerCred.Error() {
+		t.Errorf("expected ErrNoPeerCred, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package qp
+
+import "net"
+
+// peerCred reports that peer credentials are not supported on this system.
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, ErrNoPeerCred
+}
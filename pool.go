@@ -0,0 +1,293 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPoolExhausted indicates that all identifiers in a pool are in use.
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// poolShards is the amount of shards an idPool is split into. Identifiers are
+// assigned to shards by their value, so that Put only ever contends with
+// operations on the same shard.
+const poolShards = 16
+
+// poolShard holds the free list and in-use set of a subset of identifiers.
+type poolShard struct {
+	sync.Mutex
+
+	// free are released identifiers ready for reuse.
+	free []uint32
+
+	// inuse maps allocated identifiers to the program counters of the
+	// allocating call stack, or nil if tracing is disabled.
+	inuse map[uint32][]uintptr
+}
+
+// idPool is a sharded allocator of identifiers in the range [0, limit). New
+// identifiers are handed out sequentially, after which released identifiers
+// are reused.
+type idPool struct {
+	// next is the next identifier that has never been allocated.
+	next atomic.Uint64
+
+	// rr is used to spread free list lookups across shards.
+	rr atomic.Uint32
+
+	// waiters is the amount of goroutines blocked in wait.
+	waiters atomic.Int32
+
+	shards [poolShards]poolShard
+
+	// mu protects wake.
+	mu sync.Mutex
+
+	// wake is closed and replaced when an identifier is released while
+	// goroutines are waiting.
+	wake chan struct{}
+}
+
+// mark records an identifier as in use. If trace is set, the call stack is
+// recorded, skipping depth frames above the exported allocation method.
+func (p *idPool) mark(sh *poolShard, id uint32, trace bool, depth int) {
+	if sh.inuse == nil {
+		sh.inuse = make(map[uint32][]uintptr)
+	}
+	var pcs []uintptr
+	if trace {
+		pcs = make([]uintptr, 32)
+		pcs = pcs[:runtime.Callers(4+depth, pcs)]
+	}
+	sh.inuse[id] = pcs
+}
+
+func (p *idPool) get(limit uint64, trace bool, depth int) (uint32, error) {
+	start := p.rr.Add(1)
+	for i := uint32(0); i < poolShards; i++ {
+		sh := &p.shards[(start+i)%poolShards]
+		sh.Lock()
+		if n := len(sh.free); n > 0 {
+			id := sh.free[n-1]
+			sh.free = sh.free[:n-1]
+			p.mark(sh, id, trace, depth)
+			sh.Unlock()
+			return id, nil
+		}
+		sh.Unlock()
+	}
+
+	if n := p.next.Add(1) - 1; n < limit {
+		id := uint32(n)
+		sh := &p.shards[id%poolShards]
+		sh.Lock()
+		p.mark(sh, id, trace, depth)
+		sh.Unlock()
+		return id, nil
+	}
+
+	// Keep next from eventually wrapping around.
+	p.next.Store(limit)
+	return 0, ErrPoolExhausted
+}
+
+func (p *idPool) wait(ctx context.Context, limit uint64, trace bool) (uint32, error) {
+	for {
+		if id, err := p.get(limit, trace, 1); err == nil {
+			return id, nil
+		}
+
+		// Register as a waiter before retrying, so that a concurrent put
+		// either makes the identifier visible to the retry or wakes us.
+		p.mu.Lock()
+		if p.wake == nil {
+			p.wake = make(chan struct{})
+		}
+		wake := p.wake
+		p.waiters.Add(1)
+		p.mu.Unlock()
+
+		id, err := p.get(limit, trace, 1)
+		if err == nil {
+			p.waiters.Add(-1)
+			return id, nil
+		}
+
+		select {
+		case <-wake:
+			p.waiters.Add(-1)
+		case <-ctx.Done():
+			p.waiters.Add(-1)
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (p *idPool) put(id uint32) bool {
+	sh := &p.shards[id%poolShards]
+	sh.Lock()
+	if _, ok := sh.inuse[id]; !ok {
+		sh.Unlock()
+		return false
+	}
+	delete(sh.inuse, id)
+	sh.free = append(sh.free, id)
+	sh.Unlock()
+
+	if p.waiters.Load() > 0 {
+		p.mu.Lock()
+		if p.wake != nil {
+			close(p.wake)
+			p.wake = nil
+		}
+		p.mu.Unlock()
+	}
+	return true
+}
+
+func (p *idPool) inUse() []uint32 {
+	var ids []uint32
+	for i := range p.shards {
+		sh := &p.shards[i]
+		sh.Lock()
+		for id := range sh.inuse {
+			ids = append(ids, id)
+		}
+		sh.Unlock()
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (p *idPool) where(id uint32) string {
+	sh := &p.shards[id%poolShards]
+	sh.Lock()
+	pcs := sh.inuse[id]
+	sh.Unlock()
+
+	if len(pcs) == 0 {
+		return ""
+	}
+
+	var lines []string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		lines = append(lines, f.Function+"\n\t"+f.File+":"+strconv.Itoa(f.Line))
+		if !more {
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TagPool allocates unique tags for requests. NOTAG is never handed out. The
+// zero value is ready to use, and a TagPool may be used concurrently from
+// arbitrary goroutines.
+type TagPool struct {
+	// Trace enables leak detection, recording the call stack of every
+	// allocation for retrieval with Where. It must be set before the pool is
+	// first used.
+	Trace bool
+
+	// reserved is the amount of tags below NOTAG that are never handed out,
+	// left for the owner of the pool to use as it sees fit.
+	reserved Tag
+
+	pool idPool
+}
+
+// limit returns the end of the range of tags handed out.
+func (tp *TagPool) limit() uint64 {
+	return uint64(NOTAG - tp.reserved)
+}
+
+// Get allocates a tag, returning ErrPoolExhausted if all tags are in use.
+func (tp *TagPool) Get() (Tag, error) {
+	id, err := tp.pool.get(tp.limit(), tp.Trace, 0)
+	return Tag(id), err
+}
+
+// Wait allocates a tag, blocking until a tag is released if all tags are in
+// use, or until the context is done.
+func (tp *TagPool) Wait(ctx context.Context) (Tag, error) {
+	id, err := tp.pool.wait(ctx, tp.limit(), tp.Trace)
+	return Tag(id), err
+}
+
+// Put releases a tag for reuse. Put panics if the tag is not in use.
+func (tp *TagPool) Put(t Tag) {
+	if !tp.pool.put(uint32(t)) {
+		panic("qp: Put of unallocated tag")
+	}
+}
+
+// InUse returns all currently allocated tags in ascending order.
+func (tp *TagPool) InUse() []Tag {
+	ids := tp.pool.inUse()
+	tags := make([]Tag, len(ids))
+	for i, id := range ids {
+		tags[i] = Tag(id)
+	}
+	return tags
+}
+
+// Where returns the call stack that allocated the tag if Trace is enabled,
+// or an empty string otherwise.
+func (tp *TagPool) Where(t Tag) string {
+	return tp.pool.where(uint32(t))
+}
+
+// FidPool allocates unique fids. NOFID is never handed out. The zero value is
+// ready to use, and a FidPool may be used concurrently from arbitrary
+// goroutines.
+type FidPool struct {
+	// Trace enables leak detection, recording the call stack of every
+	// allocation for retrieval with Where. It must be set before the pool is
+	// first used.
+	Trace bool
+
+	pool idPool
+}
+
+// Get allocates a fid, returning ErrPoolExhausted if all fids are in use.
+func (fp *FidPool) Get() (Fid, error) {
+	id, err := fp.pool.get(uint64(NOFID), fp.Trace, 0)
+	return Fid(id), err
+}
+
+// Wait allocates a fid, blocking until a fid is released if all fids are in
+// use, or until the context is done.
+func (fp *FidPool) Wait(ctx context.Context) (Fid, error) {
+	id, err := fp.pool.wait(ctx, uint64(NOFID), fp.Trace)
+	return Fid(id), err
+}
+
+// Put releases a fid for reuse. Put panics if the fid is not in use.
+func (fp *FidPool) Put(f Fid) {
+	if !fp.pool.put(uint32(f)) {
+		panic("qp: Put of unallocated fid")
+	}
+}
+
+// InUse returns all currently allocated fids in ascending order.
+func (fp *FidPool) InUse() []Fid {
+	ids := fp.pool.inUse()
+	fids := make([]Fid, len(ids))
+	for i, id := range ids {
+		fids[i] = Fid(id)
+	}
+	return fids
+}
+
+// Where returns the call stack that allocated the fid if Trace is enabled,
+// or an empty string otherwise.
+func (fp *FidPool) Where(f Fid) string {
+	return fp.pool.where(uint32(f))
+}
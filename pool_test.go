@@ -0,0 +1,130 @@
+package qp
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTagPoolExhaustion(t *testing.T) {
+	var tp TagPool
+	seen := make(map[Tag]bool)
+	for i := 0; i < int(NOTAG); i++ {
+		tag, err := tp.Get()
+		if err != nil {
+			t.Fatalf("allocation %d failed: %v", i, err)
+		}
+		if tag == NOTAG || seen[tag] {
+			t.Fatalf("allocation %d returned invalid or duplicate tag %d", i, tag)
+		}
+		seen[tag] = true
+	}
+
+	if _, err := tp.Get(); err != ErrPoolExhausted {
+		t.Fatalf("expected ErrPoolExhausted, got %v", err)
+	}
+	if n := len(tp.InUse()); n != int(NOTAG) {
+		t.Fatalf("expected %d tags in use, got %d", NOTAG, n)
+	}
+
+	// A blocked Wait must complete once a tag is released.
+	done := make(chan Tag)
+	go func() {
+		tag, err := tp.Wait(context.Background())
+		if err != nil {
+			t.Errorf("wait failed: %v", err)
+		}
+		done <- tag
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait returned while pool was exhausted")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	tp.Put(1234)
+	select {
+	case tag := <-done:
+		if tag != 1234 {
+			t.Errorf("expected tag 1234, got %d", tag)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait never returned")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tp.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestFidPoolConcurrent(t *testing.T) {
+	var (
+		fp FidPool
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	held := make(map[Fid]bool)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				fid, err := fp.Get()
+				if err != nil {
+					t.Errorf("allocation failed: %v", err)
+					return
+				}
+				mu.Lock()
+				if held[fid] {
+					t.Errorf("fid %d allocated twice", fid)
+				}
+				held[fid] = true
+				mu.Unlock()
+
+				runtime.Gosched()
+
+				mu.Lock()
+				delete(held, fid)
+				mu.Unlock()
+				fp.Put(fid)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(fp.InUse()); n != 0 {
+		t.Errorf("expected no fids in use, got %d", n)
+	}
+}
+
+func TestPoolTrace(t *testing.T) {
+	fp := FidPool{Trace: true}
+	fid, _ := fp.Get()
+	if w := fp.Where(fid); !strings.Contains(w, "TestPoolTrace") {
+		t.Errorf("allocation site not recorded:\n%s", w)
+	}
+
+	var tp TagPool
+	tag, _ := tp.Get()
+	if w := tp.Where(tag); w != "" {
+		t.Errorf("allocation site recorded without tracing:\n%s", w)
+	}
+	if inuse := tp.InUse(); len(inuse) != 1 || inuse[0] != tag {
+		t.Errorf("unexpected tags in use: %v", inuse)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("double Put did not panic")
+		}
+	}()
+	tp.Put(tag)
+	tp.Put(tag)
+}
@@ -0,0 +1,690 @@
+package qp
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ramNode is a file or directory in a ramFS.
+type ramNode struct {
+	name     string
+	mode     FileMode
+	qid      Qid
+	mtime    uint32
+	data     []byte
+	parent   *ramNode
+	children []*ramNode
+
+	// stream, if set, makes reads ignore the offset and consume the data
+	// from the front, like a device or an event file.
+	stream bool
+}
+
+func (n *ramNode) stat() Stat {
+	s := Stat{
+		Qid:   n.qid,
+		Mode:  n.mode,
+		Atime: n.mtime,
+		Mtime: n.mtime,
+		Name:  n.name,
+		UID:   "glenda",
+		GID:   "glenda",
+		MUID:  "glenda",
+	}
+	if n.mode&DMDIR == 0 {
+		s.Length = uint64(len(n.data))
+	}
+	return s
+}
+
+func (n *ramNode) child(name string) *ramNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ramFS is a minimal in-memory 9P file server used to test the client. It
+// handles each request in its own goroutine, like a real server would.
+type ramFS struct {
+	mu   sync.Mutex
+	root *ramNode
+	path uint64
+
+	// msize is the maximum message size offered by the server.
+	msize uint32
+
+	// iounit is returned for all opened files.
+	iounit uint32
+
+	// requests counts the requests handled, per message type.
+	requests map[MessageType]int
+
+	// short, if set, limits the amount of data returned by a read or
+	// accepted by a write at the provided offset, to simulate short
+	// transfers.
+	short func(offset uint64, count uint32) uint32
+
+	// hold, if set, is called before handling each request, and may block
+	// to keep the request in flight.
+	hold func(m Message)
+
+	// key, if set, is the session key of all 9P2000.e connections. The fid
+	// tables of such connections are kept in sessions after the connection
+	// closes, to be resumed with Tsession.
+	key      *[8]byte
+	sessions map[[8]byte]map[Fid]*ramFid
+}
+
+func newRamFS() *ramFS {
+	fs := &ramFS{
+		msize:    8192,
+		requests: make(map[MessageType]int),
+		sessions: make(map[[8]byte]map[Fid]*ramFid),
+	}
+	fs.root = fs.newNode("/", DMDIR|0777)
+	fs.root.parent = fs.root
+	return fs
+}
+
+func (fs *ramFS) newNode(name string, mode FileMode) *ramNode {
+	fs.path++
+	n := &ramNode{name: name, mode: mode, mtime: 1234}
+	n.qid.Path = fs.path
+	if mode&DMDIR != 0 {
+		n.qid.Type = QTDIR
+	}
+	return n
+}
+
+// add creates a file or directory at the provided path, creating parent
+// directories as needed.
+func (fs *ramFS) add(path string, mode FileMode, data []byte) *ramNode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	names := SplitPath(path)
+	dir := fs.root
+	for i, name := range names {
+		n := dir.child(name)
+		if n == nil {
+			m := FileMode(DMDIR | 0777)
+			if i == len(names)-1 {
+				m = mode
+			}
+			n = fs.newNode(name, m)
+			n.parent = dir
+			dir.children = append(dir.children, n)
+		}
+		dir = n
+	}
+	dir.data = data
+	return dir
+}
+
+// lookup returns the node at the provided path, or nil.
+func (fs *ramFS) lookup(path string) *ramNode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.root
+	for _, name := range SplitPath(path) {
+		if n = n.child(name); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (fs *ramFS) count(mt MessageType) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.requests[mt]
+}
+
+// dial returns a new connection to the server.
+func (fs *ramFS) dial() (io.ReadWriteCloser, error) {
+	c1, c2 := net.Pipe()
+	go fs.serve(c2)
+	return c1, nil
+}
+
+// client returns a negotiated client connected to the server.
+func (fs *ramFS) client(t *testing.T, version string) *Client {
+	conn, _ := fs.dial()
+	c := NewClient(conn)
+	if err := c.Negotiate(fs.msize, version); err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// attach returns a client connected to the server, and the root of the tree.
+func (fs *ramFS) attach(t *testing.T, version string) (*Client, *File) {
+	c := fs.client(t, version)
+	root, err := c.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	return c, root
+}
+
+// ramFid is the server side state of a fid.
+type ramFid struct {
+	node *ramNode
+	open bool
+	mode OpenMode
+
+	// dir is the directory listing being read, and diroff the offset at
+	// which the next entry starts.
+	dir    []Stat
+	diroff uint64
+}
+
+// ramConn is the server side state of a connection.
+type ramConn struct {
+	fs    *ramFS
+	enc   *Encoder
+	proto Protocol
+	msize uint32
+	fids  map[Fid]*ramFid
+}
+
+func (fs *ramFS) serve(rw io.ReadWriteCloser) {
+	defer rw.Close()
+
+	dec := &Decoder{Protocol: NineP2000, Reader: rw}
+	rc := &ramConn{
+		fs:    fs,
+		enc:   &Encoder{Protocol: NineP2000, Writer: rw},
+		proto: NineP2000,
+		fids:  make(map[Fid]*ramFid),
+	}
+
+	m, err := dec.ReadMessage()
+	if err != nil {
+		return
+	}
+	vr, ok := m.(*VersionRequest)
+	if !ok {
+		return
+	}
+	rc.msize = vr.MessageSize
+	if rc.msize > fs.msize {
+		rc.msize = fs.msize
+	}
+	version := vr.Version
+	if p := ProtocolForVersion(version); p != nil {
+		rc.proto = p
+	} else if strings.HasPrefix(version, Version) {
+		version = Version
+	} else {
+		version = UnknownVersion
+	}
+	rc.enc.WriteMessage(&VersionResponse{Tag: vr.Tag, MessageSize: rc.msize, Version: version})
+	if version == UnknownVersion {
+		return
+	}
+
+	rc.enc.Protocol = rc.proto
+	dec.Protocol = rc.proto
+	first := true
+	for {
+		m, err := dec.ReadMessage()
+		if err != nil {
+			return
+		}
+		if first && rc.proto == NineP2000Dote {
+			first = false
+			if rc.session(m) {
+				continue
+			}
+		}
+		go rc.handle(m)
+	}
+}
+
+// session sets up the session of a 9P2000.e connection, resuming it if the
+// first message is a Tsession with a known key. It reports whether the
+// message was handled.
+func (rc *ramConn) session(m Message) bool {
+	fs := rc.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sr, ok := m.(*SessionRequestDote)
+	if ok {
+		fs.requests[Tsession]++
+		if fids, found := fs.sessions[sr.Key]; found {
+			rc.fids = fids
+			rc.enc.WriteMessage(&SessionResponseDote{Tag: sr.Tag})
+		} else {
+			rc.enc.WriteMessage(rc.error(sr.Tag, "unknown session"))
+		}
+	}
+	if fs.key != nil {
+		fs.sessions[*fs.key] = rc.fids
+	}
+	return ok
+}
+
+func (rc *ramConn) error(t Tag, msg string) Message {
+	if rc.proto == NineP2000Dotu {
+		return &ErrorResponseDotu{Tag: t, Error: msg}
+	}
+	return &ErrorResponse{Tag: t, Error: msg}
+}
+
+func (rc *ramConn) handle(m Message) {
+	fs := rc.fs
+	if fs.hold != nil {
+		fs.hold(m)
+	}
+	fs.mu.Lock()
+	mt, _ := rc.proto.MessageType(m)
+	fs.requests[mt]++
+	resp := rc.respond(m)
+	fs.mu.Unlock()
+
+	if resp != nil {
+		rc.enc.WriteMessage(resp)
+	}
+}
+
+// walk walks from the node along the names, returning the qids of the walked
+// nodes.
+func (rc *ramConn) walk(n *ramNode, names []string) (*ramNode, []Qid) {
+	qids := []Qid{}
+	for _, name := range names {
+		if n.mode&DMDIR == 0 {
+			break
+		}
+		var next *ramNode
+		if name == ".." {
+			next = n.parent
+		} else {
+			next = n.child(name)
+		}
+		if next == nil {
+			break
+		}
+		n = next
+		qids = append(qids, n.qid)
+	}
+	return n, qids
+}
+
+func (rc *ramConn) create(dir *ramNode, name string, perm FileMode) (*ramNode, string) {
+	if dir.mode&DMDIR == 0 {
+		return nil, "not a directory"
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, "illegal name"
+	}
+	if dir.child(name) != nil {
+		return nil, "file exists"
+	}
+	n := rc.fs.newNode(name, perm)
+	n.parent = dir
+	dir.children = append(dir.children, n)
+	return n, ""
+}
+
+func (rc *ramConn) open(f *ramFid, mode OpenMode) string {
+	if f.node.mode&DMDIR != 0 && mode&3 != OREAD {
+		return "is a directory"
+	}
+	if mode&OTRUNC != 0 {
+		f.node.data = nil
+		f.node.qid.Version++
+	}
+	f.open = true
+	f.mode = mode
+	return ""
+}
+
+func (rc *ramConn) read(f *ramFid, offset uint64, count uint32) []byte {
+	n := f.node
+	if n.stream {
+		b := append([]byte{}, n.data[:min(len(n.data), int(count))]...)
+		n.data = n.data[len(b):]
+		return b
+	}
+	if n.mode&DMDIR == 0 {
+		if offset >= uint64(len(n.data)) {
+			return []byte{}
+		}
+		end := offset + uint64(count)
+		if end > uint64(len(n.data)) {
+			end = uint64(len(n.data))
+		}
+		return append([]byte{}, n.data[offset:end]...)
+	}
+
+	if offset == 0 {
+		f.dir = f.dir[:0]
+		for _, c := range n.children {
+			f.dir = append(f.dir, c.stat())
+		}
+		f.diroff = 0
+	}
+	var b []byte
+	for len(f.dir) > 0 {
+		var buf []byte
+		if rc.proto == NineP2000Dotu {
+			s := StatDotu{
+				Qid: f.dir[0].Qid, Mode: f.dir[0].Mode, Atime: f.dir[0].Atime, Mtime: f.dir[0].Mtime,
+				Length: f.dir[0].Length, Name: f.dir[0].Name, UID: f.dir[0].UID, GID: f.dir[0].GID,
+				MUID: f.dir[0].MUID, UIDno: NONUNAME, GIDno: NONUNAME, MUIDno: NONUNAME,
+			}
+			buf = make([]byte, s.EncodedSize())
+			s.Marshal(buf)
+		} else {
+			buf = make([]byte, f.dir[0].EncodedSize())
+			f.dir[0].Marshal(buf)
+		}
+		if len(b)+len(buf) > int(count) {
+			break
+		}
+		b = append(b, buf...)
+		f.dir = f.dir[1:]
+	}
+	f.diroff += uint64(len(b))
+	if b == nil {
+		b = []byte{}
+	}
+	return b
+}
+
+func (rc *ramConn) write(f *ramFid, offset uint64, data []byte) uint32 {
+	n := f.node
+	if n.mode&DMAPPEND != 0 {
+		offset = uint64(len(n.data))
+	}
+	if end := offset + uint64(len(data)); end > uint64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-uint64(len(n.data)))...)
+	}
+	copy(n.data[offset:], data)
+	n.qid.Version++
+	return uint32(len(data))
+}
+
+func (rc *ramConn) remove(n *ramNode) string {
+	if n == rc.fs.root {
+		return "permission denied"
+	}
+	if len(n.children) > 0 {
+		return "directory not empty"
+	}
+	p := n.parent
+	for i, c := range p.children {
+		if c == n {
+			p.children = append(p.children[:i], p.children[i+1:]...)
+			break
+		}
+	}
+	return ""
+}
+
+func (rc *ramConn) wstat(n *ramNode, s *Stat) string {
+	if s.Name != "" && s.Name != n.name {
+		if n == rc.fs.root {
+			return "permission denied"
+		}
+		if n.parent.child(s.Name) != nil {
+			return "file exists"
+		}
+	}
+	if s.Length != ^uint64(0) && n.mode&DMDIR != 0 && s.Length != 0 {
+		return "is a directory"
+	}
+
+	if s.Name != "" {
+		n.name = s.Name
+	}
+	if s.Mode != ^FileMode(0) {
+		n.mode = n.mode&DMDIR | s.Mode&^DMDIR
+	}
+	if s.Mtime != ^uint32(0) {
+		n.mtime = s.Mtime
+	}
+	if s.Length != ^uint64(0) && n.mode&DMDIR == 0 {
+		if s.Length < uint64(len(n.data)) {
+			n.data = n.data[:s.Length]
+		} else {
+			n.data = append(n.data, make([]byte, s.Length-uint64(len(n.data)))...)
+		}
+		n.qid.Version++
+	}
+	return ""
+}
+
+func (rc *ramConn) respond(m Message) Message {
+	t := m.GetTag()
+	fid := func(f Fid) (*ramFid, Message) {
+		x, ok := rc.fids[f]
+		if !ok {
+			return nil, rc.error(t, "unknown fid")
+		}
+		return x, nil
+	}
+
+	switch m := m.(type) {
+	case *AuthRequest, *AuthRequestDotu:
+		return rc.error(t, "authentication not required")
+
+	case *AttachRequest:
+		if _, ok := rc.fids[m.Fid]; ok {
+			return rc.error(t, "fid in use")
+		}
+		rc.fids[m.Fid] = &ramFid{node: rc.fs.root}
+		return &AttachResponse{Tag: t, Qid: rc.fs.root.qid}
+
+	case *AttachRequestDotu:
+		if _, ok := rc.fids[m.Fid]; ok {
+			return rc.error(t, "fid in use")
+		}
+		rc.fids[m.Fid] = &ramFid{node: rc.fs.root}
+		return &AttachResponse{Tag: t, Qid: rc.fs.root.qid}
+
+	case *FlushRequest:
+		return &FlushResponse{Tag: t}
+
+	case *WalkRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if _, ok := rc.fids[m.NewFid]; ok && m.NewFid != m.Fid {
+			return rc.error(t, "fid in use")
+		}
+		if f.open {
+			return rc.error(t, "fid open")
+		}
+		n, qids := rc.walk(f.node, m.Names)
+		if len(m.Names) > 0 && len(qids) == 0 {
+			return rc.error(t, "file does not exist")
+		}
+		if len(qids) == len(m.Names) {
+			rc.fids[m.NewFid] = &ramFid{node: n}
+		}
+		return &WalkResponse{Tag: t, Qids: qids}
+
+	case *OpenRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if msg := rc.open(f, m.Mode); msg != "" {
+			return rc.error(t, msg)
+		}
+		return &OpenResponse{Tag: t, Qid: f.node.qid, IOUnit: rc.fs.iounit}
+
+	case *CreateRequest, *CreateRequestDotu:
+		var (
+			f    Fid
+			name string
+			perm FileMode
+			mode OpenMode
+		)
+		if cr, ok := m.(*CreateRequest); ok {
+			f, name, perm, mode = cr.Fid, cr.Name, cr.Permissions, cr.Mode
+		} else {
+			cr := m.(*CreateRequestDotu)
+			f, name, perm, mode = cr.Fid, cr.Name, cr.Permissions, cr.Mode
+		}
+		x, e := fid(f)
+		if e != nil {
+			return e
+		}
+		n, msg := rc.create(x.node, name, perm)
+		if msg != "" {
+			return rc.error(t, msg)
+		}
+		x.node = n
+		rc.open(x, mode)
+		return &CreateResponse{Tag: t, Qid: n.qid, IOUnit: rc.fs.iounit}
+
+	case *ReadRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if !f.open {
+			return rc.error(t, "file not open")
+		}
+		count := m.Count
+		if rc.fs.short != nil {
+			count = rc.fs.short(m.Offset, count)
+		}
+		return &ReadResponse{Tag: t, Data: rc.read(f, m.Offset, count)}
+
+	case *WriteRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if !f.open || f.mode&3 == OREAD || f.mode&3 == OEXEC {
+			return rc.error(t, "file not open for writing")
+		}
+		data := m.Data
+		if rc.fs.short != nil {
+			data = data[:rc.fs.short(m.Offset, uint32(len(data)))]
+		}
+		return &WriteResponse{Tag: t, Count: rc.write(f, m.Offset, data)}
+
+	case *ClunkRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		delete(rc.fids, m.Fid)
+		if f.open && f.mode&ORCLOSE != 0 {
+			rc.remove(f.node)
+		}
+		return &ClunkResponse{Tag: t}
+
+	case *RemoveRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		delete(rc.fids, m.Fid)
+		if msg := rc.remove(f.node); msg != "" {
+			return rc.error(t, msg)
+		}
+		return &RemoveResponse{Tag: t}
+
+	case *StatRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		s := f.node.stat()
+		if rc.proto == NineP2000Dotu {
+			return &StatResponseDotu{Tag: t, Stat: StatDotu{
+				Qid: s.Qid, Mode: s.Mode, Atime: s.Atime, Mtime: s.Mtime, Length: s.Length,
+				Name: s.Name, UID: s.UID, GID: s.GID, MUID: s.MUID,
+				UIDno: NONUNAME, GIDno: NONUNAME, MUIDno: NONUNAME,
+			}}
+		}
+		return &StatResponse{Tag: t, Stat: s}
+
+	case *WriteStatRequest:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if msg := rc.wstat(f.node, &m.Stat); msg != "" {
+			return rc.error(t, msg)
+		}
+		return &WriteStatResponse{Tag: t}
+
+	case *WriteStatRequestDotu:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		s := Stat{Mode: m.Stat.Mode, Mtime: m.Stat.Mtime, Length: m.Stat.Length, Name: m.Stat.Name}
+		if msg := rc.wstat(f.node, &s); msg != "" {
+			return rc.error(t, msg)
+		}
+		return &WriteStatResponse{Tag: t}
+
+	case *SimpleReadRequestDote:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		n, qids := rc.walk(f.node, m.Names)
+		if len(qids) != len(m.Names) {
+			return rc.error(t, "file does not exist")
+		}
+		x := &ramFid{node: n}
+		rc.open(x, OREAD)
+		var data []byte
+		for {
+			b := rc.read(x, uint64(len(data)), rc.msize-ReadOverhead-uint32(len(data)))
+			if len(b) == 0 {
+				break
+			}
+			data = append(data, b...)
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		return &SimpleReadResponseDote{Tag: t, Data: data}
+
+	case *SimpleWriteRequestDote:
+		f, e := fid(m.Fid)
+		if e != nil {
+			return e
+		}
+		if len(m.Names) == 0 {
+			return rc.error(t, "illegal name")
+		}
+		dir, qids := rc.walk(f.node, m.Names[:len(m.Names)-1])
+		if len(qids) != len(m.Names)-1 {
+			return rc.error(t, "file does not exist")
+		}
+		rc.create(dir, m.Names[len(m.Names)-1], 0666)
+		n, qids := rc.walk(dir, m.Names[len(m.Names)-1:])
+		if len(qids) != 1 {
+			return rc.error(t, "file does not exist")
+		}
+		x := &ramFid{node: n}
+		if msg := rc.open(x, OWRITE|OTRUNC); msg != "" {
+			return rc.error(t, msg)
+		}
+		return &SimpleWriteResponseDote{Tag: t, Count: rc.write(x, 0, m.Data)}
+
+	default:
+		return rc.error(t, "not implemented")
+	}
+}
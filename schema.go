@@ -0,0 +1,320 @@
+package qp
+
+import (
+	"reflect"
+	"strings"
+)
+
+// WireType describes how a single message field is laid out on the wire,
+// using the notation of the 9P manual pages.
+type WireType byte
+
+// WireType constants.
+const (
+	// Wire1 is a 1 byte integer, written as "[1]".
+	Wire1 WireType = iota + 1
+
+	// Wire2 is a 2 byte little-endian integer, written as "[2]".
+	Wire2
+
+	// Wire4 is a 4 byte little-endian integer, written as "[4]".
+	Wire4
+
+	// Wire8 is an 8 byte field, written as "[8]". It is an uint64 for most
+	// fields, but a raw [8]byte for the 9P2000.e session key.
+	Wire8
+
+	// WireString is a string prefixed by a 2 byte length, written as "[s]".
+	WireString
+
+	// WireQid is a Qid structure, written as "[13]".
+	WireQid
+
+	// WireStat is a Stat or StatDotu structure, prefixed by an additional 2
+	// byte length, written as "stat[n]".
+	WireStat
+
+	// WireData is a byte slice prefixed by a 4 byte count, written as
+	// "count[4] data[count]".
+	WireData
+)
+
+func (wt WireType) String() string {
+	switch wt {
+	case Wire1:
+		return "[1]"
+	case Wire2:
+		return "[2]"
+	case Wire4:
+		return "[4]"
+	case Wire8:
+		return "[8]"
+	case WireString:
+		return "[s]"
+	case WireQid:
+		return "[13]"
+	case WireStat:
+		return "[n]"
+	case WireData:
+		return "[count]"
+	default:
+		return "[?]"
+	}
+}
+
+// Field describes a single field of a message.
+type Field struct {
+	// Name is the name of the field as used in the 9P manual pages, such as
+	// "newfid" or "wname".
+	Name string
+
+	// GoName is the name of the struct field holding the value.
+	GoName string
+
+	// Type is the wire type of the field, or of each element if the field is
+	// repeated.
+	Type WireType
+
+	// Count is the name of the 2 byte element count preceding a repeated
+	// field, such as "nwname". It is empty for fields that are not repeated.
+	Count string
+}
+
+// Repeated reports whether the field is a counted list of elements.
+func (f *Field) Repeated() bool {
+	return f.Count != ""
+}
+
+// Value returns the value of the field in the provided message. The message
+// must be of the type described by the schema the field was retrieved from.
+func (f *Field) Value(m Message) interface{} {
+	return reflect.ValueOf(m).Elem().FieldByName(f.GoName).Interface()
+}
+
+func (f *Field) String() string {
+	switch {
+	case f.Repeated():
+		return f.Count + "[2] " + f.Count + "*(" + f.Name + f.Type.String() + ")"
+	case f.Type == WireData:
+		return "count[4] " + f.Name + f.Type.String()
+	default:
+		return f.Name + f.Type.String()
+	}
+}
+
+// Schema describes the wire layout of a message type. Schemas allow generic
+// tools, such as dissectors and encoders for other formats, to inspect any
+// message without knowledge of the concrete message types.
+type Schema struct {
+	// Name is the name of the message type, such as "Twalk".
+	Name string
+
+	// Type is the message type constant used on the wire.
+	Type MessageType
+
+	// Fields are the fields of the message in wire order, starting with the
+	// tag. The size and type header fields are not included.
+	Fields []Field
+
+	// typ is the concrete message struct type.
+	typ reflect.Type
+}
+
+// New returns a new, empty message of the type described by the schema.
+func (s *Schema) New() Message {
+	return reflect.New(s.typ).Interface().(Message)
+}
+
+// In reports whether the message described by the schema is a part of the
+// provided protocol, meaning that the protocol both encodes the message and
+// decodes its message type back to the same message.
+func (s *Schema) In(p Protocol) bool {
+	mt, err := p.MessageType(s.New())
+	if err != nil || mt != s.Type {
+		return false
+	}
+	m, err := p.Message(mt)
+	return err == nil && reflect.TypeOf(m).Elem() == s.typ
+}
+
+// Field returns the field with the provided name, or nil if no such field
+// exists.
+func (s *Schema) Field(name string) *Field {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+// String returns the layout of the message in the notation of the 9P manual
+// pages, such as "size[4] Tclunk tag[2] fid[4]".
+func (s *Schema) String() string {
+	parts := make([]string, 0, len(s.Fields)+2)
+	parts = append(parts, "size[4]", s.Name)
+	for i := range s.Fields {
+		parts = append(parts, s.Fields[i].String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// SchemaOf returns the schema for the provided message, or nil if the message
+// type is unknown.
+func SchemaOf(m Message) *Schema {
+	return schemaIndex[reflect.TypeOf(m)]
+}
+
+// SchemaFor returns the schema for the message that the provided protocol
+// uses for the provided message type, or nil if the protocol does not know
+// the message type.
+func SchemaFor(p Protocol, mt MessageType) *Schema {
+	m, err := p.Message(mt)
+	if err != nil {
+		return nil
+	}
+	return SchemaOf(m)
+}
+
+// Schemas returns the schemas for all messages known to this package,
+// including those of all protocol extensions.
+func Schemas() []*Schema {
+	s := make([]*Schema, len(schemas))
+	copy(s, schemas)
+	return s
+}
+
+func newSchema(name string, mt MessageType, m Message, fields ...Field) *Schema {
+	return &Schema{
+		Name:   name,
+		Type:   mt,
+		Fields: append([]Field{{Name: "tag", GoName: "Tag", Type: Wire2}}, fields...),
+		typ:    reflect.TypeOf(m).Elem(),
+	}
+}
+
+var schemas = []*Schema{
+	// 9P2000
+	newSchema("Tversion", Tversion, &VersionRequest{},
+		Field{Name: "msize", GoName: "MessageSize", Type: Wire4},
+		Field{Name: "version", GoName: "Version", Type: WireString}),
+	newSchema("Rversion", Rversion, &VersionResponse{},
+		Field{Name: "msize", GoName: "MessageSize", Type: Wire4},
+		Field{Name: "version", GoName: "Version", Type: WireString}),
+	newSchema("Tauth", Tauth, &AuthRequest{},
+		Field{Name: "afid", GoName: "AuthFid", Type: Wire4},
+		Field{Name: "uname", GoName: "Username", Type: WireString},
+		Field{Name: "aname", GoName: "Service", Type: WireString}),
+	newSchema("Rauth", Rauth, &AuthResponse{},
+		Field{Name: "aqid", GoName: "AuthQid", Type: WireQid}),
+	newSchema("Tattach", Tattach, &AttachRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "afid", GoName: "AuthFid", Type: Wire4},
+		Field{Name: "uname", GoName: "Username", Type: WireString},
+		Field{Name: "aname", GoName: "Service", Type: WireString}),
+	newSchema("Rattach", Rattach, &AttachResponse{},
+		Field{Name: "qid", GoName: "Qid", Type: WireQid}),
+	newSchema("Rerror", Rerror, &ErrorResponse{},
+		Field{Name: "ename", GoName: "Error", Type: WireString}),
+	newSchema("Tflush", Tflush, &FlushRequest{},
+		Field{Name: "oldtag", GoName: "OldTag", Type: Wire2}),
+	newSchema("Rflush", Rflush, &FlushResponse{}),
+	newSchema("Twalk", Twalk, &WalkRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "newfid", GoName: "NewFid", Type: Wire4},
+		Field{Name: "wname", GoName: "Names", Type: WireString, Count: "nwname"}),
+	newSchema("Rwalk", Rwalk, &WalkResponse{},
+		Field{Name: "wqid", GoName: "Qids", Type: WireQid, Count: "nwqid"}),
+	newSchema("Topen", Topen, &OpenRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "mode", GoName: "Mode", Type: Wire1}),
+	newSchema("Ropen", Ropen, &OpenResponse{},
+		Field{Name: "qid", GoName: "Qid", Type: WireQid},
+		Field{Name: "iounit", GoName: "IOUnit", Type: Wire4}),
+	newSchema("Tcreate", Tcreate, &CreateRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "name", GoName: "Name", Type: WireString},
+		Field{Name: "perm", GoName: "Permissions", Type: Wire4},
+		Field{Name: "mode", GoName: "Mode", Type: Wire1}),
+	newSchema("Rcreate", Rcreate, &CreateResponse{},
+		Field{Name: "qid", GoName: "Qid", Type: WireQid},
+		Field{Name: "iounit", GoName: "IOUnit", Type: Wire4}),
+	newSchema("Tread", Tread, &ReadRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "offset", GoName: "Offset", Type: Wire8},
+		Field{Name: "count", GoName: "Count", Type: Wire4}),
+	newSchema("Rread", Rread, &ReadResponse{},
+		Field{Name: "data", GoName: "Data", Type: WireData}),
+	newSchema("Twrite", Twrite, &WriteRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "offset", GoName: "Offset", Type: Wire8},
+		Field{Name: "data", GoName: "Data", Type: WireData}),
+	newSchema("Rwrite", Rwrite, &WriteResponse{},
+		Field{Name: "count", GoName: "Count", Type: Wire4}),
+	newSchema("Tclunk", Tclunk, &ClunkRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4}),
+	newSchema("Rclunk", Rclunk, &ClunkResponse{}),
+	newSchema("Tremove", Tremove, &RemoveRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4}),
+	newSchema("Rremove", Rremove, &RemoveResponse{}),
+	newSchema("Tstat", Tstat, &StatRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4}),
+	newSchema("Rstat", Rstat, &StatResponse{},
+		Field{Name: "stat", GoName: "Stat", Type: WireStat}),
+	newSchema("Twstat", Twstat, &WriteStatRequest{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "stat", GoName: "Stat", Type: WireStat}),
+	newSchema("Rwstat", Rwstat, &WriteStatResponse{}),
+
+	// 9P2000.u
+	newSchema("Tauth", Tauth, &AuthRequestDotu{},
+		Field{Name: "afid", GoName: "AuthFid", Type: Wire4},
+		Field{Name: "uname", GoName: "Username", Type: WireString},
+		Field{Name: "aname", GoName: "Service", Type: WireString},
+		Field{Name: "n_uname", GoName: "UIDno", Type: Wire4}),
+	newSchema("Tattach", Tattach, &AttachRequestDotu{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "afid", GoName: "AuthFid", Type: Wire4},
+		Field{Name: "uname", GoName: "Username", Type: WireString},
+		Field{Name: "aname", GoName: "Service", Type: WireString},
+		Field{Name: "n_uname", GoName: "UIDno", Type: Wire4}),
+	newSchema("Rerror", Rerror, &ErrorResponseDotu{},
+		Field{Name: "ename", GoName: "Error", Type: WireString},
+		Field{Name: "errno", GoName: "Errno", Type: Wire4}),
+	newSchema("Tcreate", Tcreate, &CreateRequestDotu{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "name", GoName: "Name", Type: WireString},
+		Field{Name: "perm", GoName: "Permissions", Type: Wire4},
+		Field{Name: "mode", GoName: "Mode", Type: Wire1},
+		Field{Name: "extension", GoName: "Extensions", Type: WireString}),
+	newSchema("Rstat", Rstat, &StatResponseDotu{},
+		Field{Name: "stat", GoName: "Stat", Type: WireStat}),
+	newSchema("Twstat", Twstat, &WriteStatRequestDotu{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "stat", GoName: "Stat", Type: WireStat}),
+
+	// 9P2000.e
+	newSchema("Tsession", Tsession, &SessionRequestDote{},
+		Field{Name: "key", GoName: "Key", Type: Wire8}),
+	newSchema("Rsession", Rsession, &SessionResponseDote{}),
+	newSchema("Tsread", Tsread, &SimpleReadRequestDote{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "wname", GoName: "Names", Type: WireString, Count: "nwname"}),
+	newSchema("Rsread", Rsread, &SimpleReadResponseDote{},
+		Field{Name: "data", GoName: "Data", Type: WireData}),
+	newSchema("Tswrite", Tswrite, &SimpleWriteRequestDote{},
+		Field{Name: "fid", GoName: "Fid", Type: Wire4},
+		Field{Name: "wname", GoName: "Names", Type: WireString, Count: "nwname"},
+		Field{Name: "data", GoName: "Data", Type: WireData}),
+	newSchema("Rswrite", Rswrite, &SimpleWriteResponseDote{},
+		Field{Name: "count", GoName: "Count", Type: Wire4}),
+}
+
+// schemaIndex maps message pointer types to their schema.
+var schemaIndex = func() map[reflect.Type]*Schema {
+	idx := make(map[reflect.Type]*Schema, len(schemas))
+	for _, s := range schemas {
+		idx[reflect.PtrTo(s.typ)] = s
+	}
+	return idx
+}()
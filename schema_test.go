@@ -0,0 +1,112 @@
+package qp
+
+import "testing"
+
+// schemaSize computes the encoded size of a message from its schema alone.
+func schemaSize(s *Schema, m Message) int {
+	size := 0
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		v := f.Value(m)
+		if f.Repeated() {
+			size += 2
+			switch vv := v.(type) {
+			case []string:
+				for _, x := range vv {
+					size += 2 + len(x)
+				}
+			case []Qid:
+				size += 13 * len(vv)
+			}
+			continue
+		}
+		switch f.Type {
+		case Wire1:
+			size++
+		case Wire2:
+			size += 2
+		case Wire4:
+			size += 4
+		case Wire8:
+			size += 8
+		case WireString:
+			size += 2 + len(v.(string))
+		case WireQid:
+			size += 13
+		case WireStat:
+			switch st := v.(type) {
+			case Stat:
+				size += 2 + st.EncodedSize()
+			case StatDotu:
+				size += 2 + st.EncodedSize()
+			}
+		case WireData:
+			size += 4 + len(v.([]byte))
+		}
+	}
+	return size
+}
+
+func TestSchema(t *testing.T) {
+	sets := []struct {
+		p    Protocol
+		data []MessageTestEntry
+	}{
+		{NineP2000, MessageTestData},
+		{NineP2000Dotu, MessageTestDataDotu},
+		{NineP2000Dote, MessageTestDataDote},
+	}
+
+	for _, set := range sets {
+		for i, tt := range set.data {
+			s := SchemaOf(tt.input)
+			if s == nil {
+				t.Errorf("test %d: no schema for %T", i, tt.input)
+				continue
+			}
+			if !s.In(set.p) {
+				t.Errorf("test %d: schema %s for %T not in protocol", i, s.Name, tt.input)
+			}
+			mt, _ := set.p.MessageType(tt.input)
+			if mt != s.Type {
+				t.Errorf("test %d: schema %s has type %d, expected %d", i, s.Name, s.Type, mt)
+			}
+			if size := schemaSize(s, tt.input); size != tt.input.EncodedSize() {
+				t.Errorf("test %d: schema %s computed size %d, expected %d", i, s.Name, size, tt.input.EncodedSize())
+			}
+		}
+	}
+}
+
+func TestSchemaMembership(t *testing.T) {
+	if s := SchemaOf(&AuthRequest{}); s.In(NineP2000Dotu) {
+		t.Errorf("AuthRequest should not be a part of 9P2000.u")
+	}
+	if s := SchemaOf(&AuthRequestDotu{}); s.In(NineP2000) {
+		t.Errorf("AuthRequestDotu should not be a part of 9P2000")
+	}
+	if s := SchemaOf(&SessionRequestDote{}); s.In(NineP2000) || !s.In(NineP2000Dote) {
+		t.Errorf("SessionRequestDote should only be a part of 9P2000.e")
+	}
+	if s := SchemaFor(NineP2000Dotu, Tcreate); s == nil || s.Field("extension") == nil {
+		t.Errorf("Tcreate for 9P2000.u should have an extension field")
+	}
+}
+
+func TestSchemaString(t *testing.T) {
+	tests := []struct {
+		m        Message
+		expected string
+	}{
+		{&WalkRequest{}, "size[4] Twalk tag[2] fid[4] newfid[4] nwname[2] nwname*(wname[s])"},
+		{&ReadResponse{}, "size[4] Rread tag[2] count[4] data[count]"},
+		{&StatResponse{}, "size[4] Rstat tag[2] stat[n]"},
+		{&SessionRequestDote{}, "size[4] Tsession tag[2] key[8]"},
+	}
+
+	for i, tt := range tests {
+		if s := SchemaOf(tt.m).String(); s != tt.expected {
+			t.Errorf("test %d: expected %q, got %q", i, tt.expected, s)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package qp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	// ErrSecureFrame indicates a frame of a secure connection that fails to
+	// authenticate, because it was altered, replayed, reordered or dropped.
+	// The connection cannot be used once it occurs.
+	ErrSecureFrame = errors.New("secure connection: invalid frame")
+
+	// ErrNoSecret indicates an authentication that did not establish a
+	// secret to secure the connection with.
+	ErrNoSecret = errors.New("secure connection: no shared secret")
+)
+
+// SecureCipher selects the AEAD encrypting the frames of a SecureConn. Both
+// ends of a connection must use the same cipher.
+type SecureCipher int
+
+const (
+	// SecureChaCha20Poly1305 encrypts with ChaCha20-Poly1305, which is fast
+	// without hardware support for AES.
+	SecureChaCha20Poly1305 SecureCipher = iota
+
+	// SecureAESGCM encrypts with AES-256-GCM.
+	SecureAESGCM
+)
+
+func (sc SecureCipher) String() string {
+	switch sc {
+	case SecureChaCha20Poly1305:
+		return "chacha20-poly1305"
+	case SecureAESGCM:
+		return "aes-256-gcm"
+	default:
+		return "unknown cipher"
+	}
+}
+
+// aead returns the AEAD of the cipher with the 32 byte key.
+func (sc SecureCipher) aead(key []byte) (cipher.AEAD, error) {
+	switch sc {
+	case SecureChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case SecureAESGCM:
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	default:
+		return nil, errors.New("secure connection: " + sc.String())
+	}
+}
+
+const (
+	// secureMaxFrame is the maximum size of the data of a frame, so that
+	// frames are buffered in full without trusting the size of a frame
+	// beyond it.
+	secureMaxFrame = 1 << 16
+
+	// secureHeaderSize is the size of the header of a frame, holding the
+	// size of the sealed data.
+	secureHeaderSize = 4
+
+	// secureSaltSize is the size of the random salt each end contributes to
+	// the keys of a connection.
+	secureSaltSize = 32
+
+	// secureCloseTimeout limits how long Close waits for the close frame to
+	// be sent.
+	secureCloseTimeout = time.Second
+)
+
+// SecureConn is a connection encrypting and authenticating the data sent
+// each way, keyed by the secret shared after authentication. It sits between
+// a net.Conn and the Encoder and Decoder of 9P, and can be passed to
+// Server.ServeConn and NewClient in place of the connection it wraps.
+//
+// Data is sent in frames consisting of the size of the sealed data as 4
+// little-endian bytes, followed by the data sealed with the cipher. The
+// nonce of a frame is its sequence number in the direction it is sent, so
+// that frames that are replayed, reordered or dropped fail to open. The keys
+// of each direction are derived with HKDF-SHA256 from the secret and a
+// random salt sent in the clear by each end, first by the client, so that
+// every connection has its own keys even if the secret is reused.
+//
+// Close sends a frame without data, after which reading at the other end
+// returns io.EOF. A connection that ends without it, as it does when it is
+// cut, returns io.ErrUnexpectedEOF instead, so that truncated data is not
+// taken for complete.
+type SecureConn struct {
+	net.Conn
+	info *AuthInfo
+
+	// rmu protects the reading side: the AEAD, the sequence number of the
+	// next frame, the data of the last frame not read yet, and the error
+	// that ended reading.
+	rmu  sync.Mutex
+	r    cipher.AEAD
+	rseq uint64
+	rbuf []byte
+	rerr error
+
+	// wmu protects the writing side, and whether the close frame was sent.
+	wmu     sync.Mutex
+	w       cipher.AEAD
+	wseq    uint64
+	wbuf    []byte
+	wclosed bool
+}
+
+// NewSecureConn secures the connection with the secret of the
+// authentication, with client telling which end of the connection this is,
+// after exchanging salts with the other end. The secrets of p9sk1 are only
+// 56 bits of DES key, so dp9ik should be preferred for connections crossing
+// untrusted networks.
+func NewSecureConn(conn net.Conn, info *AuthInfo, client bool, c SecureCipher) (*SecureConn, error) {
+	salt := make([]byte, secureSaltSize)
+	authRandom(salt)
+	return newSecureConn(conn, info, client, c, salt)
+}
+
+// newSecureConn is NewSecureConn with the salt of this end.
+func newSecureConn(conn net.Conn, info *AuthInfo, client bool, c SecureCipher, salt []byte) (*SecureConn, error) {
+	if info == nil || len(info.Secret) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	// The client sends its salt first, so that neither end waits for the
+	// other on connections without buffering.
+	peer := make([]byte, secureSaltSize)
+	var err error
+	if client {
+		if _, err = conn.Write(salt); err == nil {
+			_, err = io.ReadFull(conn, peer)
+		}
+		salt = append(salt[:secureSaltSize:secureSaltSize], peer...)
+	} else {
+		if _, err = io.ReadFull(conn, peer); err == nil {
+			_, err = conn.Write(salt)
+		}
+		salt = append(peer, salt...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := hkdf.Key(sha256.New, info.Secret, salt, "qp secure connection "+c.String(), 64)
+	if err != nil {
+		return nil, err
+	}
+	toServer, err := c.aead(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := c.aead(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+	sc := &SecureConn{Conn: conn, info: info, r: toServer, w: toClient}
+	if client {
+		sc.r, sc.w = toClient, toServer
+	}
+	return sc, nil
+}
+
+// AuthInfo returns the result of the authentication securing the
+// connection.
+func (sc *SecureConn) AuthInfo() *AuthInfo {
+	return sc.info
+}
+
+// secureNonce returns the nonce of the frame with the sequence number.
+func secureNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// Read reads the data of the frames received, one frame at a time.
+func (sc *SecureConn) Read(p []byte) (int, error) {
+	sc.rmu.Lock()
+	defer sc.rmu.Unlock()
+	for len(sc.rbuf) == 0 {
+		if sc.rerr != nil {
+			return 0, sc.rerr
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+		sc.rbuf, sc.rerr = sc.readFrame()
+	}
+	n := copy(p, sc.rbuf)
+	sc.rbuf = sc.rbuf[n:]
+	return n, nil
+}
+
+// readFrame reads and opens the next frame, returning io.EOF for the close
+// frame.
+func (sc *SecureConn) readFrame() ([]byte, error) {
+	var hdr [secureHeaderSize]byte
+	if _, err := io.ReadFull(sc.Conn, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size < uint32(sc.r.Overhead()) || size > uint32(secureMaxFrame+sc.r.Overhead()) {
+		return nil, ErrSecureFrame
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(sc.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	data, err := sc.r.Open(buf[:0], secureNonce(sc.r, sc.rseq), buf, hdr[:])
+	if err != nil {
+		return nil, ErrSecureFrame
+	}
+	sc.rseq++
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+// Write sends the data in as many frames as needed, so that concurrent
+// writes are not interleaved within a frame.
+func (sc *SecureConn) Write(p []byte) (int, error) {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), secureMaxFrame)]
+		if err := sc.writeFrame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// writeFrame seals and sends a frame. The caller must hold wmu.
+func (sc *SecureConn) writeFrame(data []byte) error {
+	size := len(data) + sc.w.Overhead()
+	if cap(sc.wbuf) < secureHeaderSize+size {
+		sc.wbuf = make([]byte, secureHeaderSize+size)
+	}
+	frame := sc.wbuf[:secureHeaderSize+size]
+	binary.LittleEndian.PutUint32(frame, uint32(size))
+	sc.w.Seal(frame[secureHeaderSize:secureHeaderSize], secureNonce(sc.w, sc.wseq), data, frame[:secureHeaderSize])
+	sc.wseq++
+	_, err := sc.Conn.Write(frame)
+	return err
+}
+
+// Close sends the close frame and closes the connection. The close frame is
+// left out if a write is in progress, as the data it writes may be cut
+// short, and Close gives up on it after a second if the other end does not
+// take it.
+func (sc *SecureConn) Close() error {
+	if sc.wmu.TryLock() {
+		if !sc.wclosed {
+			sc.wclosed = true
+			sc.Conn.SetWriteDeadline(time.Now().Add(secureCloseTimeout))
+			sc.writeFrame(nil)
+		}
+		sc.wmu.Unlock()
+	}
+	return sc.Conn.Close()
+}
+
+// authMessageMax is the size limit of the messages of an authentication
+// conversation on a stream.
+const authMessageMax = 8192
+
+// streamAuthConn carries the messages of an authentication conversation on
+// a connection before it is secured, with each message prefixed by its size
+// as 4 little-endian bytes.
+type streamAuthConn struct {
+	rw io.ReadWriter
+}
+
+func (sa streamAuthConn) ReadMessage() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(sa.rw, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size > authMessageMax {
+		return nil, ErrAuthProtocol
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(sa.rw, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (sa streamAuthConn) WriteMessage(msg []byte) error {
+	if len(msg) > authMessageMax {
+		return ErrAuthProtocol
+	}
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(msg)))
+	_, err := sa.rw.Write(append(b, msg...))
+	return err
+}
+
+// SecureClient authenticates the user to the server at the other end of
+// the connection with p9any, before any 9P is exchanged, and returns the
+// connection secured with the resulting secret. See SecureServer.
+func SecureClient(conn net.Conn, pc *P9AnyClient, user string, c SecureCipher) (*SecureConn, error) {
+	info, err := pc.AuthenticateInfo(streamAuthConn{conn}, user, "")
+	if err != nil {
+		return nil, err
+	}
+	return NewSecureConn(conn, info, true, c)
+}
+
+// SecureServer authenticates the client at the other end of the connection
+// with p9any, and returns the connection secured with the resulting secret.
+// When served, attaches without an auth file are then accepted for the user
+// of the client, making Tauth unnecessary.
+func SecureServer(conn net.Conn, a *P9AnyAuth, c SecureCipher) (*SecureConn, error) {
+	conv, err := a.Start("", "")
+	if err != nil {
+		return nil, err
+	}
+	s := conv.(*p9anyServer)
+	sa := streamAuthConn{conn}
+	for {
+		msg, err := s.ReadMessage()
+		if err == nil {
+			err = sa.WriteMessage(msg)
+		} else if err == ErrAuthPhase {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.Authenticated(); ok {
+			return NewSecureConn(conn, s.info, false, c)
+		}
+		if msg, err = sa.ReadMessage(); err != nil {
+			return nil, err
+		}
+		if err := s.WriteMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// connAuthInfo returns the result of the authentication securing a
+// connection, unwrapping negotiated connections, or nil if the connection
+// is not secured.
+func connAuthInfo(rw io.ReadWriteCloser) *AuthInfo {
+	if c, ok := rw.(*Conn); ok {
+		rw = c.Conn
+	}
+	if sc, ok := rw.(*SecureConn); ok {
+		return sc.info
+	}
+	return nil
+}
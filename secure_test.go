@@ -0,0 +1,185 @@
+package qp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// frameConn is a connection reading from r and writing to w.
+type frameConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c frameConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c frameConn) Write(p []byte) (int, error)      { return c.w.Write(p) }
+func (c frameConn) SetWriteDeadline(time.Time) error { return nil }
+func (c frameConn) Close() error                     { return nil }
+
+// securePipe returns the ends of a secured pipe.
+func securePipe(t *testing.T, info *AuthInfo, c SecureCipher) (client, server *SecureConn) {
+	c1, c2 := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = NewSecureConn(c2, info, false, c)
+		done <- err
+	}()
+	client, err := NewSecureConn(c1, info, true, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSecureConn(t *testing.T) {
+	info := &AuthInfo{CUID: "glenda", SUID: "glenda", Secret: bytes.Repeat([]byte{7}, 32)}
+	for _, c := range []SecureCipher{SecureChaCha20Poly1305, SecureAESGCM} {
+		client, server := securePipe(t, info, c)
+
+		// Writes larger than a frame are split, and closing ends the data
+		// at the other end.
+		data := make([]byte, 3*secureMaxFrame+100)
+		authRandom(data)
+		go func() {
+			client.Write(data)
+			io.Copy(client, bytes.NewReader([]byte("bye")))
+			client.Close()
+		}()
+		got, err := io.ReadAll(server)
+		if err != nil {
+			t.Fatalf("%v: read failed: %v", c, err)
+		}
+		if len(got) != len(data)+3 || !bytes.Equal(got[:len(data)], data) || string(got[len(data):]) != "bye" {
+			t.Errorf("%v: data corrupted", c)
+		}
+		server.Close()
+	}
+
+	// Connections sharing a secret have keys of their own.
+	c1, s1 := securePipe(t, info, SecureChaCha20Poly1305)
+	c2, s2 := securePipe(t, info, SecureChaCha20Poly1305)
+	if bytes.Equal(c1.w.Seal(nil, secureNonce(c1.w, 0), nil, nil), c2.w.Seal(nil, secureNonce(c2.w, 0), nil, nil)) {
+		t.Error("connections with the same secret share keys")
+	}
+	s1.Conn.Close()
+	s2.Conn.Close()
+}
+
+func TestSecureConnFrames(t *testing.T) {
+	info := &AuthInfo{Secret: bytes.Repeat([]byte{7}, 32)}
+	csalt, ssalt := bytes.Repeat([]byte{1}, secureSaltSize), bytes.Repeat([]byte{2}, secureSaltSize)
+	var sent bytes.Buffer
+	client, err := newSecureConn(frameConn{r: bytes.NewReader(ssalt), w: &sent}, info, true, SecureChaCha20Poly1305, csalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent.Next(secureSaltSize), csalt) {
+		t.Fatal("salt not sent")
+	}
+	client.Write([]byte("one"))
+	client.Write([]byte("two"))
+	client.Close()
+	frames := sent.Bytes()
+	n := (len(frames) - secureHeaderSize - chacha20poly1305.Overhead) / 2
+	f1, f2, closed := frames[:n], frames[n:2*n], frames[2*n:]
+	tampered := append([]byte(nil), f1...)
+	tampered[n-1] ^= 1
+
+	for _, test := range []struct {
+		name   string
+		stream [][]byte
+		c      SecureCipher
+		salt   []byte
+		data   string
+		err    error
+	}{
+		{"in order", [][]byte{f1, f2, closed}, SecureChaCha20Poly1305, ssalt, "onetwo", nil},
+		{"truncated", [][]byte{f1, f2}, SecureChaCha20Poly1305, ssalt, "onetwo", io.ErrUnexpectedEOF},
+		{"cut short", [][]byte{f1, f2[:n-1]}, SecureChaCha20Poly1305, ssalt, "one", io.ErrUnexpectedEOF},
+		{"closed early", [][]byte{f1, closed}, SecureChaCha20Poly1305, ssalt, "one", ErrSecureFrame},
+		{"replayed", [][]byte{f1, f1}, SecureChaCha20Poly1305, ssalt, "one", ErrSecureFrame},
+		{"dropped", [][]byte{f2}, SecureChaCha20Poly1305, ssalt, "", ErrSecureFrame},
+		{"tampered", [][]byte{tampered}, SecureChaCha20Poly1305, ssalt, "", ErrSecureFrame},
+		{"other cipher", [][]byte{f1}, SecureAESGCM, ssalt, "", ErrSecureFrame},
+		{"other salt", [][]byte{f1}, SecureChaCha20Poly1305, csalt, "", ErrSecureFrame},
+	} {
+		stream := append([][]byte{csalt}, test.stream...)
+		server, err := newSecureConn(frameConn{r: bytes.NewReader(bytes.Join(stream, nil)), w: io.Discard}, info, false, test.c, test.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(server)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+		if string(got) != test.data {
+			t.Errorf("%s: read %q, expected %q", test.name, got, test.data)
+		}
+	}
+
+	if _, err := NewSecureConn(frameConn{}, &AuthInfo{}, true, SecureAESGCM); err != ErrNoSecret {
+		t.Errorf("expected ErrNoSecret, got %v", err)
+	}
+}
+
+func TestSecureServe(t *testing.T) {
+	a, as := p9anySetup()
+	srv := &Server{FS: newRamServer(newRamFS()), Auth: a}
+	for _, c := range []SecureCipher{SecureChaCha20Poly1305, SecureAESGCM} {
+		c1, c2 := net.Pipe()
+		go func() {
+			sconn, err := SecureServer(c2, a, c)
+			if err != nil {
+				c2.Close()
+				return
+			}
+			srv.ServeConn(sconn)
+		}()
+
+		pc := &P9AnyClient{Key: PassToKey("glenda password"), AuthServer: as}
+		sconn, err := SecureClient(c1, pc, "glenda", c)
+		if err != nil {
+			t.Fatalf("%v: authentication failed: %v", c, err)
+		}
+		cl := NewClient(sconn)
+		defer cl.Close()
+		if err := cl.Negotiate(8192, Version); err != nil {
+			t.Fatalf("%v: negotiation failed: %v", c, err)
+		}
+
+		// The user who secured the connection attaches without Tauth, and
+		// nobody else.
+		root, err := cl.Attach(nil, "glenda", "")
+		if err != nil {
+			t.Fatalf("%v: attach failed: %v", c, err)
+		}
+		if _, err := root.Stat(); err != nil {
+			t.Errorf("%v: stat failed: %v", c, err)
+		}
+		if _, err := cl.Attach(nil, "bootes", ""); err == nil {
+			t.Errorf("%v: attach as another user succeeded", c)
+		}
+	}
+
+	// A client with the wrong key does not get a secure connection.
+	c1, c2 := net.Pipe()
+	go func() {
+		SecureServer(c2, a, SecureChaCha20Poly1305)
+		c2.Close()
+	}()
+	pc := &P9AnyClient{Key: PassToKey("wrong"), AuthServer: as}
+	if _, err := SecureClient(c1, pc, "glenda", SecureChaCha20Poly1305); err == nil {
+		t.Error("authentication with the wrong key succeeded")
+	}
+	c1.Close()
+}
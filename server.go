@@ -0,0 +1,941 @@
+package qp
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMessageSize is the maximum message size offered by a Server if
+// none is configured.
+const DefaultMessageSize = 65536
+
+var (
+	// ErrUnknownFid indicates a request for a fid that does not exist.
+	ErrUnknownFid = errors.New("unknown fid")
+
+	// ErrFidInUse indicates an attempt to assign a fid that already exists.
+	ErrFidInUse = errors.New("fid in use")
+
+	// ErrFidOpen indicates a walk or open of a fid that is already open.
+	ErrFidOpen = errors.New("fid already open")
+
+	// ErrFidNotOpen indicates I/O on a fid that has not been opened for it.
+	ErrFidNotOpen = errors.New("fid not open for I/O")
+
+	// ErrNoAuth indicates an authentication request to a server that does
+	// not require authentication.
+	ErrNoAuth = errors.New("authentication not required")
+
+	// ErrBadDirOffset indicates a directory read at an offset other than 0
+	// or the end of the previous read.
+	ErrBadDirOffset = errors.New("bad offset in directory read")
+
+	// ErrUnexpectedMessage indicates a message the server does not accept.
+	ErrUnexpectedMessage = errors.New("unexpected message")
+
+	// ErrServerClosed is returned by Serve after Close.
+	ErrServerClosed = errors.New("server closed")
+)
+
+// FileServer is a file system served by Server.
+type FileServer interface {
+	// Attach returns the root of the tree named by aname, as accessed by
+	// the user uname.
+	Attach(uname, aname string) (Node, error)
+}
+
+// Node is the state of a single fid on a served file system. Every fid has
+// its own Node, which is released with Clunk or Remove once the fid is
+// clunked. As the requests on a fid may be served concurrently, Node methods
+// must be safe for concurrent use.
+type Node interface {
+	// Qid returns the qid of the file.
+	Qid() Qid
+
+	// Walk walks from the file along the names, returning a new node for
+	// the destination, and the qids of the walked names. An empty list of
+	// names clones the node. If a name other than the first cannot be
+	// walked, Walk returns the qids walked so far and a nil node. If the
+	// first name cannot be walked, Walk returns an error.
+	Walk(names []string) ([]Qid, Node, error)
+
+	// Open prepares the file for I/O with the provided mode, returning the
+	// iounit, or 0 if no iounit is provided.
+	Open(mode OpenMode) (uint32, error)
+
+	// Create creates a file in the directory, returning an opened node for
+	// the new file and the iounit. The node of the directory is released
+	// by the server.
+	Create(name string, perm FileMode, mode OpenMode) (Node, uint32, error)
+
+	// Read reads from the opened file at the provided offset. Directories
+	// implementing DirReader are read through ReadDir instead.
+	Read(p []byte, off uint64) (int, error)
+
+	// Write writes to the opened file at the provided offset.
+	Write(p []byte, off uint64) (int, error)
+
+	// Stat returns the Stat struct of the file.
+	Stat() (Stat, error)
+
+	// WriteStat applies the Stat struct to the file. Fields set to their
+	// NoChangeStat values are left unchanged.
+	WriteStat(s Stat) error
+
+	// Remove removes the file and releases the node.
+	Remove() error
+
+	// Clunk releases the node.
+	Clunk() error
+}
+
+// DirReader may be implemented by nodes of directories to let the server
+// handle directory reads. ReadDir is called when reading at offset 0, after
+// which the server packs the entries into reads, taking care of offsets.
+type DirReader interface {
+	ReadDir() ([]Stat, error)
+}
+
+// ContextReader may be implemented by nodes of files whose reads block, such
+// as event files, so that a read is abandoned once it is flushed or its
+// connection closes. ReadContext is called in place of Read, and should
+// return the error of ctx once ctx is done.
+type ContextReader interface {
+	ReadContext(ctx context.Context, p []byte, off uint64) (int, error)
+}
+
+// ContextWriter is like ContextReader for writes.
+type ContextWriter interface {
+	WriteContext(ctx context.Context, p []byte, off uint64) (int, error)
+}
+
+// nodeRead reads from the node, through ReadContext if implemented.
+func nodeRead(ctx context.Context, node Node, p []byte, off uint64) (int, error) {
+	if cr, ok := node.(ContextReader); ok {
+		return cr.ReadContext(ctx, p, off)
+	}
+	return node.Read(p, off)
+}
+
+// nodeWrite writes to the node, through WriteContext if implemented.
+func nodeWrite(ctx context.Context, node Node, p []byte, off uint64) (int, error) {
+	if cw, ok := node.(ContextWriter); ok {
+		return cw.WriteContext(ctx, p, off)
+	}
+	return node.Write(p, off)
+}
+
+// Server serves a FileServer over 9P2000, 9P2000.u and 9P2000.e. The
+// configuration must not be changed once serving has begun.
+type Server struct {
+	// FS is the file system to serve.
+	FS FileServer
+
+	// MessageSize is the maximum message size accepted by the server. If
+	// zero, DefaultMessageSize is used.
+	MessageSize uint32
+
+	// Versions are the protocol versions offered by the server. Clients
+	// requesting one of them get it, and clients requesting an unknown
+	// extension of 9P2000 get 9P2000 if it is offered, as no extension can
+	// stand in for another. If empty, 9P2000, 9P2000.u and 9P2000.e are
+	// offered.
+	Versions []string
+
+	// Sessions configures session persistence for 9P2000.e.
+	Sessions SessionConfig
+
+	// Credentials, if set, decides the user name of each attach from the
+	// credentials of the process at the other end of the connection, which
+	// are nil unless the connection is a unix socket on a system providing
+	// them. It receives the user name of the request and, for 9P2000.u, its
+	// numeric user ID, which is NONUNAME otherwise, and returns the user name
+	// to attach as, or an error to reject the attach. See CheckPeerCred and
+	// OverridePeerCred.
+	Credentials func(cred *PeerCred, uname string, uidno uint32) (string, error)
+
+	// TLSCredentials, if set, decides the user name of each attach from the
+	// verified client certificate of the connection, which is nil unless
+	// the connection is secured with TLS and the client presented a
+	// certificate that verified. It is called like Credentials, after it.
+	// See CheckCertificate and ListenTLS.
+	TLSCredentials func(cert *x509.Certificate, uname string, uidno uint32) (string, error)
+
+	// Auth, if set, runs the conversations on the auth files established
+	// with Tauth, and every attach must then name an auth file whose
+	// conversation has authenticated the user of the attach. If nil, Tauth
+	// is rejected with ErrNoAuth. Over a SecureConn, attaches without an
+	// auth file are accepted for the user who secured the connection only.
+	Auth Authenticator
+
+	// authPath numbers the qids of auth files.
+	authPath atomic.Uint64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	sessions  map[[8]byte]*session
+	closed    bool
+
+	// active counts the connections being served.
+	active sync.WaitGroup
+}
+
+// serverFid is the server side state of a fid.
+type serverFid struct {
+	node Node
+
+	// uname, aname and names record how the fid was established, so that it
+	// can be restored from a SessionStore.
+	uname, aname string
+	names        []string
+
+	// open and mode are protected by the mu of the session.
+	open bool
+	mode OpenMode
+
+	// dirmu protects the directory read state.
+	dirmu  sync.Mutex
+	dir    []Stat
+	diroff uint64
+}
+
+// serverConn is a single connection to a Server.
+type serverConn struct {
+	srv   *Server
+	rw    io.ReadWriteCloser
+	enc   *Encoder
+	proto Protocol
+	msize uint32
+
+	// cred holds the peer credentials of the connection, or nil.
+	cred *PeerCred
+
+	// secure holds the authentication securing the connection, or nil.
+	secure *AuthInfo
+
+	// cert holds the verified client certificate of the connection, or nil.
+	cert *x509.Certificate
+
+	// mu protects sess and inflight.
+	mu   sync.Mutex
+	sess *session
+
+	// inflight maps the tags of requests being handled to their state. A
+	// flushed request is removed, so that its tag can be reused while the
+	// request is still being handled.
+	inflight map[Tag]*serverRequest
+}
+
+// serverRequest is the state of a request being handled.
+type serverRequest struct {
+	// cancel cancels the context of the request.
+	cancel context.CancelFunc
+
+	// mu serializes sending the response with flushing the request, whose
+	// response is never sent once flushed is set.
+	mu      sync.Mutex
+	flushed bool
+}
+
+func (s *Server) messageSize() uint32 {
+	if s.MessageSize == 0 {
+		return DefaultMessageSize
+	}
+	return s.MessageSize
+}
+
+// negotiateVersion picks the protocol for a requested version from the
+// versions offered by the server.
+func (s *Server) negotiateVersion(version string) (string, Protocol) {
+	return negotiateVersion(s.Versions, version)
+}
+
+// negotiateVersion picks the protocol for a requested version from the
+// offered versions, defaulting to all supported versions if none are
+// offered. Unknown versions of 9P2000 are answered with 9P2000 if offered.
+func negotiateVersion(offered []string, version string) (string, Protocol) {
+	if len(offered) == 0 {
+		offered = []string{Version, VersionDotu, VersionDote}
+	}
+	for _, v := range offered {
+		if v == version {
+			return v, ProtocolForVersion(v)
+		}
+	}
+	if strings.HasPrefix(version, Version) {
+		for _, v := range offered {
+			if v == Version {
+				return v, NineP2000
+			}
+		}
+	}
+	return UnknownVersion, nil
+}
+
+// acceptVersion handles the Tversion that starts a connection, configuring
+// the codecs for the chosen protocol and message size. It is the server side
+// counterpart of handshake.
+func acceptVersion(enc *Encoder, dec *Decoder, msize uint32, offered []string) error {
+	m, err := dec.ReadMessage()
+	if err != nil {
+		return err
+	}
+	vr, ok := m.(*VersionRequest)
+	if !ok {
+		enc.WriteMessage(&ErrorResponse{Tag: m.GetTag(), Error: ErrUnexpectedMessage.Error()})
+		return ErrUnexpectedMessage
+	}
+
+	if vr.MessageSize < msize {
+		msize = vr.MessageSize
+	}
+	version, p := negotiateVersion(offered, vr.Version)
+	if err := enc.WriteMessage(&VersionResponse{Tag: vr.Tag, MessageSize: msize, Version: version}); err != nil {
+		return err
+	}
+	if p == nil {
+		return ErrVersionRejected
+	}
+
+	enc.Protocol = p
+	enc.MessageSize = msize
+	dec.Protocol = p
+	dec.MessageSize = msize
+	dec.Greedy = true
+	return dec.Reset()
+}
+
+// Serve accepts connections from the listener, serving each in its own
+// goroutine. Serve returns ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close stops the server, closing all listeners and connections, and waits
+// for the connections to finish. The requests of the connections are
+// cancelled, but Close still waits for nodes blocked in calls that do not
+// take a context. Sessions are not expired, and are left in the session
+// store to be resumed by a later server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+
+	for _, sc := range conns {
+		sc.rw.Close()
+	}
+	s.active.Wait()
+	s.stopSessions()
+	return err
+}
+
+// ServeConn serves a single connection, returning once the connection has
+// been closed and all requests have been handled. Requests still being
+// handled once the connection closes are cancelled. If the connection is a
+// *Conn, such as one accepted from a Listener, the version it negotiated is
+// used as is.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	defer rw.Close()
+
+	sc := &serverConn{
+		srv:      s,
+		rw:       rw,
+		enc:      &Encoder{Protocol: NineP2000, Writer: rw},
+		sess:     newSession(),
+		inflight: make(map[Tag]*serverRequest),
+	}
+	dec := &Decoder{Protocol: NineP2000, Reader: rw}
+	conn, negotiated := rw.(*Conn)
+	if negotiated {
+		sc.enc, dec = conn.Encoder, conn.Decoder
+	}
+	if s.Credentials != nil {
+		sc.cred, _ = connPeerCred(rw)
+	}
+	sc.secure = connAuthInfo(rw)
+	if s.TLSCredentials != nil {
+		sc.cert, _ = connCertificate(rw)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+	s.active.Add(1)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sc)
+		s.mu.Unlock()
+		s.active.Done()
+	}()
+
+	if negotiated {
+		sc.proto = sc.enc.Protocol
+		sc.msize = sc.enc.MessageSize
+	} else if err := sc.negotiate(dec); err != nil {
+		return err
+	}
+
+	// Requests are cancelled once the connection closes, so that the
+	// connection is not held open by requests that would never complete.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	first := true
+	var err error
+	for {
+		var m Message
+		m, err = dec.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		// Tsession must be the first request after Tversion.
+		if sr, ok := m.(*SessionRequestDote); ok && first {
+			first = false
+			sc.enc.WriteMessage(sc.resume(sr))
+			continue
+		}
+		first = false
+
+		rctx, rcancel := context.WithCancel(ctx)
+		req := &serverRequest{cancel: rcancel}
+		sc.mu.Lock()
+		sc.inflight[m.GetTag()] = req
+		sc.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.handle(rctx, m, req)
+		}()
+	}
+
+	cancel()
+	wg.Wait()
+	s.detach(sc.session())
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// negotiate performs version negotiation on a new connection.
+func (sc *serverConn) negotiate(dec *Decoder) error {
+	if err := acceptVersion(sc.enc, dec, sc.srv.messageSize(), sc.srv.Versions); err != nil {
+		return err
+	}
+	sc.proto = sc.enc.Protocol
+	sc.msize = sc.enc.MessageSize
+	return nil
+}
+
+// session returns the session of the connection.
+func (sc *serverConn) session() *session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.sess
+}
+
+// handle handles a request, sending the response unless the request was
+// flushed.
+func (sc *serverConn) handle(ctx context.Context, m Message, req *serverRequest) {
+	resp := sc.dispatch(ctx, m)
+
+	req.mu.Lock()
+	if !req.flushed {
+		sc.enc.WriteMessage(resp)
+	}
+	req.mu.Unlock()
+
+	sc.mu.Lock()
+	if sc.inflight[m.GetTag()] == req {
+		delete(sc.inflight, m.GetTag())
+	}
+	sc.mu.Unlock()
+	req.cancel()
+}
+
+// flush flushes the request with the tag, if it is being handled. Once
+// flush returns, the response to the request has either been sent or will
+// never be, and the request is cancelled.
+func (sc *serverConn) flush(oldtag Tag) {
+	sc.mu.Lock()
+	req := sc.inflight[oldtag]
+	delete(sc.inflight, oldtag)
+	sc.mu.Unlock()
+	if req == nil {
+		return
+	}
+
+	req.mu.Lock()
+	req.flushed = true
+	req.mu.Unlock()
+	req.cancel()
+}
+
+// errorResponse returns the error response for err.
+func (sc *serverConn) errorResponse(t Tag, err error) Message {
+	if sc.proto == NineP2000Dotu {
+		var errno uint32
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			errno = 2 // ENOENT
+		case errors.Is(err, fs.ErrPermission):
+			errno = 13 // EACCES
+		case errors.Is(err, fs.ErrExist):
+			errno = 17 // EEXIST
+		}
+		return &ErrorResponseDotu{Tag: t, Error: err.Error(), Errno: errno}
+	}
+	return &ErrorResponse{Tag: t, Error: err.Error()}
+}
+
+// fid returns the state of an existing fid.
+func (sc *serverConn) fid(fid Fid) (*serverFid, error) {
+	sess := sc.session()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	f, ok := sess.fids[fid]
+	if !ok {
+		return nil, ErrUnknownFid
+	}
+	return f, nil
+}
+
+// bind assigns a fid. If the fid is already in use, the node is released.
+func (sc *serverConn) bind(fid Fid, f *serverFid) error {
+	sess := sc.session()
+	sess.mu.Lock()
+	if _, ok := sess.fids[fid]; ok {
+		sess.mu.Unlock()
+		f.node.Clunk()
+		return ErrFidInUse
+	}
+	sess.fids[fid] = f
+	sess.mu.Unlock()
+	return nil
+}
+
+// unbind removes a fid, returning its state.
+func (sc *serverConn) unbind(fid Fid) (*serverFid, error) {
+	sess := sc.session()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	f, ok := sess.fids[fid]
+	if !ok {
+		return nil, ErrUnknownFid
+	}
+	delete(sess.fids, fid)
+	return f, nil
+}
+
+// openState returns whether the fid is open, and its mode.
+func (sc *serverConn) openState(f *serverFid) (bool, OpenMode) {
+	sess := sc.session()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return f.open, f.mode
+}
+
+// dispatch handles a request, returning the response.
+func (sc *serverConn) dispatch(ctx context.Context, m Message) Message {
+	t := m.GetTag()
+	resp, err := sc.serve(ctx, m)
+	if err != nil {
+		return sc.errorResponse(t, err)
+	}
+	return resp
+}
+
+func (sc *serverConn) serve(ctx context.Context, m Message) (Message, error) {
+	t := m.GetTag()
+	switch m := m.(type) {
+	case *AuthRequest:
+		return sc.auth(t, m.AuthFid, m.Username, m.Service)
+	case *AuthRequestDotu:
+		return sc.auth(t, m.AuthFid, m.Username, m.Service)
+
+	case *AttachRequest:
+		return sc.attach(t, m.Fid, m.AuthFid, m.Username, NONUNAME, m.Service)
+	case *AttachRequestDotu:
+		return sc.attach(t, m.Fid, m.AuthFid, m.Username, m.UIDno, m.Service)
+
+	case *FlushRequest:
+		sc.flush(m.OldTag)
+		return &FlushResponse{Tag: t}, nil
+
+	case *WalkRequest:
+		return sc.walk(t, m)
+
+	case *OpenRequest:
+		f, err := sc.fid(m.Fid)
+		if err != nil {
+			return nil, err
+		}
+		if open, _ := sc.openState(f); open {
+			return nil, ErrFidOpen
+		}
+		iounit, err := f.node.Open(m.Mode)
+		if err != nil {
+			return nil, err
+		}
+		sc.setOpen(f, m.Mode)
+		return &OpenResponse{Tag: t, Qid: f.node.Qid(), IOUnit: iounit}, nil
+
+	case *CreateRequest:
+		return sc.create(t, m.Fid, m.Name, m.Permissions, m.Mode)
+	case *CreateRequestDotu:
+		return sc.create(t, m.Fid, m.Name, m.Permissions, m.Mode)
+
+	case *ReadRequest:
+		return sc.read(ctx, t, m)
+
+	case *WriteRequest:
+		f, err := sc.fid(m.Fid)
+		if err != nil {
+			return nil, err
+		}
+		if open, mode := sc.openState(f); !open || mode&3 == OREAD || mode&3 == OEXEC {
+			return nil, ErrFidNotOpen
+		}
+		n, err := nodeWrite(ctx, f.node, m.Data, m.Offset)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+		return &WriteResponse{Tag: t, Count: uint32(n)}, nil
+
+	case *ClunkRequest:
+		f, err := sc.unbind(m.Fid)
+		if err != nil {
+			return nil, err
+		}
+		if err := sc.session().release(f); err != nil {
+			return nil, err
+		}
+		return &ClunkResponse{Tag: t}, nil
+
+	case *RemoveRequest:
+		f, err := sc.unbind(m.Fid)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.node.Remove(); err != nil {
+			return nil, err
+		}
+		return &RemoveResponse{Tag: t}, nil
+
+	case *StatRequest:
+		f, err := sc.fid(m.Fid)
+		if err != nil {
+			return nil, err
+		}
+		s, err := f.node.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if sc.proto == NineP2000Dotu {
+			return &StatResponseDotu{Tag: t, Stat: statDotu(s)}, nil
+		}
+		return &StatResponse{Tag: t, Stat: s}, nil
+
+	case *WriteStatRequest:
+		return sc.wstat(t, m.Fid, m.Stat)
+	case *WriteStatRequestDotu:
+		return sc.wstat(t, m.Fid, m.Stat.stat())
+
+	case *SimpleReadRequestDote:
+		return sc.sread(ctx, t, m)
+	case *SimpleWriteRequestDote:
+		return sc.swrite(ctx, t, m)
+
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+}
+
+// statDotu returns the Stat struct with empty 9P2000.u extensions.
+func statDotu(s Stat) StatDotu {
+	return StatDotu{
+		Type:   s.Type,
+		Dev:    s.Dev,
+		Qid:    s.Qid,
+		Mode:   s.Mode,
+		Atime:  s.Atime,
+		Mtime:  s.Mtime,
+		Length: s.Length,
+		Name:   s.Name,
+		UID:    s.UID,
+		GID:    s.GID,
+		MUID:   s.MUID,
+		UIDno:  NONUNAME,
+		GIDno:  NONUNAME,
+		MUIDno: NONUNAME,
+	}
+}
+
+func (sc *serverConn) setOpen(f *serverFid, mode OpenMode) {
+	sess := sc.session()
+	sess.mu.Lock()
+	f.open = true
+	f.mode = mode
+	sess.mu.Unlock()
+}
+
+// user checks that the connection has authenticated the user of an attach,
+// and returns the user name to attach as, as decided by Credentials and
+// TLSCredentials.
+func (sc *serverConn) user(afid Fid, uname string, uidno uint32) (string, error) {
+	if err := sc.authenticated(afid, uname); err != nil {
+		return "", err
+	}
+	if creds := sc.srv.Credentials; creds != nil {
+		var err error
+		if uname, err = creds(sc.cred, uname, uidno); err != nil {
+			return "", err
+		}
+	}
+	if creds := sc.srv.TLSCredentials; creds != nil {
+		var err error
+		if uname, err = creds(sc.cert, uname, uidno); err != nil {
+			return "", err
+		}
+	}
+	return uname, nil
+}
+
+func (sc *serverConn) attach(t Tag, fid, afid Fid, uname string, uidno uint32, aname string) (Message, error) {
+	if _, err := sc.fid(fid); err == nil {
+		return nil, ErrFidInUse
+	}
+	uname, err := sc.user(afid, uname, uidno)
+	if err != nil {
+		return nil, err
+	}
+	node, err := sc.srv.FS.Attach(uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	if err := sc.bind(fid, &serverFid{node: node, uname: uname, aname: aname}); err != nil {
+		return nil, err
+	}
+	return &AttachResponse{Tag: t, Qid: node.Qid()}, nil
+}
+
+func (sc *serverConn) walk(t Tag, m *WalkRequest) (Message, error) {
+	if len(m.Names) > MAXWELEM {
+		return nil, ErrUnexpectedMessage
+	}
+	f, err := sc.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if open, _ := sc.openState(f); open {
+		return nil, ErrFidOpen
+	}
+	if m.NewFid != m.Fid {
+		if _, err := sc.fid(m.NewFid); err == nil {
+			return nil, ErrFidInUse
+		}
+	}
+
+	qids, node, err := f.node.Walk(m.Names)
+	if err != nil {
+		return nil, err
+	}
+	if qids == nil {
+		qids = []Qid{}
+	}
+	if node == nil {
+		return &WalkResponse{Tag: t, Qids: qids}, nil
+	}
+
+	nf := &serverFid{
+		node:  node,
+		uname: f.uname,
+		aname: f.aname,
+		names: append(append([]string{}, f.names...), m.Names...),
+	}
+	if m.NewFid == m.Fid {
+		sess := sc.session()
+		sess.mu.Lock()
+		sess.fids[m.Fid] = nf
+		sess.mu.Unlock()
+		f.node.Clunk()
+	} else if err := sc.bind(m.NewFid, nf); err != nil {
+		return nil, err
+	}
+	return &WalkResponse{Tag: t, Qids: qids}, nil
+}
+
+func (sc *serverConn) create(t Tag, fid Fid, name string, perm FileMode, mode OpenMode) (Message, error) {
+	f, err := sc.fid(fid)
+	if err != nil {
+		return nil, err
+	}
+	if open, _ := sc.openState(f); open {
+		return nil, ErrFidOpen
+	}
+	node, iounit, err := f.node.Create(name, perm, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	nf := &serverFid{
+		node:  node,
+		uname: f.uname,
+		aname: f.aname,
+		names: append(append([]string{}, f.names...), name),
+		open:  true,
+		mode:  mode,
+	}
+	sess := sc.session()
+	sess.mu.Lock()
+	sess.fids[fid] = nf
+	sess.mu.Unlock()
+	f.node.Clunk()
+	return &CreateResponse{Tag: t, Qid: node.Qid(), IOUnit: iounit}, nil
+}
+
+func (sc *serverConn) read(ctx context.Context, t Tag, m *ReadRequest) (Message, error) {
+	f, err := sc.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if open, mode := sc.openState(f); !open || mode&3 == OWRITE {
+		return nil, ErrFidNotOpen
+	}
+
+	count := m.Count
+	if max := sc.msize - ReadOverhead; count > max {
+		count = max
+	}
+	data, err := sc.readFid(ctx, f, m.Offset, count)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadResponse{Tag: t, Data: data}, nil
+}
+
+// readFid reads from an opened fid, handling directories implementing
+// DirReader.
+func (sc *serverConn) readFid(ctx context.Context, f *serverFid, offset uint64, count uint32) ([]byte, error) {
+	if dr, ok := f.node.(DirReader); ok && f.node.Qid().Type&QTDIR != 0 {
+		return sc.readDir(f, dr, offset, count)
+	}
+
+	buf := make([]byte, count)
+	n, err := nodeRead(ctx, f.node, buf, offset)
+	if err != nil && err != io.EOF && n == 0 {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readDir packs directory entries into a read. Entries are never split, and
+// reads must continue at the offset where the previous read ended.
+func (sc *serverConn) readDir(f *serverFid, dr DirReader, offset uint64, count uint32) ([]byte, error) {
+	f.dirmu.Lock()
+	defer f.dirmu.Unlock()
+
+	if offset == 0 {
+		stats, err := dr.ReadDir()
+		if err != nil {
+			return nil, err
+		}
+		f.dir = stats
+		f.diroff = 0
+	} else if offset != f.diroff {
+		return nil, ErrBadDirOffset
+	}
+
+	b := []byte{}
+	for len(f.dir) > 0 {
+		var m interface {
+			EncodedSize() int
+			Marshal([]byte) error
+		} = &f.dir[0]
+		if sc.proto == NineP2000Dotu {
+			sd := statDotu(f.dir[0])
+			m = &sd
+		}
+		size := m.EncodedSize()
+		if len(b)+size > int(count) {
+			break
+		}
+		buf := make([]byte, size)
+		if err := m.Marshal(buf); err != nil {
+			return nil, err
+		}
+		b = append(b, buf...)
+		f.dir = f.dir[1:]
+	}
+	f.diroff += uint64(len(b))
+	return b, nil
+}
+
+func (sc *serverConn) wstat(t Tag, fid Fid, s Stat) (Message, error) {
+	f, err := sc.fid(fid)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.node.WriteStat(s); err != nil {
+		return nil, err
+	}
+	return &WriteStatResponse{Tag: t}, nil
+}
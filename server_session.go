@@ -0,0 +1,414 @@
+package qp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSessionGrace is how long detached sessions are kept if no grace
+// period is configured.
+const DefaultSessionGrace = time.Minute
+
+var (
+	// ErrUnknownSession indicates a Tsession with a key that does not
+	// identify a resumable session.
+	ErrUnknownSession = errors.New("unknown session")
+
+	// ErrSessionInUse indicates a Tsession for a session that is attached to
+	// another connection.
+	ErrSessionInUse = errors.New("session in use")
+)
+
+// SessionConfig configures 9P2000.e session persistence. A session is the
+// fid table of a connection. Once bound to a key, a session outlives its
+// connection for the grace period, during which a new connection may resume
+// it with a Tsession carrying the key. Sessions without a key are clunked
+// when their connection closes.
+//
+// As Tsession precedes any Tauth, a connection only resumes a session if it
+// could attach as each user of the session's fids without an auth file, as
+// decided by Credentials, TLSCredentials and SecureConn. Sessions of users
+// authenticated through Server.Auth can therefore only be resumed over a
+// SecureConn established by the same user.
+type SessionConfig struct {
+	// Grace is how long a detached session is kept. If zero,
+	// DefaultSessionGrace is used.
+	Grace time.Duration
+
+	// Bind, if set, binds the new session of a connection to the key of a
+	// Tsession that failed because the key was unknown, allowing clients to
+	// pick their own session keys.
+	Bind bool
+
+	// Store, if set, persists detached sessions, so that they can be
+	// resumed by another server process using the same store. Sessions
+	// resumed from the store are restored by attaching, walking and opening
+	// their fids again.
+	Store SessionStore
+}
+
+func (sc *SessionConfig) grace() time.Duration {
+	if sc.Grace == 0 {
+		return DefaultSessionGrace
+	}
+	return sc.Grace
+}
+
+// SessionStore persists detached sessions.
+type SessionStore interface {
+	// Save stores the state of a session, replacing any previous state for
+	// the key.
+	Save(state *SessionState) error
+
+	// Load returns the state stored for the key, or ErrUnknownSession if
+	// none is stored.
+	Load(key [8]byte) (*SessionState, error)
+
+	// Delete removes the state stored for the key, if any.
+	Delete(key [8]byte) error
+}
+
+// SessionState is the persisted state of a session.
+type SessionState struct {
+	Key      [8]byte      `json:"key"`
+	Detached time.Time    `json:"detached"`
+	Fids     []SessionFid `json:"fids"`
+}
+
+// SessionFid is the persisted state of a fid, describing how to establish it
+// again.
+type SessionFid struct {
+	Fid   Fid      `json:"fid"`
+	Uname string   `json:"uname"`
+	Aname string   `json:"aname"`
+	Names []string `json:"names"`
+	Open  bool     `json:"open"`
+	Mode  OpenMode `json:"mode"`
+}
+
+// DirSessionStore is a SessionStore keeping each session as a JSON file in a
+// directory.
+type DirSessionStore struct {
+	// Dir is the directory to store sessions in, which must exist.
+	Dir string
+}
+
+func (ds *DirSessionStore) path(key [8]byte) string {
+	return filepath.Join(ds.Dir, hex.EncodeToString(key[:])+".json")
+}
+
+// Save implements SessionStore. The state is written to a temporary file
+// first, so that a crash never leaves a partial state behind.
+func (ds *DirSessionStore) Save(state *SessionState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := ds.path(state.Key)
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Load implements SessionStore.
+func (ds *DirSessionStore) Load(key [8]byte) (*SessionState, error) {
+	b, err := os.ReadFile(ds.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUnknownSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state SessionState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Delete implements SessionStore.
+func (ds *DirSessionStore) Delete(key [8]byte) error {
+	err := os.Remove(ds.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// session is a fid table, which may outlive its connection.
+type session struct {
+	// mu protects fids, as well as the open state of the fids.
+	mu   sync.Mutex
+	fids map[Fid]*serverFid
+
+	// key, attached and timer are protected by the mu of the server. key is
+	// nil for sessions that cannot be resumed, and timer is set while the
+	// session is detached.
+	key      *[8]byte
+	attached bool
+	timer    *time.Timer
+}
+
+func newSession() *session {
+	return &session{fids: make(map[Fid]*serverFid), attached: true}
+}
+
+// release releases the node of a clunked fid, removing the file if it was
+// opened with ORCLOSE.
+func (sess *session) release(f *serverFid) error {
+	sess.mu.Lock()
+	open, mode := f.open, f.mode
+	sess.mu.Unlock()
+	if open && mode&ORCLOSE != 0 {
+		return f.node.Remove()
+	}
+	return f.node.Clunk()
+}
+
+// clunkAll clunks all fids of the session.
+func (sess *session) clunkAll() {
+	sess.mu.Lock()
+	fids := sess.fids
+	sess.fids = make(map[Fid]*serverFid)
+	sess.mu.Unlock()
+
+	for _, f := range fids {
+		sess.release(f)
+	}
+}
+
+// users returns the users the fids of the session were established for.
+func (sess *session) users() []string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	var unames []string
+	for _, f := range sess.fids {
+		unames = append(unames, f.uname)
+	}
+	return unames
+}
+
+// authorize checks that the connection may take over fids established for
+// the users, which is the case if it could attach as each of them without
+// an auth file.
+func (sc *serverConn) authorize(unames []string) error {
+	seen := make(map[string]bool)
+	for _, uname := range unames {
+		if seen[uname] {
+			continue
+		}
+		seen[uname] = true
+		user, err := sc.user(NOFID, uname, NONUNAME)
+		if err != nil {
+			return err
+		}
+		if user != uname {
+			return fs.ErrPermission
+		}
+	}
+	return nil
+}
+
+// state returns the persistable state of the session.
+func (sess *session) state(key [8]byte) *SessionState {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	state := &SessionState{Key: key, Detached: time.Now(), Fids: []SessionFid{}}
+	for fid, f := range sess.fids {
+		// Auth files are left out, as their conversations cannot be
+		// persisted.
+		if _, ok := f.node.(*authNode); ok {
+			continue
+		}
+		state.Fids = append(state.Fids, SessionFid{
+			Fid:   fid,
+			Uname: f.uname,
+			Aname: f.aname,
+			Names: f.names,
+			Open:  f.open,
+			Mode:  f.mode,
+		})
+	}
+	sort.Slice(state.Fids, func(i, j int) bool { return state.Fids[i].Fid < state.Fids[j].Fid })
+	return state
+}
+
+// setSession replaces the session of the connection.
+func (sc *serverConn) setSession(sess *session) {
+	sc.mu.Lock()
+	sc.sess = sess
+	sc.mu.Unlock()
+}
+
+// resume handles a Tsession, which is always the first request after
+// Tversion, and therefore received while the session of the connection is
+// still empty.
+func (sc *serverConn) resume(sr *SessionRequestDote) Message {
+	s := sc.srv
+	key := sr.Key
+
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[[8]byte]*session)
+	}
+	if sess, ok := s.sessions[key]; ok {
+		if sess.attached {
+			s.mu.Unlock()
+			return sc.errorResponse(sr.Tag, ErrSessionInUse)
+		}
+		s.mu.Unlock()
+
+		// The fids of a detached session do not change, but the session
+		// may be resumed or expire while the users are checked.
+		if err := sc.authorize(sess.users()); err != nil {
+			return sc.errorResponse(sr.Tag, err)
+		}
+		s.mu.Lock()
+		if sess.attached || s.sessions[key] != sess {
+			s.mu.Unlock()
+			return sc.errorResponse(sr.Tag, ErrSessionInUse)
+		}
+		sess.attached = true
+		if sess.timer != nil {
+			sess.timer.Stop()
+			sess.timer = nil
+		}
+		s.mu.Unlock()
+		sc.setSession(sess)
+		return &SessionResponseDote{Tag: sr.Tag}
+	}
+	s.mu.Unlock()
+
+	if store := s.Sessions.Store; store != nil {
+		state, err := store.Load(key)
+		if err == nil && time.Since(state.Detached) <= s.Sessions.grace() {
+			var unames []string
+			for _, sf := range state.Fids {
+				unames = append(unames, sf.Uname)
+			}
+			if err := sc.authorize(unames); err != nil {
+				return sc.errorResponse(sr.Tag, err)
+			}
+			sess := s.restoreSession(state)
+			s.mu.Lock()
+			if _, ok := s.sessions[key]; ok {
+				s.mu.Unlock()
+				sess.clunkAll()
+				return sc.errorResponse(sr.Tag, ErrSessionInUse)
+			}
+			sess.key = &key
+			s.sessions[key] = sess
+			s.mu.Unlock()
+			sc.setSession(sess)
+			return &SessionResponseDote{Tag: sr.Tag}
+		}
+		if err == nil {
+			store.Delete(key)
+		}
+	}
+
+	if s.Sessions.Bind {
+		s.mu.Lock()
+		if _, ok := s.sessions[key]; !ok {
+			sess := sc.session()
+			sess.key = &key
+			s.sessions[key] = sess
+		}
+		s.mu.Unlock()
+	}
+	return sc.errorResponse(sr.Tag, ErrUnknownSession)
+}
+
+// restoreSession establishes the fids of a stored session again. Fids that
+// cannot be restored are left out, and files are never truncated when
+// reopened. The caller must have authorized the users of the fids.
+func (s *Server) restoreSession(state *SessionState) *session {
+	sess := newSession()
+	for _, sf := range state.Fids {
+		node, err := s.FS.Attach(sf.Uname, sf.Aname)
+		if err != nil {
+			continue
+		}
+		if len(sf.Names) > 0 {
+			if node, err = walkNode(node, sf.Names, true); err != nil {
+				continue
+			}
+		}
+		if sf.Open {
+			if _, err := node.Open(sf.Mode &^ OTRUNC); err != nil {
+				node.Clunk()
+				continue
+			}
+		}
+		sess.fids[sf.Fid] = &serverFid{
+			node:  node,
+			uname: sf.Uname,
+			aname: sf.Aname,
+			names: sf.Names,
+			open:  sf.Open,
+			mode:  sf.Mode,
+		}
+	}
+	return sess
+}
+
+// detach detaches the session of a closed connection. Sessions with a key
+// are kept for the grace period and saved to the store, while others are
+// clunked right away. After Close, sessions are saved but never expired.
+func (s *Server) detach(sess *session) {
+	s.mu.Lock()
+	if sess.key == nil {
+		s.mu.Unlock()
+		sess.clunkAll()
+		return
+	}
+	key := *sess.key
+	sess.attached = false
+	if !s.closed {
+		sess.timer = time.AfterFunc(s.Sessions.grace(), func() { s.expire(sess) })
+	}
+	s.mu.Unlock()
+
+	if store := s.Sessions.Store; store != nil {
+		store.Save(sess.state(key))
+	}
+}
+
+// expire removes a session whose grace period has ended, clunking its fids.
+func (s *Server) expire(sess *session) {
+	s.mu.Lock()
+	key := *sess.key
+	if sess.attached || s.sessions[key] != sess {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, key)
+	sess.timer = nil
+	s.mu.Unlock()
+
+	sess.clunkAll()
+	if store := s.Sessions.Store; store != nil {
+		store.Delete(key)
+	}
+}
+
+// stopSessions stops the expiry of all detached sessions.
+func (s *Server) stopSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.timer != nil {
+			sess.timer.Stop()
+			sess.timer = nil
+		}
+	}
+}
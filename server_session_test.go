@@ -0,0 +1,217 @@
+package qp
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rawSession sends Tsession with the key on a new connection to srv,
+// returning the response.
+func rawSession(t *testing.T, srv *Server, key [8]byte) Message {
+	conn, _ := serverDial(srv)()
+	defer conn.Close()
+
+	enc := &Encoder{Protocol: NineP2000Dote, Writer: conn}
+	dec := &Decoder{Protocol: NineP2000Dote, Reader: conn}
+	enc.WriteMessage(&VersionRequest{Tag: NOTAG, MessageSize: 8192, Version: VersionDote})
+	if _, err := dec.ReadMessage(); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	enc.WriteMessage(&SessionRequestDote{Tag: NOTAG, Key: key})
+	m, err := dec.ReadMessage()
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	return m
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// detached reports whether the session with the key is detached.
+func detached(srv *Server, key [8]byte) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sess, ok := srv.sessions[key]
+	return ok && !sess.attached
+}
+
+// sessionClient returns a 9P2000.e client of srv presenting the key, with the
+// file at the path opened.
+func sessionClient(t *testing.T, srv *Server, key [8]byte, path string, mode OpenMode) (*Client, *File) {
+	conn, _ := serverDial(srv)()
+	c := NewClient(conn)
+	c.SetSessionKey(key)
+	if err := c.Negotiate(8192, VersionDote); err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	root, err := c.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	f, err := root.Walk(SplitPath(path)...)
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if err := f.Open(mode); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	return c, f
+}
+
+func TestServerSessionResume(t *testing.T) {
+	key := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("content"))
+	rs := newRamServer(rfs)
+	srv := &Server{FS: rs, Sessions: SessionConfig{Bind: true}}
+
+	c, f := sessionClient(t, srv, key, "file", OREAD)
+	c.Redial = func() (io.ReadWriteCloser, error) {
+		waitFor(t, "detach", func() bool { return detached(srv, key) })
+		return serverDial(srv)()
+	}
+
+	if m, ok := rawSession(t, srv, key).(*ErrorResponse); !ok || m.Error != ErrSessionInUse.Error() {
+		t.Errorf("expected %v for attached session, got %v", ErrSessionInUse, m)
+	}
+
+	dropConn(t, c)
+
+	buf := make([]byte, 7)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "content" {
+		t.Errorf("read after resume returned %q, %v", buf, err)
+	}
+	if attaches, live := rs.counts(); attaches != 1 || live != 2 {
+		t.Errorf("expected 1 attach and 2 live nodes, got %d and %d", attaches, live)
+	}
+}
+
+func TestServerSessionExpire(t *testing.T) {
+	key := [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	store := &DirSessionStore{Dir: t.TempDir()}
+	rfs := newRamFS()
+	rfs.add("file", 0644, nil)
+	rs := newRamServer(rfs)
+	srv := &Server{FS: rs, Sessions: SessionConfig{Bind: true, Grace: 10 * time.Millisecond, Store: store}}
+
+	c, _ := sessionClient(t, srv, key, "file", ORDWR|ORCLOSE)
+	c.Close()
+
+	waitFor(t, "expiry", func() bool {
+		_, live := rs.counts()
+		return live == 0
+	})
+	if rfs.lookup("file") != nil {
+		t.Error("expected expiry to remove ORCLOSE file")
+	}
+	if _, err := store.Load(key); err != ErrUnknownSession {
+		t.Errorf("expected expired session to be deleted from store, got %v", err)
+	}
+	if m, ok := rawSession(t, srv, key).(*ErrorResponse); !ok || m.Error != ErrUnknownSession.Error() {
+		t.Errorf("expected %v for expired session, got %v", ErrUnknownSession, m)
+	}
+}
+
+func TestServerSessionStore(t *testing.T) {
+	key := [8]byte{4, 4, 4, 4}
+	store := &DirSessionStore{Dir: t.TempDir()}
+	rfs := newRamFS()
+	rfs.add("dir/file", 0644, nil)
+	rs := newRamServer(rfs)
+	srv1 := &Server{FS: rs, Sessions: SessionConfig{Bind: true, Store: store}}
+	srv2 := &Server{FS: rs, Sessions: SessionConfig{Store: store}}
+	defer srv2.Close()
+
+	c, f := sessionClient(t, srv1, key, "dir/file", ORDWR|OTRUNC)
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	restarted := make(chan struct{})
+	c.Redial = func() (io.ReadWriteCloser, error) {
+		<-restarted
+		return serverDial(srv2)()
+	}
+	srv1.Close()
+	close(restarted)
+
+	// The session is restored by the new server from the store, without
+	// truncating the file again.
+	buf := make([]byte, 4)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Errorf("read after restart returned %q, %v", buf, err)
+	}
+	if attaches, _ := rs.counts(); attaches != 3 {
+		t.Errorf("expected 3 attaches, got %d", attaches)
+	}
+	if c.Err() != nil {
+		t.Errorf("client failed: %v", c.Err())
+	}
+}
+
+func TestServerSessionIdentity(t *testing.T) {
+	key := [8]byte{9, 9, 9}
+	store := &DirSessionStore{Dir: t.TempDir()}
+	rfs := newRamFS()
+	rfs.add("file", 0644, nil)
+
+	// The policy stands in for credentials that identify the user at the
+	// other end of each connection.
+	var mu sync.Mutex
+	peer := "glenda"
+	setPeer := func(uname string) {
+		mu.Lock()
+		peer = uname
+		mu.Unlock()
+	}
+	policy := func(_ *PeerCred, uname string, _ uint32) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if uname != peer {
+			return "", fs.ErrPermission
+		}
+		return uname, nil
+	}
+	srv1 := &Server{FS: newRamServer(rfs), Credentials: policy, Sessions: SessionConfig{Bind: true, Store: store}}
+	srv2 := &Server{FS: newRamServer(rfs), Credentials: policy, Sessions: SessionConfig{Store: store}}
+	defer srv1.Close()
+	defer srv2.Close()
+
+	c, _ := sessionClient(t, srv1, key, "file", OREAD)
+	c.Close()
+	waitFor(t, "detach", func() bool { return detached(srv1, key) })
+
+	for _, srv := range []*Server{srv1, srv2} {
+		setPeer("bootes")
+		if m, ok := rawSession(t, srv, key).(*ErrorResponse); !ok || m.Error != fs.ErrPermission.Error() {
+			t.Errorf("expected %v for session of another user, got %v", fs.ErrPermission, m)
+		}
+		setPeer("glenda")
+		if m, ok := rawSession(t, srv, key).(*SessionResponseDote); !ok {
+			t.Errorf("expected session to be resumed, got %v", m)
+		}
+		waitFor(t, "detach", func() bool { return detached(srv, key) })
+	}
+
+	// Without credentials, users authenticated through Tauth cannot be
+	// identified before the session is resumed.
+	srv3 := &Server{FS: newRamServer(rfs), Auth: &SharedSecretAuth{}, Sessions: SessionConfig{Store: store}}
+	defer srv3.Close()
+	if m, ok := rawSession(t, srv3, key).(*ErrorResponse); !ok || m.Error != ErrAuthRequired.Error() {
+		t.Errorf("expected %v for session without credentials, got %v", ErrAuthRequired, m)
+	}
+}
@@ -0,0 +1,176 @@
+package qp
+
+import (
+	"context"
+	"io/fs"
+)
+
+// SimpleReader may be implemented by nodes to serve Tsread requests walking
+// from them directly, instead of through Walk, Open, Read and Clunk.
+type SimpleReader interface {
+	// SimpleRead reads the file at the names, returning at most count
+	// bytes.
+	SimpleRead(names []string, count uint32) ([]byte, error)
+}
+
+// SimpleWriter may be implemented by nodes to serve Tswrite requests walking
+// from them directly, instead of through Walk, Create, Open, Write and
+// Clunk.
+type SimpleWriter interface {
+	// SimpleWrite creates the file at the names if it does not exist,
+	// truncates it and writes the data to it, returning the amount of data
+	// written.
+	SimpleWrite(names []string, data []byte) (uint32, error)
+}
+
+// walkNode walks from the node along any amount of names, at most MAXWELEM at
+// a time, returning the node of the destination. If release is set, the
+// starting node is released, and is otherwise left untouched. An incomplete
+// walk fails with fs.ErrNotExist.
+func walkNode(node Node, names []string, release bool) (Node, error) {
+	for {
+		n := len(names)
+		if n > MAXWELEM {
+			n = MAXWELEM
+		}
+		_, next, err := node.Walk(names[:n])
+		if release {
+			node.Clunk()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		node, names, release = next, names[n:], true
+		if len(names) == 0 {
+			return node, nil
+		}
+	}
+}
+
+// sread serves a Tsread as a walk, open, read until end of file or the
+// message size, and clunk. Directories are read until an empty read, as their
+// reads end short of whole entries, while other files are read until a short
+// read, as files such as event files block once they have returned what is
+// available.
+func (sc *serverConn) sread(ctx context.Context, t Tag, m *SimpleReadRequestDote) (Message, error) {
+	f, err := sc.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if open, _ := sc.openState(f); open {
+		return nil, ErrFidOpen
+	}
+	count := sc.msize - ReadOverhead
+
+	if sr, ok := f.node.(SimpleReader); ok {
+		data, err := sr.SimpleRead(m.Names, count)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(data)) > count {
+			data = data[:count]
+		}
+		return &SimpleReadResponseDote{Tag: t, Data: data}, nil
+	}
+
+	node, err := walkNode(f.node, m.Names, false)
+	if err != nil {
+		return nil, err
+	}
+	defer node.Clunk()
+
+	iounit, err := node.Open(OREAD)
+	if err != nil {
+		return nil, err
+	}
+	nf := &serverFid{
+		node:  node,
+		uname: f.uname,
+		aname: f.aname,
+		names: append(append([]string{}, f.names...), m.Names...),
+		open:  true,
+		mode:  OREAD,
+	}
+	dir := node.Qid().Type&QTDIR != 0
+
+	data := []byte{}
+	for uint32(len(data)) < count {
+		n := count - uint32(len(data))
+		if iounit != 0 && n > iounit {
+			n = iounit
+		}
+		b, err := sc.readFid(ctx, nf, uint64(len(data)), n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+		if len(b) == 0 || (!dir && uint32(len(b)) < n) {
+			break
+		}
+	}
+	return &SimpleReadResponseDote{Tag: t, Data: data}, nil
+}
+
+// swrite serves a Tswrite as a walk to the directory, a create of the file
+// ignoring failure, a walk to and truncating open of the file, a write of all
+// data, and a clunk.
+func (sc *serverConn) swrite(ctx context.Context, t Tag, m *SimpleWriteRequestDote) (Message, error) {
+	if len(m.Names) == 0 {
+		return nil, fs.ErrInvalid
+	}
+	f, err := sc.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if open, _ := sc.openState(f); open {
+		return nil, ErrFidOpen
+	}
+
+	if sw, ok := f.node.(SimpleWriter); ok {
+		n, err := sw.SimpleWrite(m.Names, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &SimpleWriteResponseDote{Tag: t, Count: n}, nil
+	}
+
+	dir := f.node
+	dirnames, name := m.Names[:len(m.Names)-1], m.Names[len(m.Names)-1]
+	if len(dirnames) > 0 {
+		if dir, err = walkNode(f.node, dirnames, false); err != nil {
+			return nil, err
+		}
+		defer dir.Clunk()
+	}
+
+	node, _, err := dir.Create(name, 0666, OWRITE|OTRUNC)
+	if err != nil {
+		if node, err = walkNode(dir, []string{name}, false); err != nil {
+			return nil, err
+		}
+		if _, err := node.Open(OWRITE | OTRUNC); err != nil {
+			node.Clunk()
+			return nil, err
+		}
+	}
+	defer node.Clunk()
+
+	var written int
+	for written < len(m.Data) {
+		n, err := nodeWrite(ctx, node, m.Data[written:], uint64(written))
+		written += n
+		if err != nil {
+			if written == 0 {
+				return nil, err
+			}
+			break
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return &SimpleWriteResponseDote{Tag: t, Count: uint32(written)}, nil
+}
@@ -0,0 +1,201 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// simpleNode overrides Tsread and Tswrite handling for a ramServerNode.
+type simpleNode struct {
+	*ramServerNode
+	reads, writes int
+}
+
+func (n *simpleNode) SimpleRead(names []string, count uint32) ([]byte, error) {
+	n.reads++
+	return []byte(strings.Join(names, "/")), nil
+}
+
+func (n *simpleNode) SimpleWrite(names []string, data []byte) (uint32, error) {
+	n.writes++
+	return uint32(len(data)), nil
+}
+
+type simpleServer struct {
+	*ramServer
+	root *simpleNode
+}
+
+func (ss *simpleServer) Attach(uname, aname string) (Node, error) {
+	return ss.root, nil
+}
+
+func TestServerSimple(t *testing.T) {
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, "d"+strconv.Itoa(i))
+	}
+	deep := strings.Join(names, "/") + "/file"
+
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("old content"))
+	rfs.add(deep, 0644, []byte("deep"))
+	rfs.add("big", 0644, bytes.Repeat([]byte("x"), 10000))
+	rfs.add("dir/a", 0644, nil)
+	rfs.iounit = 100
+	rs := newRamServer(rfs)
+	c := serverClient(t, &Server{FS: rs}, VersionDote)
+	if _, err := c.Attach(nil, "glenda", ""); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	if b, err := c.ReadFile(deep); err != nil || string(b) != "deep" {
+		t.Errorf("read of deep file returned %q, %v", b, err)
+	}
+	if b, err := c.ReadFile("big"); err != nil || len(b) != 10000 {
+		t.Errorf("read of big file returned %d bytes, %v", len(b), err)
+	}
+	if _, err := c.ReadFile("nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	// Directories are read as packed Stat entries.
+	resp, err := c.RPC(&SimpleReadRequestDote{Fid: c.root.Fid(), Names: []string{"dir"}})
+	if err != nil {
+		t.Fatalf("Tsread of directory failed: %v", err)
+	}
+	data := resp.(*SimpleReadResponseDote).Data
+	if s, size, err := unmarshalDirEntry(data, false); err != nil || size != len(data) || s.Name != "a" {
+		t.Errorf("Tsread of directory returned %+v, %v", s, err)
+	}
+
+	if err := c.WriteFile("file", []byte("new"), 0644); err != nil {
+		t.Errorf("write of existing file failed: %v", err)
+	}
+	if err := c.WriteFile("dir/b", []byte("created"), 0644); err != nil {
+		t.Errorf("write of new file failed: %v", err)
+	}
+	if err := c.WriteFile("nope/b", []byte("created"), 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	for path, expected := range map[string]string{"file": "new", "dir/b": "created"} {
+		if n := rfs.lookup(path); n == nil || string(n.data) != expected {
+			t.Errorf("%s: expected %q", path, expected)
+		}
+	}
+
+	if _, live := rs.counts(); live != 1 {
+		t.Errorf("expected only the root to be live, got %d nodes", live)
+	}
+}
+
+func TestServerSimpleOverride(t *testing.T) {
+	rs := newRamServer(newRamFS())
+	ss := &simpleServer{ramServer: rs, root: &simpleNode{ramServerNode: rs.node(rs.fs.root)}}
+	c := serverClient(t, &Server{FS: ss}, VersionDote)
+	if _, err := c.Attach(nil, "glenda", ""); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	if b, err := c.ReadFile("a/b"); err != nil || string(b) != "a/b" {
+		t.Errorf("read returned %q, %v", b, err)
+	}
+	if err := c.WriteFile("a/b", []byte("data"), 0644); err != nil {
+		t.Errorf("write failed: %v", err)
+	}
+	if ss.root.reads != 1 || ss.root.writes != 1 {
+		t.Errorf("expected overrides to be used, got %d reads and %d writes", ss.root.reads, ss.root.writes)
+	}
+}
+
+// eventNode serves files named events as event files, which always have an
+// event to read.
+type eventNode struct {
+	Node
+	reads *int
+}
+
+func (n *eventNode) Walk(names []string) ([]Qid, Node, error) {
+	qids, node, err := n.Node.Walk(names)
+	if node != nil {
+		node = &eventNode{Node: node, reads: n.reads}
+	}
+	return qids, node, err
+}
+
+func (n *eventNode) Read(p []byte, off uint64) (int, error) {
+	if n.Node.Qid().Type&QTDIR != 0 {
+		return n.Node.Read(p, off)
+	}
+	*n.reads++
+	return copy(p, "event\n"), nil
+}
+
+type eventServer struct {
+	*ramServer
+	reads int
+}
+
+func (es *eventServer) Attach(uname, aname string) (Node, error) {
+	node, err := es.ramServer.Attach(uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	return &eventNode{Node: node, reads: &es.reads}, nil
+}
+
+func TestServerSimpleFallback(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("events", 0444, nil)
+	rfs.add("file", 0644, []byte("old content"))
+	rfs.add("dir/a", 0644, nil)
+	rs := newRamServer(rfs)
+	es := &eventServer{ramServer: rs}
+	var node Node = &eventNode{Node: rs.node(rfs.root)}
+	if _, ok := node.(SimpleReader); ok {
+		t.Fatal("expected a node without SimpleReader")
+	}
+	if _, ok := node.(SimpleWriter); ok {
+		t.Fatal("expected a node without SimpleWriter")
+	}
+	node.Clunk()
+
+	c := serverClient(t, &Server{FS: es}, VersionDote)
+	if _, err := c.Attach(nil, "glenda", ""); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	// The short read of an event file ends the Tsread, rather than reading
+	// events until the message is full.
+	if b, err := c.ReadFile("events"); err != nil || string(b) != "event\n" {
+		t.Errorf("read of event file returned %q, %v", b, err)
+	}
+	if es.reads != 1 {
+		t.Errorf("expected 1 read of event file, got %d", es.reads)
+	}
+
+	// The create of an existing file fails, and the file is truncated by
+	// the open instead.
+	if err := c.WriteFile("file", []byte("new"), 0644); err != nil {
+		t.Errorf("write of existing file failed: %v", err)
+	}
+	if n := rfs.lookup("file"); string(n.data) != "new" {
+		t.Errorf("expected truncated file, got %q", n.data)
+	}
+	if c := rfs.lookup("dir").children; len(c) != 1 {
+		t.Errorf("expected no file to be created, got %d entries", len(c))
+	}
+
+	// A directory cannot be opened for writing once its create fails.
+	if err := c.WriteFile("dir", []byte("x"), 0644); err == nil {
+		t.Error("expected write of directory to fail")
+	}
+
+	if _, live := rs.counts(); live != 1 {
+		t.Errorf("expected only the root to be live, got %d nodes", live)
+	}
+}
@@ -0,0 +1,398 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// ramServer serves a ramFS tree through Server, sharing the file system
+// logic of the raw test server.
+type ramServer struct {
+	fs *ramFS
+	rc *ramConn
+
+	// mu protects attaches and live.
+	mu       sync.Mutex
+	attaches int
+	live     int
+}
+
+func newRamServer(rfs *ramFS) *ramServer {
+	return &ramServer{fs: rfs, rc: &ramConn{fs: rfs, proto: NineP2000}}
+}
+
+func (rs *ramServer) counts() (attaches, live int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.attaches, rs.live
+}
+
+func (rs *ramServer) node(n *ramNode) *ramServerNode {
+	rs.mu.Lock()
+	rs.live++
+	rs.mu.Unlock()
+	return &ramServerNode{rs: rs, fid: &ramFid{node: n}}
+}
+
+func (rs *ramServer) Attach(uname, aname string) (Node, error) {
+	rs.mu.Lock()
+	rs.attaches++
+	rs.mu.Unlock()
+	return rs.node(rs.fs.root), nil
+}
+
+// dial returns a client connection to a new goroutine serving srv.
+func serverDial(srv *Server) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go srv.ServeConn(c2)
+		return c1, nil
+	}
+}
+
+// serverClient returns a negotiated client of srv.
+func serverClient(t *testing.T, srv *Server, version string) *Client {
+	conn, _ := serverDial(srv)()
+	c := NewClient(conn)
+	if err := c.Negotiate(8192, version); err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+type ramServerNode struct {
+	rs  *ramServer
+	fid *ramFid
+}
+
+func ramError(msg string) error {
+	switch msg {
+	case "":
+		return nil
+	case "file does not exist":
+		return fs.ErrNotExist
+	case "file exists":
+		return fs.ErrExist
+	case "permission denied":
+		return fs.ErrPermission
+	default:
+		return errors.New(msg)
+	}
+}
+
+func (n *ramServerNode) lock() func() {
+	n.rs.fs.mu.Lock()
+	return n.rs.fs.mu.Unlock
+}
+
+func (n *ramServerNode) Qid() Qid {
+	defer n.lock()()
+	return n.fid.node.qid
+}
+
+func (n *ramServerNode) Walk(names []string) ([]Qid, Node, error) {
+	unlock := n.lock()
+	node, qids := n.rs.rc.walk(n.fid.node, names)
+	unlock()
+	if len(names) > 0 && len(qids) == 0 {
+		return nil, nil, fs.ErrNotExist
+	}
+	if len(qids) < len(names) {
+		return qids, nil, nil
+	}
+	return qids, n.rs.node(node), nil
+}
+
+func (n *ramServerNode) Open(mode OpenMode) (uint32, error) {
+	defer n.lock()()
+	return n.rs.fs.iounit, ramError(n.rs.rc.open(n.fid, mode))
+}
+
+func (n *ramServerNode) Create(name string, perm FileMode, mode OpenMode) (Node, uint32, error) {
+	unlock := n.lock()
+	node, msg := n.rs.rc.create(n.fid.node, name, perm)
+	if msg != "" {
+		unlock()
+		return nil, 0, ramError(msg)
+	}
+	unlock()
+	nn := n.rs.node(node)
+	iounit, err := nn.Open(mode)
+	return nn, iounit, err
+}
+
+func (n *ramServerNode) Read(p []byte, off uint64) (int, error) {
+	defer n.lock()()
+	return copy(p, n.rs.rc.read(n.fid, off, uint32(len(p)))), nil
+}
+
+func (n *ramServerNode) ReadDir() ([]Stat, error) {
+	defer n.lock()()
+	var stats []Stat
+	for _, c := range n.fid.node.children {
+		stats = append(stats, c.stat())
+	}
+	return stats, nil
+}
+
+func (n *ramServerNode) Write(p []byte, off uint64) (int, error) {
+	defer n.lock()()
+	return int(n.rs.rc.write(n.fid, off, p)), nil
+}
+
+func (n *ramServerNode) Stat() (Stat, error) {
+	defer n.lock()()
+	return n.fid.node.stat(), nil
+}
+
+func (n *ramServerNode) WriteStat(s Stat) error {
+	defer n.lock()()
+	return ramError(n.rs.rc.wstat(n.fid.node, &s))
+}
+
+func (n *ramServerNode) Remove() error {
+	unlock := n.lock()
+	err := ramError(n.rs.rc.remove(n.fid.node))
+	unlock()
+	n.Clunk()
+	return err
+}
+
+func (n *ramServerNode) Clunk() error {
+	n.rs.mu.Lock()
+	n.rs.live--
+	n.rs.mu.Unlock()
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	for _, version := range []string{Version, VersionDotu, VersionDote} {
+		rfs := newRamFS()
+		rfs.iounit = 200
+		rfs.add("hello.txt", 0644, []byte("hello, world\n"))
+		rfs.add("dir/a", 0644, []byte("a"))
+		rfs.add("dir/sub/b", 0444, make([]byte, 1000))
+		rs := newRamServer(rfs)
+		srv := &Server{FS: rs}
+
+		c := serverClient(t, srv, version)
+		root, err := c.Attach(nil, "glenda", "")
+		if err != nil {
+			t.Fatalf("%s: attach failed: %v", version, err)
+		}
+		if err := fstest.TestFS(NewFS(root), "hello.txt", "dir/a", "dir/sub/b"); err != nil {
+			t.Errorf("%s: %v", version, err)
+		}
+
+		if err := c.WriteFile("dir/new", []byte("new"), 0600); err != nil {
+			t.Errorf("%s: write failed: %v", version, err)
+		}
+		if err := c.Rename("dir/new", "dir/renamed"); err != nil {
+			t.Errorf("%s: rename failed: %v", version, err)
+		}
+		if b, err := c.ReadFile("dir/renamed"); err != nil || string(b) != "new" {
+			t.Errorf("%s: read returned %q, %v", version, b, err)
+		}
+		if err := c.Remove("dir/renamed"); err != nil {
+			t.Errorf("%s: remove failed: %v", version, err)
+		}
+		if _, err := c.Stat("dir/renamed"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist, got %v", version, err)
+		}
+
+		f, err := root.Walk("hello.txt")
+		if err != nil {
+			t.Fatalf("%s: walk failed: %v", version, err)
+		}
+		if _, err := f.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: expected read of unopened file to fail", version)
+		}
+		if err := f.Open(OREAD); err != nil {
+			t.Errorf("%s: open failed: %v", version, err)
+		}
+		if err := f.Open(OREAD); err == nil || err.Error() != ErrFidOpen.Error() {
+			t.Errorf("%s: expected %v, got %v", version, ErrFidOpen, err)
+		}
+		if _, err := f.Write([]byte("x")); err == nil || err.Error() != ErrFidNotOpen.Error() {
+			t.Errorf("%s: expected %v, got %v", version, ErrFidNotOpen, err)
+		}
+
+		// All nodes but the root and the open file must have been
+		// released, and closing the connection releases the rest.
+		if _, live := rs.counts(); live != 2 {
+			t.Errorf("%s: expected 2 live nodes, got %d", version, live)
+		}
+		c.Close()
+		srv.Close()
+		if _, live := rs.counts(); live != 0 {
+			t.Errorf("%s: expected no live nodes, got %d", version, live)
+		}
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		version  string
+		expected string
+	}{
+		{nil, VersionDotu, VersionDotu},
+		{nil, "9P2000.L", Version},
+		{[]string{VersionDote}, "9P2000.L", UnknownVersion},
+		{nil, "10P", UnknownVersion},
+	}
+
+	for i, tt := range tests {
+		srv := &Server{Versions: tt.offered}
+		if v, _ := srv.negotiateVersion(tt.version); v != tt.expected {
+			t.Errorf("test %d: expected %s, got %s", i, tt.expected, v)
+		}
+	}
+}
+
+// blockNode wraps a node, blocking reads until release is closed. If ctx is
+// set, the node implements ContextReader, whose reads also return once the
+// request is cancelled.
+type blockNode struct {
+	Node
+	release chan struct{}
+	ctx     bool
+}
+
+type blockContextNode struct{ *blockNode }
+
+func (n *blockNode) wrap(node Node) Node {
+	bn := &blockNode{Node: node, release: n.release, ctx: n.ctx}
+	if n.ctx {
+		return blockContextNode{bn}
+	}
+	return bn
+}
+
+func (n *blockNode) Walk(names []string) ([]Qid, Node, error) {
+	qids, node, err := n.Node.Walk(names)
+	if node != nil {
+		node = n.wrap(node)
+	}
+	return qids, node, err
+}
+
+func (n *blockNode) Read(p []byte, off uint64) (int, error) {
+	<-n.release
+	return n.Node.Read(p, off)
+}
+
+func (n blockContextNode) ReadContext(ctx context.Context, p []byte, off uint64) (int, error) {
+	select {
+	case <-n.release:
+		return n.Node.Read(p, off)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// blockFS serves a ramServer through blockNodes.
+type blockFS struct {
+	*blockNode
+	rs *ramServer
+}
+
+func newBlockFS(rfs *ramFS, ctx bool) *blockFS {
+	return &blockFS{
+		blockNode: &blockNode{release: make(chan struct{}), ctx: ctx},
+		rs:        newRamServer(rfs),
+	}
+}
+
+func (bfs *blockFS) Attach(uname, aname string) (Node, error) {
+	node, err := bfs.rs.Attach(uname, aname)
+	if err != nil {
+		return nil, err
+	}
+	return bfs.wrap(node), nil
+}
+
+func TestServerFlush(t *testing.T) {
+	for _, ctx := range []bool{false, true} {
+		rfs := newRamFS()
+		rfs.add("events", 0444, []byte("event"))
+		bfs := newBlockFS(rfs, ctx)
+		srv := &Server{FS: bfs}
+		c := serverClient(t, srv, Version)
+		root, err := c.Attach(nil, "glenda", "")
+		if err != nil {
+			t.Fatalf("ctx %v: attach failed: %v", ctx, err)
+		}
+		f, err := root.Walk("events")
+		if err != nil {
+			t.Fatalf("ctx %v: walk failed: %v", ctx, err)
+		}
+		if err := f.Open(OREAD); err != nil {
+			t.Fatalf("ctx %v: open failed: %v", ctx, err)
+		}
+
+		// The flush is answered while the read is still blocked, whether
+		// or not the node honors the cancellation.
+		rctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = f.ReadContext(rctx, make([]byte, 10))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ctx %v: expected context.DeadlineExceeded, got %v", ctx, err)
+		}
+
+		close(bfs.release)
+		b := make([]byte, 10)
+		if n, err := f.ReadAt(b, 0); string(b[:n]) != "event" {
+			t.Errorf("ctx %v: read returned %q, %v", ctx, b[:n], err)
+		}
+		c.Close()
+		srv.Close()
+	}
+}
+
+func TestServerCloseCancels(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("events", 0444, []byte("event"))
+	srv := &Server{FS: newBlockFS(rfs, true)}
+	c := serverClient(t, srv, Version)
+	root, err := c.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	f, err := root.Walk("events")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if err := f.Open(OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := f.Read(make([]byte, 10))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on a pending read")
+	}
+	if err := <-errc; err == nil {
+		t.Error("expected pending read to fail")
+	}
+}
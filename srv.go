@@ -0,0 +1,218 @@
+package qp
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrInvalidServiceName indicates a service name that cannot be used as
+	// a file name in the namespace directory, or contains a '!', which
+	// would keep its socket from being named in a dial string.
+	ErrInvalidServiceName = errors.New("invalid service name")
+
+	// ErrInvalidNamespace indicates an attempt to post to a namespace
+	// directory whose path contains a '!', which would keep its sockets
+	// from being named in a dial string.
+	ErrInvalidNamespace = errors.New("invalid namespace directory")
+
+	// ErrServiceExists indicates an attempt to post a service under the name
+	// of a live service.
+	ErrServiceExists = errors.New("service exists")
+
+	// ErrInsecureNamespace indicates a namespace directory that is not a
+	// directory of mode 0700 owned by the user, such as a symbolic link or
+	// a directory accessible to other users.
+	ErrInsecureNamespace = errors.New("namespace directory accessible to others")
+)
+
+// probeTimeout limits how long a posted socket may take to accept a
+// connection when probing whether it is stale.
+const probeTimeout = time.Second
+
+// NamespaceDir returns the namespace directory of the user as used by
+// plan9port, which is $NAMESPACE if set, and /tmp/ns.$USER.$DISPLAY
+// otherwise, with the screen number removed from the display.
+func NamespaceDir() (string, error) {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("LOGNAME")
+	}
+	if user == "" {
+		return "", errors.New("cannot determine user")
+	}
+	display := os.Getenv("DISPLAY")
+	if display == "" {
+		display = ":0"
+	}
+	if i := strings.LastIndexByte(display, ':'); i >= 0 {
+		if j := strings.IndexByte(display[i:], '.'); j >= 0 {
+			display = display[:i+j]
+		}
+	}
+	return filepath.Join(os.TempDir(), "ns."+user+"."+display), nil
+}
+
+// Registry publishes named services as unix sockets in a directory, like
+// /srv on Plan 9 and the namespace directory of plan9port.
+type Registry struct {
+	// Dir is the directory holding the sockets. It is created by Post if
+	// missing, and must be a directory of mode 0700 owned by the user,
+	// rather than a symbolic link to one.
+	Dir string
+}
+
+// NewRegistry returns a registry for the namespace directory of the user.
+// See NamespaceDir.
+func NewRegistry() (*Registry, error) {
+	dir, err := NamespaceDir()
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{Dir: dir}, nil
+}
+
+// validName reports whether the name may be used for a service.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/!")
+}
+
+// path returns the path of the socket for the service.
+func (r *Registry) path(name string) (string, error) {
+	if !validName(name) {
+		return "", ErrInvalidServiceName
+	}
+	return filepath.Join(r.Dir, name), nil
+}
+
+// checkDir verifies that the directory is a directory of mode 0700 owned by
+// the user, without following symbolic links, so that no one else can post
+// or replace the sockets in it.
+func (r *Registry) checkDir(op string) error {
+	fi, err := os.Lstat(r.Dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return &fs.PathError{Op: op, Path: r.Dir, Err: ErrInsecureNamespace}
+	case !fi.IsDir():
+		return &fs.PathError{Op: op, Path: r.Dir, Err: ErrNotDirectory}
+	case fi.Mode().Perm() != 0700:
+		return &fs.PathError{Op: op, Path: r.Dir, Err: ErrInsecureNamespace}
+	}
+	if uid, ok := fileOwner(fi); ok && uid != os.Getuid() {
+		return &fs.PathError{Op: op, Path: r.Dir, Err: ErrInsecureNamespace}
+	}
+	return nil
+}
+
+// prepare creates the directory if needed, and verifies it.
+func (r *Registry) prepare() error {
+	if err := os.MkdirAll(r.Dir, 0700); err != nil {
+		return err
+	}
+	return r.checkDir("post")
+}
+
+// stale reports whether the socket at the path has no server listening on
+// it, which is the case if connecting is refused.
+func stale(path string) bool {
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
+
+// Post publishes the server under the name, serving it in the background
+// until the returned listener is closed or the server is closed, either of
+// which removes the socket. A stale socket left behind by a server that
+// exited without removing it is replaced.
+func (r *Registry) Post(name string, srv *Server) (*Listener, error) {
+	path, err := r.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsRune(r.Dir, '!') {
+		return nil, ErrInvalidNamespace
+	}
+	if err := r.prepare(); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		if !stale(path) {
+			return nil, &fs.PathError{Op: "post", Path: path, Err: ErrServiceExists}
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go srv.Serve(l)
+	return l, nil
+}
+
+// List returns the names of the posted services, sorted by name. Stale
+// sockets are removed and left out.
+func (r *Registry) List() ([]string, error) {
+	if err := r.checkDir("list"); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.Type()&fs.ModeSocket == 0 || !validName(e.Name()) {
+			continue
+		}
+		path := filepath.Join(r.Dir, e.Name())
+		if stale(path) {
+			os.Remove(path)
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DialService dials the service posted under the name, negotiating the
+// protocol version as Dial does.
+func (r *Registry) DialService(name string) (*Conn, error) {
+	path, err := r.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkDir("dial"); err != nil {
+		return nil, err
+	}
+	var d Dialer
+	return d.dial(context.Background(), "unix", path)
+}
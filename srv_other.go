@@ -0,0 +1,11 @@
+//go:build !unix
+
+package qp
+
+import "io/fs"
+
+// fileOwner returns the user id of the owner of the file, which is not known
+// on this platform.
+func fileOwner(fi fs.FileInfo) (int, bool) {
+	return 0, false
+}
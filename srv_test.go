@@ -0,0 +1,151 @@
+package qp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceDir(t *testing.T) {
+	t.Setenv("NAMESPACE", "")
+	t.Setenv("USER", "glenda")
+	t.Setenv("DISPLAY", "localhost:10.0")
+	if dir, err := NamespaceDir(); err != nil || dir != filepath.Join(os.TempDir(), "ns.glenda.localhost:10") {
+		t.Errorf("unexpected namespace directory %s, %v", dir, err)
+	}
+	t.Setenv("NAMESPACE", "/tmp/ns")
+	if dir, err := NamespaceDir(); err != nil || dir != "/tmp/ns" {
+		t.Errorf("expected $NAMESPACE, got %s, %v", dir, err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("content"))
+	srv := &Server{FS: newRamServer(rfs)}
+	defer srv.Close()
+
+	r := &Registry{Dir: filepath.Join(t.TempDir(), "ns")}
+	if names, err := r.List(); err != nil || len(names) != 0 {
+		t.Errorf("expected no services, got %v, %v", names, err)
+	}
+
+	l, err := r.Post("ramfs", srv)
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	if fi, err := os.Stat(r.Dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("unexpected namespace directory: %v, %v", fi, err)
+	}
+	if _, err := r.Post("ramfs", srv); !errors.Is(err, ErrServiceExists) {
+		t.Errorf("expected ErrServiceExists, got %v", err)
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "tcp!host"} {
+		if _, err := r.Post(name, srv); err != ErrInvalidServiceName {
+			t.Errorf("%q: expected ErrInvalidServiceName, got %v", name, err)
+		}
+	}
+	bang := &Registry{Dir: r.Dir + "!x"}
+	if _, err := bang.Post("ramfs", srv); err != ErrInvalidNamespace {
+		t.Errorf("expected ErrInvalidNamespace, got %v", err)
+	}
+
+	conn, err := r.DialService("ramfs")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	c := NewClientConn(conn)
+	defer c.Close()
+	if _, err := c.Attach(nil, "glenda", ""); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if b, err := c.ReadFile("file"); err != nil || string(b) != "content" {
+		t.Errorf("read returned %q, %v", b, err)
+	}
+
+	// A socket left behind by a server that exited is stale.
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(r.Dir, "stale"), Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	os.WriteFile(filepath.Join(r.Dir, "other"), nil, 0600)
+
+	if names, err := r.List(); err != nil || !reflect.DeepEqual(names, []string{"ramfs"}) {
+		t.Errorf("expected only live service, got %v, %v", names, err)
+	}
+	if _, err := os.Lstat(filepath.Join(r.Dir, "stale")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected stale socket to be removed, got %v", err)
+	}
+
+	l.Close()
+	if names, err := r.List(); err != nil || len(names) != 0 {
+		t.Errorf("expected no services after close, got %v, %v", names, err)
+	}
+
+	os.Chmod(r.Dir, 0755)
+	if _, err := r.Post("ramfs", srv); !errors.Is(err, ErrInsecureNamespace) {
+		t.Errorf("expected ErrInsecureNamespace, got %v", err)
+	}
+}
+
+func TestRegistryDir(t *testing.T) {
+	srv := &Server{FS: newRamServer(newRamFS())}
+	defer srv.Close()
+	tmp := t.TempDir()
+
+	// Services may be dialed in directories whose path cannot be named in a
+	// dial string, although they cannot be posted to.
+	bang := &Registry{Dir: filepath.Join(tmp, "ns!x")}
+	if err := os.Mkdir(bang.Dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listen("unix", filepath.Join(bang.Dir, "ramfs"))
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go srv.Serve(l)
+	conn, err := bang.DialService("ramfs")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	// Symbolic links, directories accessible to others and directories of
+	// other users are rejected by all operations.
+	link := &Registry{Dir: filepath.Join(tmp, "link")}
+	if err := os.Symlink(bang.Dir, link.Dir); err != nil {
+		t.Fatal(err)
+	}
+	open := &Registry{Dir: filepath.Join(tmp, "open")}
+	if err := os.Mkdir(open.Dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(open.Dir, 0750)
+	insecure := []*Registry{link, open}
+	if os.Getuid() == 0 {
+		other := &Registry{Dir: filepath.Join(tmp, "other")}
+		if err := os.Mkdir(other.Dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(other.Dir, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		insecure = append(insecure, other)
+	}
+	for _, r := range insecure {
+		if _, err := r.Post("new", srv); !errors.Is(err, ErrInsecureNamespace) {
+			t.Errorf("%s: expected post to fail with ErrInsecureNamespace, got %v", r.Dir, err)
+		}
+		if _, err := r.List(); !errors.Is(err, ErrInsecureNamespace) {
+			t.Errorf("%s: expected list to fail with ErrInsecureNamespace, got %v", r.Dir, err)
+		}
+		if _, err := r.DialService("ramfs"); !errors.Is(err, ErrInsecureNamespace) {
+			t.Errorf("%s: expected dial to fail with ErrInsecureNamespace, got %v", r.Dir, err)
+		}
+	}
+}
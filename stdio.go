@@ -0,0 +1,86 @@
+package qp
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// pipeConn joins the two ends of a pair of pipes into a connection.
+type pipeConn struct {
+	io.Reader
+	io.Writer
+
+	// close closes the connection.
+	close func() error
+}
+
+func (pc *pipeConn) Close() error {
+	return pc.close()
+}
+
+// ServeStdio serves a single connection on the standard input and output of
+// the process, as when run by ssh or by CommandConn, returning once the
+// standard input reaches end of file and all requests have been handled.
+// On unix systems other than Solaris and illumos, the messages are sent on a
+// duplicate of the standard output, and file descriptor 1 refers to the
+// standard error while serving, so that output of the file server and of
+// the programs it runs cannot corrupt the messages. Elsewhere, the file
+// server must not write to the standard output itself.
+func (s *Server) ServeStdio() error {
+	stdout, restore, err := stdioOutput()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	conn := &pipeConn{Reader: os.Stdin, Writer: stdout, close: func() error { return nil }}
+	return s.ServeConn(conn)
+}
+
+// commandExitTimeout is how long a command is given to exit once its
+// standard input is closed, before it is killed.
+const commandExitTimeout = 5 * time.Second
+
+// CommandConn starts the command, and returns a connection to the 9P server
+// it serves on its standard input and output, such as one running
+// Server.ServeStdio. If the standard error of the command is not set, it is
+// passed on to the standard error of the process, keeping it apart from the
+// messages. Closing the connection closes the standard input of the command,
+// and waits for it to exit, killing it if it has not exited after a few
+// seconds. The connection is not negotiated; see NewClient.
+func CommandConn(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	var werr error
+	stop := func() error {
+		once.Do(func() {
+			stdin.Close()
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			select {
+			case werr = <-done:
+			case <-time.After(commandExitTimeout):
+				cmd.Process.Kill()
+				werr = <-done
+			}
+		})
+		return werr
+	}
+	return &pipeConn{Reader: stdout, Writer: stdin, close: stop}, nil
+}
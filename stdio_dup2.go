@@ -0,0 +1,10 @@
+//go:build unix && !linux && !solaris
+
+package qp
+
+import "syscall"
+
+// dup2 makes newfd refer to the file of oldfd.
+func dup2(oldfd, newfd int) error {
+	return syscall.Dup2(oldfd, newfd)
+}
@@ -0,0 +1,9 @@
+package qp
+
+import "syscall"
+
+// dup2 makes newfd refer to the file of oldfd, with dup3 as some
+// architectures lack dup2.
+func dup2(oldfd, newfd int) error {
+	return syscall.Dup3(oldfd, newfd, 0)
+}
@@ -0,0 +1,68 @@
+package qp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// chattyServer prints to the standard output on every attach.
+type chattyServer struct {
+	FileServer
+}
+
+func (cs chattyServer) Attach(uname, aname string) (Node, error) {
+	fmt.Println("attach by", uname)
+	return cs.FileServer.Attach(uname, aname)
+}
+
+// TestStdioServer is not a test, but the server run by TestStdio in a
+// process of its own.
+func TestStdioServer(t *testing.T) {
+	if os.Getenv("QP_STDIO_SERVER") != "1" {
+		t.Skip("run by TestStdio")
+	}
+	rfs := newRamFS()
+	rfs.add("file", 0644, []byte("content"))
+	srv := &Server{FS: chattyServer{newRamServer(rfs)}}
+	if err := srv.ServeStdio(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestStdio(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("standard output not redirected on " + runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStdioServer$")
+	cmd.Env = append(os.Environ(), "QP_STDIO_SERVER=1")
+	cmd.Stderr = &stderr
+	conn, err := CommandConn(cmd)
+	if err != nil {
+		t.Fatalf("starting server failed: %v", err)
+	}
+
+	c := NewClient(conn)
+	if err := c.Negotiate(8192, VersionDotu); err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	if _, err := c.Attach(nil, "glenda", ""); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if b, err := c.ReadFile("file"); err != nil || string(b) != "content" {
+		t.Errorf("read returned %q, %v", b, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("close failed: %v, stderr %q", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "attach by glenda") {
+		t.Errorf("expected output of the server on stderr, got %q", stderr.String())
+	}
+}
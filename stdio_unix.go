@@ -0,0 +1,33 @@
+//go:build unix && !solaris
+
+package qp
+
+import (
+	"os"
+	"syscall"
+)
+
+// stdioOutput returns a duplicate of the standard output for the messages
+// of ServeStdio, and makes file descriptor 1 refer to the standard error,
+// until the returned function restores it.
+func stdioOutput() (*os.File, func(), error) {
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Dup(1)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := dup2(2, 1); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	out := os.NewFile(uintptr(fd), "/dev/stdout")
+	restore := func() {
+		dup2(fd, 1)
+		out.Close()
+	}
+	return out, restore, nil
+}
@@ -0,0 +1,122 @@
+package qp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"slices"
+)
+
+// ALPNProtocol is the protocol negotiated with ALPN by TLS connections
+// carrying 9P.
+const ALPNProtocol = "9p"
+
+var (
+	// ErrNoCertificate indicates a connection without a verified client
+	// certificate, as only TLS connections whose client presented a
+	// certificate that verified against the configured roots provide one.
+	ErrNoCertificate = errors.New("no verified client certificate")
+
+	// ErrALPN indicates a TLS connection that did not negotiate
+	// ALPNProtocol, such as one whose other end does not support ALPN, or
+	// chose another protocol offered by the configuration.
+	ErrALPN = errors.New("TLS connection did not negotiate " + ALPNProtocol)
+)
+
+// tlsConfig returns a copy of the configuration negotiating ALPNProtocol.
+func tlsConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if !slices.Contains(config.NextProtos, ALPNProtocol) {
+		config.NextProtos = append(config.NextProtos, ALPNProtocol)
+	}
+	return config
+}
+
+// checkALPN completes the TLS handshake of a connection, and verifies that it
+// negotiated ALPNProtocol. Connections other than TLS connections pass.
+func checkALPN(conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	if tc.ConnectionState().NegotiatedProtocol != ALPNProtocol {
+		return ErrALPN
+	}
+	return nil
+}
+
+// ListenTLS is like Listen, but secures the connections accepted with TLS,
+// negotiating ALPNProtocol. Connections that do not negotiate it are closed. To identify users by their certificates, the
+// configuration should require and verify client certificates, and the
+// server should set Server.TLSCredentials.
+func ListenTLS(addr string, config *tls.Config) (*Listener, error) {
+	l, err := Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	l.l = tls.NewListener(l.l, tlsConfig(config))
+	return l, nil
+}
+
+// DialTLS dials the dial string with TLS, negotiating ALPNProtocol, and
+// negotiates the protocol version with the default options of Dialer. It
+// fails with ErrALPN if the server does not negotiate ALPNProtocol. The
+// configuration holds the client certificate, if any.
+func DialTLS(addr string, config *tls.Config) (*Conn, error) {
+	d := &Dialer{TLSConfig: config}
+	return d.Dial(addr)
+}
+
+// connCertificate returns the verified client certificate of a connection,
+// unwrapping negotiated connections and completing the TLS handshake if
+// needed.
+func connCertificate(rw io.ReadWriteCloser) (*x509.Certificate, error) {
+	if c, ok := rw.(*Conn); ok {
+		rw = c.Conn
+	}
+	tc, ok := rw.(*tls.Conn)
+	if !ok {
+		return nil, ErrNoCertificate
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, ErrNoCertificate
+	}
+	return state.PeerCertificates[0], nil
+}
+
+// certificateNames returns the names a certificate identifies its subject
+// by: the common name of the subject, and the DNS names and email addresses
+// of its subject alternative names.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	return append(names, cert.EmailAddresses...)
+}
+
+// CheckCertificate is a Server.TLSCredentials policy that only permits
+// attaches whose user name is one of the names of the client certificate:
+// the common name of its subject, or one of the DNS names or email addresses
+// of its subject alternative names. Attaches over connections without a
+// verified client certificate are rejected.
+func CheckCertificate(cert *x509.Certificate, uname string, uidno uint32) (string, error) {
+	if cert == nil {
+		return "", ErrNoCertificate
+	}
+	if !slices.Contains(certificateNames(cert), uname) {
+		return "", fs.ErrPermission
+	}
+	return uname, nil
+}
@@ -0,0 +1,186 @@
+package qp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for the template, signed by the parent, or
+// self-signed if parent is nil.
+func testCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "qp test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	serverCert := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "fileserver"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := func(cn string, emails ...string) tls.Certificate {
+		return testCert(t, &x509.Certificate{
+			Subject:        pkix.Name{CommonName: cn},
+			EmailAddresses: emails,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+	}
+	glenda := client("glenda", "glenda@example.org")
+
+	srv := &Server{FS: newRamServer(newRamFS()), TLSCredentials: CheckCertificate}
+	defer srv.Close()
+	l, err := ListenTLS("tcp!127.0.0.1!0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    roots,
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go srv.Serve(l)
+	addr := "tcp!127.0.0.1!" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	dial := func(certs ...tls.Certificate) *Client {
+		conn, err := DialTLS(addr, &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		if p := conn.Conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != ALPNProtocol {
+			t.Errorf("negotiated protocol %q", p)
+		}
+		c := NewClientConn(conn)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	c := dial(glenda)
+	for _, user := range []string{"glenda", "glenda@example.org"} {
+		root, err := c.Attach(nil, user, "")
+		if err != nil {
+			t.Fatalf("attach as %s failed: %v", user, err)
+		}
+		if _, err := root.Stat(); err != nil {
+			t.Errorf("stat failed: %v", err)
+		}
+	}
+	if _, err := c.Attach(nil, "bootes", ""); err == nil {
+		t.Error("attach as a user not named by the certificate succeeded")
+	}
+
+	// Without a certificate, nobody can attach.
+	if _, err := dial().Attach(nil, "glenda", ""); err == nil {
+		t.Error("attach without a certificate succeeded")
+	}
+
+	// Certificates of other authorities are not accepted.
+	other := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "glenda"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+	conn, err := DialTLS(addr, &tls.Config{
+		RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &other, nil
+		},
+	})
+	if err == nil {
+		c := NewClientConn(conn)
+		defer c.Close()
+		_, err = c.Attach(nil, "glenda", "")
+	}
+	if err == nil {
+		t.Error("attach with a certificate of another authority succeeded")
+	}
+}
+
+func TestTLSALPN(t *testing.T) {
+	cert := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "fileserver"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	srv := &Server{FS: newRamServer(newRamFS())}
+	defer srv.Close()
+	l, err := ListenTLS("tcp!127.0.0.1!0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go srv.Serve(l)
+	addr := l.Addr().String()
+
+	// Clients that do not negotiate the protocol, whether by not using ALPN
+	// or by choosing another protocol of the server, are disconnected.
+	for _, protos := range [][]string{nil, {"h2"}} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: protos})
+		if err != nil {
+			t.Fatalf("%v: dial failed: %v", protos, err)
+		}
+		if _, _, err := handshake(&Encoder{Protocol: NineP2000, Writer: conn}, &Decoder{Protocol: NineP2000, Reader: conn}, 8192, Version, nil); err == nil {
+			t.Errorf("%v: expected connection to be rejected", protos)
+		}
+		conn.Close()
+	}
+	conn, err := DialTLS("tcp!"+strings.Replace(addr, ":", "!", 1), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	// Servers that do not negotiate the protocol are rejected as well.
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer tl.Close()
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(c)
+		}
+	}()
+	if _, err := DialTLS("tcp!"+strings.Replace(tl.Addr().String(), ":", "!", 1), &tls.Config{RootCAs: roots}); err != ErrALPN {
+		t.Errorf("expected ErrALPN, got %v", err)
+	}
+}
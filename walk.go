@@ -0,0 +1,109 @@
+package qp
+
+import "strings"
+
+// SplitPath splits a slash-separated path into names suitable for a walk.
+// Empty and "." elements are dropped, and ".." elements are resolved
+// lexically against the preceding name, as done by Plan 9. A ".." at the
+// start of a relative path is kept, walking to the parent of the starting
+// fid, while a ".." at the root of an absolute path is dropped, as the root is
+// its own parent.
+func SplitPath(path string) []string {
+	abs := strings.HasPrefix(path, "/")
+	names := make([]string, 0, strings.Count(path, "/")+1)
+	for _, n := range strings.Split(path, "/") {
+		switch n {
+		case "", ".":
+		case "..":
+			switch {
+			case len(names) > 0 && names[len(names)-1] != "..":
+				names = names[:len(names)-1]
+			case !abs:
+				names = append(names, n)
+			}
+		default:
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// WalkComplete reports whether a walk response covers all the names of the
+// walk request. A shorter list of qids indicates a partial walk, in which
+// case the new fid has not been affected by the request.
+func WalkComplete(req *WalkRequest, resp *WalkResponse) bool {
+	return len(resp.Qids) == len(req.Names)
+}
+
+// WalkPlan describes a walk of an arbitrary amount of names from Fid to
+// NewFid. As a single walk request may carry at most MAXWELEM names, longer
+// walks are split into several requests, the first walking from Fid to
+// NewFid, and the rest walking NewFid in place.
+type WalkPlan struct {
+	// Fid is the fid to walk from.
+	Fid Fid
+
+	// NewFid is the fid to assign the walked file to.
+	NewFid Fid
+
+	// Names are the names to walk.
+	Names []string
+}
+
+// NewWalkPlan returns a plan for walking the provided path. See SplitPath for
+// the path semantics.
+func NewWalkPlan(fid, newfid Fid, path string) *WalkPlan {
+	return &WalkPlan{
+		Fid:    fid,
+		NewFid: newfid,
+		Names:  SplitPath(path),
+	}
+}
+
+// Requests returns the walk requests that make up the plan. The tags of the
+// requests are left for the caller to assign. A plan without names results in
+// a single request that clones Fid to NewFid. The requests must be sent in
+// order, and a request must only be sent if the previous one completed.
+func (wp *WalkPlan) Requests() []*WalkRequest {
+	if len(wp.Names) == 0 {
+		return []*WalkRequest{{Fid: wp.Fid, NewFid: wp.NewFid, Names: []string{}}}
+	}
+
+	var reqs []*WalkRequest
+	fid := wp.Fid
+	for i := 0; i < len(wp.Names); i += MAXWELEM {
+		end := i + MAXWELEM
+		if end > len(wp.Names) {
+			end = len(wp.Names)
+		}
+		reqs = append(reqs, &WalkRequest{Fid: fid, NewFid: wp.NewFid, Names: wp.Names[i:end]})
+		fid = wp.NewFid
+	}
+	return reqs
+}
+
+// Result collects the qids from the responses to the requests of the plan,
+// which must be provided in order. It returns the qids of all walked names,
+// and whether the walk covers the whole path. If the walk is incomplete,
+// NewFid exists only if Established reports so, in which case it refers to
+// the file walked by the last complete request.
+func (wp *WalkPlan) Result(resps []*WalkResponse) ([]Qid, bool) {
+	var qids []Qid
+	reqs := wp.Requests()
+	for i, resp := range resps {
+		if i >= len(reqs) {
+			break
+		}
+		qids = append(qids, resp.Qids...)
+		if !WalkComplete(reqs[i], resp) {
+			return qids, false
+		}
+	}
+	return qids, len(resps) >= len(reqs)
+}
+
+// Established reports whether NewFid has been assigned by the responses to
+// the requests of the plan, which is the case if the first request completed.
+func (wp *WalkPlan) Established(resps []*WalkResponse) bool {
+	return len(resps) > 0 && WalkComplete(wp.Requests()[0], resps[0])
+}
@@ -0,0 +1,90 @@
+package qp
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"/", []string{}},
+		{"a", []string{"a"}},
+		{"/a//b/./c/", []string{"a", "b", "c"}},
+		{"/a/b/../c", []string{"a", "c"}},
+		{"/../a", []string{"a"}},
+		{"../a", []string{"..", "a"}},
+		{"a/../../b", []string{"..", "b"}},
+		{"../../a/..", []string{"..", ".."}},
+	}
+
+	for i, tt := range tests {
+		if names := SplitPath(tt.path); !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("test %d: %q split to %q, expected %q", i, tt.path, names, tt.expected)
+		}
+	}
+}
+
+func TestWalkPlan(t *testing.T) {
+	path := ""
+	for i := 0; i < 40; i++ {
+		path += "/" + strconv.Itoa(i)
+	}
+	wp := NewWalkPlan(1, 2, path)
+
+	reqs := wp.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+	for i, req := range reqs {
+		if len(req.Names) > MAXWELEM {
+			t.Errorf("request %d has %d names", i, len(req.Names))
+		}
+		if (i == 0 && req.Fid != 1) || (i > 0 && req.Fid != 2) || req.NewFid != 2 {
+			t.Errorf("request %d walks from %d to %d", i, req.Fid, req.NewFid)
+		}
+	}
+	if reqs[2].Names[0] != "32" || reqs[2].Names[7] != "39" {
+		t.Errorf("last request has unexpected names: %v", reqs[2].Names)
+	}
+
+	resp := func(n int) *WalkResponse {
+		return &WalkResponse{Qids: make([]Qid, n)}
+	}
+
+	tests := []struct {
+		resps       []*WalkResponse
+		qids        int
+		complete    bool
+		established bool
+	}{
+		{[]*WalkResponse{resp(16), resp(16), resp(8)}, 40, true, true},
+		{[]*WalkResponse{resp(16), resp(16)}, 32, false, true},
+		{[]*WalkResponse{resp(16), resp(3)}, 19, false, true},
+		{[]*WalkResponse{resp(5)}, 5, false, false},
+		{nil, 0, false, false},
+	}
+
+	for i, tt := range tests {
+		qids, complete := wp.Result(tt.resps)
+		if len(qids) != tt.qids || complete != tt.complete {
+			t.Errorf("test %d: expected %d qids, complete %v, got %d, %v", i, tt.qids, tt.complete, len(qids), complete)
+		}
+		if e := wp.Established(tt.resps); e != tt.established {
+			t.Errorf("test %d: expected established %v, got %v", i, tt.established, e)
+		}
+	}
+
+	clone := NewWalkPlan(1, 2, "/")
+	reqs = clone.Requests()
+	if len(reqs) != 1 || len(reqs[0].Names) != 0 {
+		t.Fatalf("clone plan produced unexpected requests: %v", reqs)
+	}
+	if _, complete := clone.Result([]*WalkResponse{resp(0)}); !complete {
+		t.Errorf("clone was not complete")
+	}
+}